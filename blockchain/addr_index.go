@@ -0,0 +1,210 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"slices"
+)
+
+// 地址索引, 记录每个地址(公钥哈希)参与的主链交易和余额, 键的第一个字节区分记录的种类:
+// 'h' + 公钥哈希 + 高度 + 交易ID	-> 交易使该地址余额的变化量
+// 'b' + 公钥哈希					-> 地址的余额, 余额为 0 时删除
+// 'o' + 交易ID + 输出序号			-> 输出的公钥哈希和金额, 用于计算花费该输出的交易的变化量
+// 公钥哈希的长度固定, 同一地址的交易记录按高度排列在一起
+const addrIndexBucket = "addrindex"
+
+const (
+	addrHistoryPrefix = 'h'
+	addrBalancePrefix = 'b'
+	addrOutputPrefix  = 'o'
+)
+
+// AddressTx 是地址的一条交易记录
+// TxID		交易ID
+// Height	交易所在区块的高度
+// Delta	交易使地址余额的变化量, 收款为正, 付款为负
+type AddressTx struct {
+	TxID   []byte
+	Height int
+	Delta  int
+}
+
+// 地址索引中记录的交易输出
+type indexedOutput struct {
+	PubKeyHash []byte
+	Value      int
+}
+
+type addrIndex struct{}
+
+func newAddrIndex() chainIndex {
+	return addrIndex{}
+}
+
+func (addrIndex) name() string {
+	return addrIndexBucket
+}
+
+func (addrIndex) connectBlock(tx StoreTx, block *Block) error {
+	for _, t := range block.Transactions {
+		for i, out := range t.Vout {
+			key := outputKey(t.ID, i)
+			if err := tx.IndexPut(addrIndexBucket, key, gobEncode(indexedOutput{out.PubKeyHash, out.Value})); err != nil {
+				return err
+			}
+		}
+		deltas, err := addressDeltas(tx, t)
+		if err != nil {
+			return err
+		}
+		for pubKeyHash, delta := range deltas {
+			key := historyKey([]byte(pubKeyHash), block.Height, t.ID)
+			if err := tx.IndexPut(addrIndexBucket, key, encodeInt(delta)); err != nil {
+				return err
+			}
+			if err := addBalance(tx, []byte(pubKeyHash), delta); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (addrIndex) disconnectBlock(tx StoreTx, block *Block) error {
+	// 按相反的顺序撤销, 区块中花费同一区块内输出的交易先被撤销
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		t := block.Transactions[i]
+		deltas, err := addressDeltas(tx, t)
+		if err != nil {
+			return err
+		}
+		for pubKeyHash, delta := range deltas {
+			if err := tx.IndexDelete(addrIndexBucket, historyKey([]byte(pubKeyHash), block.Height, t.ID)); err != nil {
+				return err
+			}
+			if err := addBalance(tx, []byte(pubKeyHash), -delta); err != nil {
+				return err
+			}
+		}
+		for i := range t.Vout {
+			if err := tx.IndexDelete(addrIndexBucket, outputKey(t.ID, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 计算交易使各地址(公钥哈希)余额的变化量, 花费的输出从索引中的输出记录查找
+func addressDeltas(tx StoreTx, t *Transaction) (map[string]int, error) {
+	deltas := make(map[string]int)
+	if !t.IsCoinbase() {
+		for _, vin := range t.Vin {
+			data := tx.IndexGet(addrIndexBucket, outputKey(vin.Txid, vin.Vout))
+			if data == nil {
+				return nil, fmt.Errorf("output %x:%d spent by %x is not indexed", vin.Txid, vin.Vout, t.ID)
+			}
+			var out indexedOutput
+			if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&out); err != nil {
+				return nil, err
+			}
+			deltas[string(out.PubKeyHash)] -= out.Value
+		}
+	}
+	for _, out := range t.Vout {
+		deltas[string(out.PubKeyHash)] += out.Value
+	}
+	return deltas, nil
+}
+
+// 更新地址的余额
+func addBalance(tx StoreTx, pubKeyHash []byte, delta int) error {
+	key := append([]byte{addrBalancePrefix}, pubKeyHash...)
+	balance := delta
+	if data := tx.IndexGet(addrIndexBucket, key); data != nil {
+		balance += decodeInt(data)
+	}
+	if balance == 0 {
+		return tx.IndexDelete(addrIndexBucket, key)
+	}
+	return tx.IndexPut(addrIndexBucket, key, encodeInt(balance))
+}
+
+func historyKey(pubKeyHash []byte, height int, txid []byte) []byte {
+	key := append([]byte{addrHistoryPrefix}, pubKeyHash...)
+	key = append(key, heightKey(height)...)
+	return append(key, txid...)
+}
+
+func outputKey(txid []byte, vout int) []byte {
+	key := append([]byte{addrOutputPrefix}, txid...)
+	return binary.BigEndian.AppendUint32(key, uint32(vout))
+}
+
+func encodeInt(n int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(n))
+}
+
+func decodeInt(data []byte) int {
+	return int(binary.BigEndian.Uint64(data))
+}
+
+// EnableAddrIndex 启用地址索引, 之后可以查询地址的交易记录, 并且不需要遍历 UTXO 集就能得到地址的余额
+// 第一次启用时根据主链建立索引, 启用后在数据库中保持启用, 之后打开区块链时自动启用
+func (bc *BlockChain) EnableAddrIndex() error {
+	return bc.enableIndex(newAddrIndex())
+}
+
+// AddrIndexEnabled 检查地址索引是否已启用
+func (bc *BlockChain) AddrIndexEnabled() bool {
+	return bc.indexEnabled(addrIndexBucket)
+}
+
+// AddressBalance 通过地址索引返回公钥哈希为 pubKeyHash 的地址的余额(包括质押的币), 地址索引未启用时返回错误
+func (bc *BlockChain) AddressBalance(pubKeyHash []byte) (int, error) {
+	if !bc.AddrIndexEnabled() {
+		return 0, fmt.Errorf("address index is not enabled")
+	}
+
+	balance := 0
+	err := bc.store.View(func(tx StoreTx) error {
+		if data := tx.IndexGet(addrIndexBucket, append([]byte{addrBalancePrefix}, pubKeyHash...)); data != nil {
+			balance = decodeInt(data)
+		}
+		return nil
+	})
+	return balance, err
+}
+
+// AddressTransactions 通过地址索引按高度从新到旧返回地址的交易记录, 跳过前 skip 条, 最多返回 count 条
+// 同时返回交易记录的总数, 地址索引未启用时返回错误
+func (bc *BlockChain) AddressTransactions(pubKeyHash []byte, skip, count int) ([]AddressTx, int, error) {
+	if !bc.AddrIndexEnabled() {
+		return nil, 0, fmt.Errorf("address index is not enabled")
+	}
+
+	var history []AddressTx
+	prefix := append([]byte{addrHistoryPrefix}, pubKeyHash...)
+	err := bc.store.View(func(tx StoreTx) error {
+		return tx.IndexForEachPrefix(addrIndexBucket, prefix, func(key, value []byte) error {
+			rest := key[len(prefix):]
+			history = append(history, AddressTx{
+				TxID:   rest[8:],
+				Height: int(binary.BigEndian.Uint64(rest[:8])),
+				Delta:  decodeInt(value),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := len(history)
+	slices.Reverse(history)
+	skip = min(max(skip, 0), total)
+	end := min(skip+count, total)
+	return history[skip:end], total, nil
+}
@@ -0,0 +1,91 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestAddrIndex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 通过地址索引读取余额
+func indexedBalance(t *testing.T, bc *BlockChain, wallet *Wallet) int {
+	balance, err := bc.AddressBalance(HashPubKey(wallet.PublicKey))
+	assert.NoError(t, err)
+	return balance
+}
+
+func TestAddrIndex(t *testing.T) {
+	bc, alice := newTestBlockChain(t, 1)
+	bob := NewWallet()
+	_, err := bc.AddressBalance(HashPubKey(alice.PublicKey))
+	assert.Error(t, err, "Index is not enabled")
+
+	// 第一次启用时根据主链建立索引
+	assert.NoError(t, bc.EnableAddrIndex())
+	assert.Equal(t, 2*subsidy, indexedBalance(t, bc, alice))
+
+	spend := spendTx(alice, genesisCoinbase(bc), 0, string(bob.GetAddress()), 4, 1)
+	block := bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), ""), spend})
+	UTXOSet{bc}.Update(block)
+	assert.Equal(t, 3*subsidy-5, indexedBalance(t, bc, alice))
+	assert.Equal(t, 4, indexedBalance(t, bc, bob))
+
+	// 余额与 UTXO 集一致
+	utxoBalance := 0
+	for _, out := range (UTXOSet{bc}).FindUTXO(HashPubKey(alice.PublicKey)) {
+		utxoBalance += out.Value
+	}
+	assert.Equal(t, utxoBalance, indexedBalance(t, bc, alice))
+
+	// 交易记录按高度从新到旧排列, 支持分页
+	history, total, err := bc.AddressTransactions(HashPubKey(alice.PublicKey), 0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, total)
+	assert.Len(t, history, 4)
+	assert.Equal(t, 2, history[0].Height)
+	assert.Equal(t, 0, history[3].Height)
+	deltas := map[string]int{string(spend.ID): -5, string(block.Transactions[0].ID): subsidy}
+	for _, tx := range history[:2] {
+		assert.Equal(t, deltas[string(tx.TxID)], tx.Delta)
+	}
+	page, total, err := bc.AddressTransactions(HashPubKey(alice.PublicKey), 1, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, total)
+	assert.Equal(t, history[1:3], page)
+	page, _, _ = bc.AddressTransactions(HashPubKey(alice.PublicKey), 10, 2)
+	assert.Empty(t, page)
+
+	// 重组后被移出主链的交易从索引中撤销
+	fork := newTestFork(t, bc, mainChainBlock(t, bc, 1), 2, string(NewWallet().GetAddress()))
+	for _, b := range fork {
+		assert.NoError(t, bc.AddBlock(b))
+	}
+	assert.Equal(t, 2*subsidy, indexedBalance(t, bc, alice))
+	assert.Equal(t, 0, indexedBalance(t, bc, bob))
+	_, total, _ = bc.AddressTransactions(HashPubKey(alice.PublicKey), 0, 10)
+	assert.Equal(t, 2, total)
+	history, _, _ = bc.AddressTransactions(HashPubKey(bob.PublicKey), 0, 10)
+	assert.Empty(t, history)
+}
+
+func TestAddrIndexInconsistent(t *testing.T) {
+	bc, alice := newTestBlockChain(t, 1)
+	assert.NoError(t, bc.EnableAddrIndex())
+
+	// 索引中缺少被花费的输出时停用索引, 区块仍然加入区块链
+	coinbase := genesisCoinbase(bc)
+	assert.NoError(t, bc.store.Update(func(tx StoreTx) error {
+		return tx.IndexDelete(addrIndexBucket, outputKey(coinbase.ID, 0))
+	}))
+	spend := spendTx(alice, coinbase, 0, string(NewWallet().GetAddress()), 4, 1)
+	block := newTestBlock(t, bc, mainChainBlock(t, bc, 1), string(alice.GetAddress()), spend)
+	assert.NoError(t, bc.AddBlock(block))
+	assert.Equal(t, block.Hash, bc.Tip())
+	assert.False(t, bc.AddrIndexEnabled())
+
+	// 再次启用时从创世块开始重建
+	assert.NoError(t, bc.EnableAddrIndex())
+	assert.Equal(t, 3*subsidy-5, indexedBalance(t, bc, alice))
+}
@@ -51,9 +51,10 @@ func Base58Decode(input []byte) []byte {
 	zeroBytes := 0  // 记录前导'1'的数量（对应原始的0x00）
 
 	for _, b := range input {
-		if b == b58Alphabet[0] {
-			zeroBytes++
+		if b != b58Alphabet[0] {
+			break // 只统计连续的前导'1'
 		}
+		zeroBytes++
 	}
 	// 去掉前导'1'后的部分（实际参与58进制计算的字符）
 	payload := input[zeroBytes:]
@@ -24,4 +24,14 @@ func TestBase58(t *testing.T) {
 
 	decoded := Base58Decode([]byte("16UwLL9Risc3QfPqBUvKofHmBQ7wMtjvM"))
 	assert.Equal(t, strings.ToLower("00010966776006953D5567439E5E39F86A0D273BEED61967F6"), hex.EncodeToString(decoded))
-}
\ No newline at end of file
+}
+
+func TestBase58RoundTrip(t *testing.T) {
+	// 编码结果中间含有'1'时, 解码只应把前导的'1'还原为0x00
+	for i := 0; i < 100; i++ {
+		address := NewWallet().GetAddress()
+		pubKeyHash := Base58Decode(address)
+		assert.Equal(t, address, Base58Encode(pubKeyHash))
+		assert.True(t, ValidateAddress(string(address)))
+	}
+}
@@ -2,6 +2,8 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/gob"
 	"fmt"
 	"time"
@@ -13,6 +15,9 @@ import (
 // PrevHash			前一个块的哈希，即父哈希
 // Nonce			工作量证明算法中用于挖矿的计数器
 // Height			区块在区块链中的高度（第几个区块）
+// Signer			权威证明中签名区块的公钥, 工作量证明中为空
+// Signature		签名者对区块哈希的签名
+// Evidence			权益证明中验证者重复签名的证据, 被证据证明作恶的验证者失去质押权重
 type Block struct {
 	TimeStamp   	int64
 	Transactions 	[]*Transaction
@@ -20,6 +25,52 @@ type Block struct {
 	PrevHash    	[]byte
 	Nonce       	int
 	Height			int
+	Signer			[]byte
+	Signature		[]byte
+	Evidence		[]SlashingEvidence
+}
+
+// 区块头, 不包含交易数据, 用于先同步区块头再下载区块体
+// MerkleRoot		区块中所有交易的 Merkle 根, 与其余字段一起即可由共识引擎验证
+// EvidenceHash		区块中重复签名证据的哈希, 没有证据时为空
+type BlockHeader struct {
+	TimeStamp    int64
+	PrevHash     []byte
+	MerkleRoot   []byte
+	EvidenceHash []byte
+	Hash         []byte
+	Nonce        int
+	Height       int
+	Signer       []byte
+	Signature    []byte
+}
+
+// Header 返回区块的区块头
+func (b *Block) Header() BlockHeader {
+	return BlockHeader{
+		TimeStamp:    b.TimeStamp,
+		PrevHash:     b.PrevHash,
+		MerkleRoot:   b.HashTransactions(),
+		EvidenceHash: b.HashEvidence(),
+		Hash:         b.Hash,
+		Nonce:        b.Nonce,
+		Height:       b.Height,
+		Signer:       b.Signer,
+		Signature:    b.Signature,
+	}
+}
+
+// 检查两个区块头的所有字段是否相同
+func (h *BlockHeader) equal(other *BlockHeader) bool {
+	return h.TimeStamp == other.TimeStamp &&
+		h.Nonce == other.Nonce &&
+		h.Height == other.Height &&
+		bytes.Equal(h.PrevHash, other.PrevHash) &&
+		bytes.Equal(h.MerkleRoot, other.MerkleRoot) &&
+		bytes.Equal(h.EvidenceHash, other.EvidenceHash) &&
+		bytes.Equal(h.Hash, other.Hash) &&
+		bytes.Equal(h.Signer, other.Signer) &&
+		bytes.Equal(h.Signature, other.Signature)
 }
 
 func (b *Block) PrintBlock() {
@@ -32,19 +83,16 @@ func (b *Block) PrintBlock() {
 }
 
 func NewBlock(transactions []*Transaction, prevHash []byte, height int) *Block {
-	block := &Block {
-		TimeStamp: 			time.Now().Unix(),
-		Transactions:      	transactions,
-		PrevHash:  			prevHash,
-		Hash:      			[]byte{},
-		Height:				height,
-	}
-	pow := NewProofOfWork(block)
-	nonce, hash := pow.Run()
-	block.Hash, block.Nonce = hash[:], nonce
+	block, _ := NewBlockContext(context.Background(), transactions, prevHash, height)
 	return block
 }
 
+// 同 NewBlock, ctx 被取消时停止挖矿并返回 ctx 的错误
+// 使用工作量证明封装区块, 其他共识算法的区块由 BlockChain.MineBlockContext 创建
+func NewBlockContext(ctx context.Context, transactions []*Transaction, prevHash []byte, height int, opts ...SealOption) (*Block, error) {
+	return sealBlock(ctx, NewPoWEngine(), transactions, prevHash, height, time.Now().Unix(), opts...)
+}
+
 // 区块链中至少要有一个块，称为创世块
 func NewGenesisBlock(coinbase *Transaction) *Block {
 	return NewBlock([]*Transaction{coinbase}, []byte{}, 0)
@@ -60,11 +108,23 @@ func (b *Block) Serialize() []byte {
 	return result.Bytes()
 }
 
-func DeserializeBlock(d []byte) *Block {
+// DeserializeBlock 解码 Serialize 得到的区块数据, 数据无效时返回错误
+func DeserializeBlock(d []byte) (*Block, error) {
 	var block Block
 	decoder := gob.NewDecoder(bytes.NewReader(d))
-	decoder.Decode(&block)
-	return &block
+	if err := decoder.Decode(&block); err != nil {
+		return nil, fmt.Errorf("failed to decode block: %w", err)
+	}
+	return &block, nil
+}
+
+// HashEvidence 返回区块中重复签名证据的哈希, 没有证据时返回 nil
+func (block *Block) HashEvidence() []byte {
+	if len(block.Evidence) == 0 {
+		return nil
+	}
+	hash := sha256.Sum256(gobEncode(block.Evidence))
+	return hash[:]
 }
 
 func (block *Block) HashTransactions() []byte {
@@ -0,0 +1,248 @@
+package blockchain
+
+import (
+	"container/heap"
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+const maxBlockSize = 1000000 // 区块中所有交易序列化后的最大总字节数
+const maxBlockSigOps = 20000 // 区块中签名验证操作(每个交易输入一次)的最大数量
+
+// BlockTemplate 是待挖掘区块的内容
+// PrevHash			父区块(构造模板时的最新区块)的哈希
+// Height			待挖掘区块的高度
+// MinTime			区块时间戳的最小值(父区块的过去中位时间加 1)
+// Transactions		区块中的交易, coinbase 交易在最前, 父交易总是排在子交易之前
+// Fees				区块中交易的手续费总和, 已计入 coinbase 的输出
+// Size				所有交易序列化后的总字节数
+// SigOps			签名验证操作的数量
+type BlockTemplate struct {
+	PrevHash     []byte
+	Height       int
+	MinTime      int64
+	Transactions []*Transaction
+	Fees         int
+	Size         int
+	SigOps       int
+}
+
+// 交易需要的签名验证次数, coinbase 交易不需要验证
+func sigOpCount(tx *Transaction) int {
+	if tx.IsCoinbase() {
+		return 0
+	}
+	return len(tx.Vin)
+}
+
+// NewBlockTemplate 从内存池 mp 中选择交易构造区块模板, 挖矿奖励和手续费发送到 address
+func NewBlockTemplate(bc *BlockChain, mp *Mempool, address string) *BlockTemplate {
+	return newBlockTemplate(bc, mp, address, maxBlockSize, maxBlockSigOps)
+}
+
+// 按祖先交易包的费率从高到低选择交易:
+// 交易与其所有尚未选中的祖先交易作为一个整体计算费率, 子交易的高手续费可以带动低手续费的父交易被打包(CPFP)
+// 选中的交易包按拓扑顺序加入区块, 总大小和签名验证次数不超过上限
+// 交易包被选中后, 从其子孙交易的祖先交易包中减去被选中的交易, 以新的费率重新加入候选;
+// 放不进区块的交易包在祖先交易被选中、交易包变小后再次尝试
+func newBlockTemplate(bc *BlockChain, mp *Mempool, address string, maxSize, maxSigOps int) *BlockTemplate {
+	coinbase := NewCoinbaseTX(address, "")
+	tip := bc.Tip()
+	last, err := bc.GetBlock(tip)
+	if err != nil {
+		log.Panic(err)
+	}
+	tmpl := &BlockTemplate{
+		PrevHash: tip,
+		Height:   last.Height + 1,
+		MinTime:  bc.MedianTimePast() + 1,
+		Size:     len(coinbase.Serialize()),
+		SigOps:   sigOpCount(coinbase),
+	}
+
+	entries := mp.snapshot()
+	packages := make(map[string]*ancestorPackage, len(entries))
+	candidates := make(packageHeap, 0, len(entries))
+	for txID := range entries {
+		pkg := newAncestorPackage(entries, txID)
+		packages[txID] = pkg
+		candidates = append(candidates, packageCandidate{txID, pkg.fee, pkg.size})
+	}
+	heap.Init(&candidates)
+
+	inBlock := make(map[string]Transaction)
+	var txs []*Transaction
+
+	for candidates.Len() > 0 {
+		candidate := heap.Pop(&candidates).(packageCandidate)
+		pkg := packages[candidate.txID]
+		// 交易已被选中或丢弃, 或者交易包已变化(变化后的交易包另有候选)
+		if pkg == nil || pkg.fee != candidate.fee || pkg.size != candidate.size {
+			continue
+		}
+		if tmpl.Size+pkg.size > maxSize || tmpl.SigOps+pkg.sigOps > maxSigOps {
+			continue
+		}
+
+		// 按拓扑顺序加入交易包, 交易无效时丢弃该交易及依赖它的交易
+		var selected []string
+		for _, id := range pkg.order(candidate.txID, packages) {
+			entry := entries[id]
+			if !bc.verifyTransaction(&entry.Tx, inBlock) {
+				discard := make(map[string]bool)
+				collectDescendants(entries, id, discard)
+				for txID := range discard {
+					delete(packages, txID)
+				}
+				break
+			}
+			delete(packages, id)
+			selected = append(selected, id)
+			inBlock[id] = entry.Tx
+			txs = append(txs, &entry.Tx)
+			tmpl.Fees += entry.Fee
+			tmpl.Size += entry.Size
+			tmpl.SigOps += sigOpCount(&entry.Tx)
+		}
+
+		// 从子孙交易的祖先交易包中减去被选中的交易
+		changed := make(map[string]bool)
+		for _, id := range selected {
+			descendants := make(map[string]bool)
+			collectDescendants(entries, id, descendants)
+			for txID := range descendants {
+				if desc := packages[txID]; desc != nil && desc.ancestors[id] {
+					desc.remove(id, entries[id])
+					changed[txID] = true
+				}
+			}
+		}
+		for txID := range changed {
+			if desc := packages[txID]; desc != nil {
+				heap.Push(&candidates, packageCandidate{txID, desc.fee, desc.size})
+			}
+		}
+	}
+
+	// 手续费作为挖矿奖励的一部分发给矿工
+	coinbase.Vout[0].Value += tmpl.Fees
+	coinbase.ID = coinbase.Hash()
+	tmpl.Transactions = append([]*Transaction{coinbase}, txs...)
+
+	return tmpl
+}
+
+// Mine 对模板进行工作量证明, 返回挖出的区块, 区块需要通过 BlockChain.SubmitBlock 添加到区块链
+// 区块的时间戳为当前时间, 但不小于 MinTime
+func (tmpl *BlockTemplate) Mine(ctx context.Context, opts ...SealOption) (*Block, error) {
+	return sealBlock(ctx, NewPoWEngine(), tmpl.Transactions, tmpl.PrevHash, tmpl.Height, max(time.Now().Unix(), tmpl.MinTime), opts...)
+}
+
+// 交易的祖先交易包, 只包含尚未被选中的祖先交易
+// ancestors			尚未被选中的祖先交易ID
+// fee, size, sigOps	交易与 ancestors 的手续费、字节数和签名验证次数之和
+type ancestorPackage struct {
+	ancestors map[string]bool
+	fee       int
+	size      int
+	sigOps    int
+}
+
+// 计算交易 txID 在内存池中的祖先交易包
+func newAncestorPackage(entries map[string]*mempoolEntry, txID string) *ancestorPackage {
+	pkg := &ancestorPackage{ancestors: make(map[string]bool)}
+	collectAncestors(entries, txID, pkg.ancestors)
+	pkg.add(entries[txID])
+	for id := range pkg.ancestors {
+		pkg.add(entries[id])
+	}
+	return pkg
+}
+
+func (pkg *ancestorPackage) add(entry *mempoolEntry) {
+	pkg.fee += entry.Fee
+	pkg.size += entry.Size
+	pkg.sigOps += sigOpCount(&entry.Tx)
+}
+
+// 从交易包中移除被选中的祖先交易 txID
+func (pkg *ancestorPackage) remove(txID string, entry *mempoolEntry) {
+	delete(pkg.ancestors, txID)
+	pkg.fee -= entry.Fee
+	pkg.size -= entry.Size
+	pkg.sigOps -= sigOpCount(&entry.Tx)
+}
+
+// 返回交易包中的交易ID(包括交易 txID 本身), 按拓扑顺序排列(祖先交易在前)
+func (pkg *ancestorPackage) order(txID string, packages map[string]*ancestorPackage) []string {
+	ids := make([]string, 0, len(pkg.ancestors)+1)
+	for id := range pkg.ancestors {
+		ids = append(ids, id)
+	}
+	ids = append(ids, txID)
+	// 交易的祖先数量总是多于它的任何一个祖先, 按祖先数量排序即为拓扑顺序
+	sort.Slice(ids, func(i, j int) bool {
+		ci, cj := len(packages[ids[i]].ancestors), len(packages[ids[j]].ancestors)
+		if ci != cj {
+			return ci < cj
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// 将交易在 entries 中的所有祖先交易ID加入 set
+func collectAncestors(entries map[string]*mempoolEntry, txID string, set map[string]bool) {
+	for parentID := range entries[txID].parents {
+		if entries[parentID] != nil && !set[parentID] {
+			set[parentID] = true
+			collectAncestors(entries, parentID, set)
+		}
+	}
+}
+
+// 将交易及其在 entries 中的所有子孙交易ID加入 set
+func collectDescendants(entries map[string]*mempoolEntry, txID string, set map[string]bool) {
+	if set[txID] {
+		return
+	}
+	set[txID] = true
+	for childID := range entries[txID].children {
+		if entries[childID] != nil {
+			collectDescendants(entries, childID, set)
+		}
+	}
+}
+
+// 候选交易及其加入候选时的祖先交易包手续费和字节数
+type packageCandidate struct {
+	txID string
+	fee  int
+	size int
+}
+
+// 按祖先交易包费率从高到低排列的候选交易, 费率相同时按交易ID排列
+type packageHeap []packageCandidate
+
+func (h packageHeap) Len() int { return len(h) }
+
+func (h packageHeap) Less(i, j int) bool {
+	ri, rj := feeRate(h[i].fee, h[i].size), feeRate(h[j].fee, h[j].size)
+	if ri != rj {
+		return ri > rj
+	}
+	return h[i].txID < h[j].txID
+}
+
+func (h packageHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *packageHeap) Push(x interface{}) { *h = append(*h, x.(packageCandidate)) }
+
+func (h *packageHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,80 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestBlockTemplate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockTemplate(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 1)
+	mp := NewMempool(bc)
+	coinbases := blockCoinbases(bc)
+	other := NewWallet()
+	miner := string(NewWallet().GetAddress())
+
+	// 父交易不付手续费, 子交易支付高手续费; 另有一笔手续费较低的独立交易
+	parent := spendTx(wallet, coinbases[0], 0, string(other.GetAddress()), 6, 0)
+	child := spendTx(other, parent, 0, string(other.GetAddress()), 1, 5)
+	single := spendTx(wallet, coinbases[1], 0, string(other.GetAddress()), 3, 1)
+	for _, tx := range []*Transaction{parent, child, single} {
+		assert.NoError(t, mp.Add(tx))
+	}
+
+	// 子交易带动父交易优先被打包, 父交易排在子交易之前
+	tmpl := NewBlockTemplate(bc, mp, miner)
+	assert.Equal(t, 4, len(tmpl.Transactions))
+	assert.True(t, tmpl.Transactions[0].IsCoinbase())
+	assert.Equal(t, parent.ID, tmpl.Transactions[1].ID)
+	assert.Equal(t, child.ID, tmpl.Transactions[2].ID)
+	assert.Equal(t, single.ID, tmpl.Transactions[3].ID)
+	assert.Equal(t, 6, tmpl.Fees)
+	assert.Equal(t, subsidy+6, tmpl.Transactions[0].Vout[0].Value)
+	assert.Equal(t, 3, tmpl.SigOps)
+
+	// 区块大小不足以容纳所有交易时, 选择费率最高的交易包
+	size := len(parent.Serialize()) + len(child.Serialize())
+	tmpl = newBlockTemplate(bc, mp, miner, len(tmpl.Transactions[0].Serialize())+size+10, maxBlockSigOps)
+	assert.Equal(t, 3, len(tmpl.Transactions))
+	assert.Equal(t, 5, tmpl.Fees)
+
+	// 签名验证次数的上限
+	tmpl = newBlockTemplate(bc, mp, miner, maxBlockSize, 1)
+	assert.Equal(t, 2, len(tmpl.Transactions))
+	assert.Equal(t, single.ID, tmpl.Transactions[1].ID)
+
+	// 同一区块中子交易可以花费父交易的输出
+	tmpl = NewBlockTemplate(bc, mp, miner)
+	block := bc.MineBlock(tmpl.Transactions)
+	mp.RemoveForBlock(block)
+	assert.Equal(t, 0, mp.Size())
+}
+
+func TestBlockTemplateUpdatesDescendants(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 1)
+	mp := NewMempool(bc)
+	coinbases := blockCoinbases(bc)
+	other := NewWallet()
+	miner := string(NewWallet().GetAddress())
+
+	// parent 的两个输出分别被 child 和 sibling 花费, child 为 parent 支付高手续费
+	parent := spendTx(wallet, coinbases[0], 0, string(other.GetAddress()), 7, 0)
+	child := spendTx(other, parent, 0, string(other.GetAddress()), 1, 6)
+	sibling := spendTx(wallet, parent, 1, string(other.GetAddress()), 1, 2)
+	single := spendTx(wallet, coinbases[1], 0, string(other.GetAddress()), 9, 1)
+	for _, tx := range []*Transaction{parent, child, sibling, single} {
+		assert.NoError(t, mp.Add(tx))
+	}
+
+	// 包含 parent 时 sibling 的交易包费率低于 single, parent 被选中后 sibling 单独的费率高于 single
+	tmpl := NewBlockTemplate(bc, mp, miner)
+	if assert.Equal(t, 5, len(tmpl.Transactions)) {
+		for i, tx := range []*Transaction{parent, child, sibling, single} {
+			assert.Equal(t, tx.ID, tmpl.Transactions[i+1].ID)
+		}
+	}
+	assert.Equal(t, 9, tmpl.Fees)
+}
@@ -2,126 +2,364 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"log"
 	"os"
-
-	"github.com/boltdb/bolt"
+	"sync"
+	"time"
 )
 
 const dbFile = "blockchain_%s.db" // %s: 区分不同端口号, 模拟网络多节点
 const blocksBucket = "blocks"
+const dbOpenTimeout = time.Second
 const genesisCoinbaseData = "The Times 03/Jan/2009 Chancellor on brink of second bailout for banks"
 
 type BlockChain struct{
 	tip []byte 		// 用于存储区块链"末端"（最新区块）的哈希值
-	db *bolt.DB		// 持久化存储区块链数据的数据库连接
+	store ChainStore	// 持久化存储区块链数据的存储后端
+	mu sync.RWMutex	// 保护 tip、checkpoints、maxReorgDepth、maxTimeDrift 和 indexes, 区块链会被多个连接的 goroutine 同时访问
+	params ChainParams		// 创建区块链时确定的链参数
+	engine ConsensusEngine	// 根据链参数创建的共识引擎
+	checkpoints map[int][]byte	// 检查点(高度 -> 区块哈希), 主链上这些高度的区块不会被替换
+	maxReorgDepth int			// 允许的最大重组深度, 小于等于 0 时不限制
+	clock *medianTime			// 根据对等节点的时间计算网络调整时间
+	maxTimeDrift time.Duration	// 区块时间戳允许超前于网络调整时间的最大值
+	indexes []chainIndex		// 启用的索引, 随主链变化更新
+	utxo *utxoCache			// UTXO 集的写回缓存, 通过 UTXOSet 访问
 }
 
 func (bc *BlockChain) Iterator() *BlockChainIterator {
-	return &BlockChainIterator{bc.tip, bc.db}
+	return &BlockChainIterator{bc.Tip(), bc.store}
+}
+
+// Tip 返回最新区块的哈希值
+func (bc *BlockChain) Tip() []byte {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	return bc.tip
 }
 
+// Params 返回区块链的链参数
+func (bc *BlockChain) Params() ChainParams {
+	return bc.params
+}
+
+// Engine 返回区块链使用的共识引擎
+func (bc *BlockChain) Engine() ConsensusEngine {
+	return bc.engine
+}
+
+// 更新最新区块的哈希值
+func (bc *BlockChain) setTip(hash []byte) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.tip = hash
+}
+
+// ErrStaleTip 表示挖矿期间其他区块成为了最新区块, 挖出的区块不再延伸主链
+var ErrStaleTip = errors.New("chain tip changed while mining")
+
+// ErrInvalidBlock 表示区块不满足共识规则或包含无效的交易
+var ErrInvalidBlock = errors.New("block is invalid")
+
+// ErrOrphanBlock 表示区块的父区块不在区块链中
+var ErrOrphanBlock = errors.New("parent block is unknown")
+
 func (bc *BlockChain) MineBlock(transactions []*Transaction) *Block {
+	block, _ := bc.MineBlockContext(context.Background(), transactions)
+	return block
+}
+
+// MineBlockContext 在最新区块之上挖掘包含 transactions 的新块并加入区块链
+// ctx 被取消时停止挖矿并返回 ctx 的错误; 挖矿期间最新区块发生变化时丢弃挖出的区块并返回 ErrStaleTip
+// transactions 的第一笔必须是 coinbase, 交易无效时返回 ErrInvalidBlock
+// 使用区块链的共识引擎封装区块, opts 可以设置并行挖矿的 goroutine 数量和算力统计
+func (bc *BlockChain) MineBlockContext(ctx context.Context, transactions []*Transaction, opts ...SealOption) (*Block, error) {
 	var lastHash []byte
 	var lastHeight int
+	var timestamp int64
 
-	for _, tx := range transactions {
-		if !bc.VerifyTransaction(tx) {
-			panic("ERROR: Invalid transaction")
-		}
-	}
-
-	if err := bc.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		if b == nil {
-			return nil
+	if err := bc.store.View(func(tx StoreTx) error {
+		lastHash = tx.Tip()
+		block := tx.Block(lastHash)
+		if block == nil {
+			return fmt.Errorf("tip %x is not found", lastHash)
 		}
-		lastHash = b.Get([]byte("l"))
-
-		blockData := b.Get(lastHash)
-		block := DeserializeBlock(blockData)
 
 		lastHeight = block.Height
+		timestamp = bc.nextTimestamp(tx, lastHash)
 
 		return nil
 	}); err != nil {
-		return nil
+		return nil, err
+	}
+
+	// 模板可能在其他区块连接之前构造, 挖矿前按当前最新区块的UTXO集重新检查交易,
+	// 避免打包已被确认或已被花费的交易
+	if err := bc.checkTransactionsAt(&Block{PrevHash: lastHash, Transactions: transactions}); err != nil {
+		return nil, err
+	}
+
+	newBlock, err := sealBlock(ctx, bc.engine, transactions, lastHash, lastHeight + 1, timestamp, opts...)
+	if err != nil {
+		return nil, err
 	}
 
-	newBlock := NewBlock(transactions, lastHash, lastHeight + 1)
+	if err := bc.store.Update(func(tx StoreTx) error {
+		if !bytes.Equal(tx.Tip(), lastHash) {
+			return ErrStaleTip
+		}
+		if err := tx.PutBlock(newBlock); err != nil {
+			return err
+		}
+		return bc.connectTip(tx, newBlock, tx.Block(lastHash))
+	}); err != nil {
+		return nil, err
+	}
 
-	if err := bc.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		if b == nil {
-			return fmt.Errorf("bucket %s not found", blocksBucket)
+	return newBlock, nil
+}
+
+// SubmitBlock 验证由外部矿工挖出的区块, 区块延伸当前主链时将其添加为最新区块
+// 区块的父区块不是最新区块时返回 ErrStaleTip, 区块不满足共识规则(包括时间戳规则)或无效时返回 ErrInvalidBlock
+func (bc *BlockChain) SubmitBlock(block *Block) error {
+	if err := bc.verifyBlock(block); err != nil {
+		return err
+	}
+	// 外部矿工只能延伸最新区块, 写入前还会再次确认父区块仍是最新区块
+	if !bytes.Equal(block.PrevHash, bc.Tip()) {
+		return ErrStaleTip
+	}
+	if err := bc.checkTransactionsAt(block); err != nil {
+		return err
+	}
+
+	return bc.store.Update(func(tx StoreTx) error {
+		lastHash := tx.Tip()
+		if !bytes.Equal(block.PrevHash, lastHash) {
+			return ErrStaleTip
+		}
+		lastBlock := tx.Block(lastHash)
+		if block.Height != lastBlock.Height+1 {
+			return fmt.Errorf("%w: height %d, expected %d", ErrInvalidBlock, block.Height, lastBlock.Height+1)
 		}
-		if err := b.Put(newBlock.Hash, newBlock.Serialize()); err != nil {
+		if err := bc.checkTimestamp(tx, block); err != nil {
 			return err
 		}
-		if err := b.Put([]byte("l"), newBlock.Hash); err != nil {
+		if err := tx.PutBlock(block); err != nil {
 			return err
 		}
-		bc.tip = newBlock.Hash
-		return nil
-	}); err != nil {
-		return nil
+		return bc.connectTip(tx, block, lastBlock)
+	})
+}
+
+// 验证区块头(由区块内容重新计算哈希并检查共识规则)和区块中的重复签名证据, 不检查交易
+func (bc *BlockChain) verifyBlock(block *Block) error {
+	header := block.Header()
+	if err := bc.engine.VerifyHeader(&header); err != nil {
+		return err
+	}
+	for i := range block.Evidence {
+		if bc.params.Consensus != ConsensusPoS {
+			return fmt.Errorf("%w: only proof of stake blocks carry slashing evidence", ErrInvalidBlock)
+		}
+		if err := block.Evidence[i].Verify(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 根据父区块对应的 UTXO 集检查区块中的交易, 父区块可以在分叉上
+// 父区块不在区块链中时返回 ErrOrphanBlock
+func (bc *BlockChain) checkTransactionsAt(block *Block) error {
+	if !bc.HasBlock(block.PrevHash) {
+		return fmt.Errorf("%w: block %x, parent %x", ErrOrphanBlock, block.Hash, block.PrevHash)
 	}
 
-	return newBlock
+	c := bc.utxo
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	view, err := c.viewAt(block.PrevHash)
+	if err != nil {
+		return err
+	}
+	return bc.checkBlockTransactions(block, view)
+}
+
+// 检查区块中的交易: 只有第一笔交易是 coinbase, 交易ID与交易数据对应且不会创建已存在的输出,
+// 其余交易花费 view 或区块中排在它之前的交易的输出, 签名有效(由输出的所有者签名)且同一输出不会被花费两次,
+// coinbase 的输出不超过挖矿奖励与手续费之和
+func (bc *BlockChain) checkBlockTransactions(block *Block, view *utxoView) error {
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+		return fmt.Errorf("%w: first transaction is not a coinbase", ErrInvalidBlock)
+	}
+
+	// 交易ID必须与交易数据对应, 否则 Merkle 根不能约束交易内容, 交易也可能覆盖他人的输出
+	ids := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if !tx.validID() {
+			return fmt.Errorf("%w: transaction %x does not match its data", ErrInvalidBlock, tx.ID)
+		}
+		if ids[hex.EncodeToString(tx.ID)] {
+			return fmt.Errorf("%w: transaction %x appears twice", ErrInvalidBlock, tx.ID)
+		}
+		ids[hex.EncodeToString(tx.ID)] = true
+		for outIdx := range tx.Vout {
+			_, exists, err := view.get(tx.ID, outIdx)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return fmt.Errorf("%w: transaction %x creates an existing output %x:%d", ErrInvalidBlock, tx.ID, tx.ID, outIdx)
+			}
+		}
+	}
+
+	inBlock := make(map[string]Transaction)
+	spent := make(map[string]bool)
+	fees := 0
+	for _, tx := range block.Transactions[1:] {
+		if tx.IsCoinbase() {
+			return fmt.Errorf("%w: more than one coinbase", ErrInvalidBlock)
+		}
+		inputValue := 0
+		// 签名只使用被花费的输出的公钥哈希, 由找到的输出构造前序交易, 分叉上的交易也可以验证
+		prevTXs := make(map[string]Transaction)
+		for _, vin := range tx.Vin {
+			outpoint := fmt.Sprintf("%x:%d", vin.Txid, vin.Vout)
+			if spent[outpoint] {
+				return fmt.Errorf("%w: transaction %x double spends %s", ErrInvalidBlock, tx.ID, outpoint)
+			}
+			spent[outpoint] = true
+
+			var out TXOutput
+			found := false
+			if prevTx, ok := inBlock[hex.EncodeToString(vin.Txid)]; ok {
+				if vin.Vout >= 0 && vin.Vout < len(prevTx.Vout) {
+					out, found = prevTx.Vout[vin.Vout], true
+				}
+			} else {
+				entry, ok, err := view.get(vin.Txid, vin.Vout)
+				if err != nil {
+					return err
+				}
+				out, found = entry.Output, ok
+			}
+			if !found {
+				return fmt.Errorf("%w: transaction %x spends an unknown or spent output %s", ErrInvalidBlock, tx.ID, outpoint)
+			}
+			if out.Stake {
+				return fmt.Errorf("%w: transaction %x spends a staked output %s", ErrInvalidBlock, tx.ID, outpoint)
+			}
+			inputValue += out.Value
+
+			prevID := hex.EncodeToString(vin.Txid)
+			prevTx := prevTXs[prevID]
+			for len(prevTx.Vout) <= vin.Vout {
+				prevTx.Vout = append(prevTx.Vout, TXOutput{})
+			}
+			prevTx.Vout[vin.Vout] = out
+			prevTXs[prevID] = prevTx
+		}
+		outputValue := 0
+		for _, out := range tx.Vout {
+			outputValue += out.Value
+		}
+		if outputValue > inputValue {
+			return fmt.Errorf("%w: transaction %x spends more than its inputs", ErrInvalidBlock, tx.ID)
+		}
+		if !tx.Verify(prevTXs) {
+			return fmt.Errorf("%w: transaction %x has an invalid signature", ErrInvalidBlock, tx.ID)
+		}
+		fees += inputValue - outputValue
+		inBlock[hex.EncodeToString(tx.ID)] = *tx
+	}
+
+	reward := 0
+	for _, out := range block.Transactions[0].Vout {
+		reward += out.Value
+	}
+	if reward > subsidy+fees {
+		return fmt.Errorf("%w: coinbase pays %d, more than %d", ErrInvalidBlock, reward, subsidy+fees)
+	}
+
+	return nil
 }
 
 // AddBlock saves the block into the blockchain
-func (bc *BlockChain) AddBlock(block *Block) {
-	err := bc.db.Update(func(tx *bolt.Tx) error {
-		// 获取名为blocksBucket = blocks的 "桶"，类似数据库的 "表"
-		b := tx.Bucket([]byte(blocksBucket))
+// 所有收到的区块(网络广播、区块下载和孤儿区块池)都通过 AddBlock 加入区块链, 保存前验证区块头、重复签名证据,
+// 并根据父区块对应的 UTXO 集检查交易, 分叉上的区块也同样检查
+// 父区块不在区块链中时返回 ErrOrphanBlock, 区块头或交易无效、区块的高度不是父区块的高度加 1,
+// 或时间戳不大于父区块的过去中位时间或超前网络调整时间太多时返回 ErrInvalidBlock,
+// 区块与检查点冲突时返回 ErrCheckpointMismatch, 切换到区块所在的分叉需要回滚过多区块时返回 ErrReorgTooDeep, 两种情况都不保存区块
+func (bc *BlockChain) AddBlock(block *Block) error {
+	if bc.HasBlock(block.Hash) {
+		return nil
+	}
+	if err := bc.verifyBlock(block); err != nil {
+		return err
+	}
+	if err := bc.checkTransactionsAt(block); err != nil {
+		return err
+	}
+
+	return bc.store.Update(func(tx StoreTx) error {
 		// 检查区块是否已存在于数据库中
-		blockInDb := b.Get(block.Hash)
 		// 如果区块已存在，则不进行任何操作，直接返回
-		if blockInDb != nil {
+		if tx.HasBlock(block.Hash) {
 			return nil
 		}
+
+		// 父区块不存在时不保存区块, 否则从该区块开始遍历时会读取到不存在的区块
+		parent := tx.Block(block.PrevHash)
+		if parent == nil {
+			return fmt.Errorf("%w: block %x, parent %x", ErrOrphanBlock, block.Hash, block.PrevHash)
+		}
+		if block.Height != parent.Height+1 {
+			return fmt.Errorf("%w: height %d, expected %d", ErrInvalidBlock, block.Height, parent.Height+1)
+		}
+
+		// 获取当前区块链的最新区块
+		lastBlock := tx.Block(tx.Tip())
+		if err := bc.checkTimestamp(tx, block); err != nil {
+			return err
+		}
+		if err := bc.checkFinality(tx, block, lastBlock); err != nil {
+			return err
+		}
+
 		// 如果区块不存在，则将其添加到数据库中
-		blockData := block.Serialize()
-		err := b.Put(block.Hash, blockData)
+		err := tx.PutBlock(block)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
-		// 获取当前区块链的最新区块哈希
-		lastHash := b.Get([]byte("l"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock := DeserializeBlock(lastBlockData)
-
-		// 如果新添加的区块高度更大, 则更新 "l" 键以及blockchain的tip, 指向新的最新区块哈希
+		// 如果新添加的区块高度更大, 则更新最新区块以及blockchain的tip, 指向新的最新区块哈希
 		if block.Height > lastBlock.Height {
-			err = b.Put([]byte("l"), block.Hash)
+			err = bc.connectTip(tx, block, lastBlock)
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
-			bc.tip = block.Hash
 		}
 
 		return nil
 	})
-	if err != nil {
-		log.Panic(err)
-	}
 }
 
 // GetBestHeight 返回区块链的最新高度（最新区块的高度）
 func (bc *BlockChain) GetBestHeight() int {
 	var lastBlock Block
 
-	err := bc.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		lastHash := b.Get([]byte("l"))
-		blockData := b.Get(lastHash)
-		lastBlock = *DeserializeBlock(blockData)
+	err := bc.store.View(func(tx StoreTx) error {
+		lastBlock = *tx.Block(tx.Tip())
 
 		return nil
 	})
@@ -136,16 +374,14 @@ func (bc *BlockChain) GetBestHeight() int {
 func (bc *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 
-	err := bc.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-
-		blockData := b.Get(blockHash)
+	err := bc.store.View(func(tx StoreTx) error {
+		blockData := tx.Block(blockHash)
 
 		if blockData == nil {
 			return fmt.Errorf("Block %s is not found", blockHash)
 		}
 
-		block = *DeserializeBlock(blockData)
+		block = *blockData
 
 		return nil
 	})
@@ -156,6 +392,22 @@ func (bc *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
+// HasBlock 检查区块是否已存在于本地数据库中
+func (bc *BlockChain) HasBlock(blockHash []byte) bool {
+	found := false
+
+	err := bc.store.View(func(tx StoreTx) error {
+		found = tx.HasBlock(blockHash)
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return found
+}
+
 // GetBlockHashes 返回区块链中所有区块的哈希值切片
 func (bc *BlockChain) GetBlockHashes() [][]byte {
 	var blocks [][]byte
@@ -171,6 +423,82 @@ func (bc *BlockChain) GetBlockHashes() [][]byte {
 	return blocks
 }
 
+// GetBlockLocator 返回描述本地主链的区块定位器
+// 从末端开始, 前10个区块逐个记录, 之后步长每次翻倍, 最后总是包含创世块
+// 对方节点据此可以找到双方主链的分叉点
+// 通过高度索引读取定位器中的区块, 不需要遍历整条主链
+func (bc *BlockChain) GetBlockLocator() [][]byte {
+	var locator [][]byte
+
+	if err := bc.store.View(func(tx StoreTx) error {
+		tip := tx.Block(tx.Tip())
+		if tip == nil {
+			return fmt.Errorf("tip %x is not found", tx.Tip())
+		}
+		step := 1
+		height := tip.Height
+		for ; height > 0; height -= step {
+			locator = append(locator, tx.IndexGet(heightIndexBucket, heightKey(height)))
+			if len(locator) >= 10 {
+				step *= 2
+			}
+		}
+		locator = append(locator, tx.IndexGet(heightIndexBucket, heightKey(0)))
+		return nil
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	return locator
+}
+
+// GetHeadersAfter 根据对方的区块定位器找到分叉点, 按高度升序返回分叉点之后至多 limit 个主链区块头
+func (bc *BlockChain) GetHeadersAfter(locator [][]byte, limit int) []BlockHeader {
+	var headers []BlockHeader
+
+	for _, hash := range bc.GetBlockHashesAfter(locator, limit) {
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			log.Panic(err)
+		}
+		headers = append(headers, block.Header())
+	}
+
+	return headers
+}
+
+// GetBlockHashesAfter 根据对方的区块定位器找到分叉点, 按高度升序返回分叉点之后至多 limit 个主链区块哈希
+// 定位器中没有任何区块在本地主链上时, 从创世块开始返回
+// 通过高度索引判断区块是否在主链上并读取之后的区块哈希, 不需要遍历整条主链
+func (bc *BlockChain) GetBlockHashesAfter(locator [][]byte, limit int) [][]byte {
+	var hashes [][]byte
+
+	if err := bc.store.View(func(tx StoreTx) error {
+		tip := tx.Block(tx.Tip())
+		if tip == nil {
+			return fmt.Errorf("tip %x is not found", tx.Tip())
+		}
+
+		start := 0
+		for _, hash := range locator {
+			block := tx.Block(hash)
+			if block != nil && bytes.Equal(tx.IndexGet(heightIndexBucket, heightKey(block.Height)), hash) {
+				start = block.Height + 1
+				break
+			}
+		}
+
+		for height := start; height <= tip.Height && len(hashes) < limit; height++ {
+			hashes = append(hashes, tx.IndexGet(heightIndexBucket, heightKey(height)))
+		}
+		return nil
+	}); err != nil {
+		log.Panic(err)
+	}
+
+	return hashes
+}
+
 // IsDataBaseExists 检查区块链数据库文件是否存在
 func IsDataBaseExists(dbFile string) bool {
 	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
@@ -187,78 +515,155 @@ func NewBlockChain(nodeID string) (*BlockChain, error) {
 		fmt.Println("No existing blockchain found. Create one first.")
 		os.Exit(1)
 	}
-	var tip []byte 
-	db, err := bolt.Open(currentDbFile, 0600, nil)
+	store, err := OpenBoltStore(currentDbFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open db: %w", err)
+		return nil, err
 	}
-	// bolt数据库的读写事务方法，用于执行修改数据库的操作
-	err = db.Update(func (tx *bolt.Tx) error {
-		// 尝试从当前事务中获取名为blocksBucket的 "桶"，类似数据库的 "表"
-		b := tx.Bucket([]byte(blocksBucket))
-		tip = b.Get([]byte("l"))
-		return nil
-	})
+	bc, err := NewBlockChainWithStore(store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return bc, nil
+}
 
+// NewBlockChainWithStore 使用已保存区块链的存储后端创建区块链实例
+// 关闭区块链(CloseDB)时同时关闭存储
+func NewBlockChainWithStore(store ChainStore) (*BlockChain, error) {
+	var tip []byte
+	var params ChainParams
+	err := store.View(func(tx StoreTx) error {
+		tip = tx.Tip()
+		if tip == nil {
+			return errors.New("no blockchain in store")
+		}
+		var err error
+		params, err = tx.Params()
+		return err
+	})
 	if err != nil {
-		db.Close()
 		return nil, fmt.Errorf("failed to initialize db: %w", err)
 	}
 
-	bc := BlockChain{tip, db}
-
-	return &bc, nil
+	return newBlockChain(store, tip, params)
 }
 
 // CreateBlockchain 创建一个新的区块链数据库
-// address 用来接收挖出创世块的奖励
-func CreateBlockChain(address string, nodeID string) (*BlockChain, error) {
+// address 用来接收挖出创世块的奖励, opts 可以设置链参数(如共识算法)
+func CreateBlockChain(address string, nodeID string, opts ...ChainOption) (*BlockChain, error) {
 	currentDbFile := fmt.Sprintf(dbFile, nodeID)
 	if IsDataBaseExists(currentDbFile) {
 		fmt.Println("Blockchain already exists.")
 		os.Exit(1)
 	}
-	var tip []byte 
-	db, err := bolt.Open(currentDbFile, 0600, nil)
+	store, err := OpenBoltStore(currentDbFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open db: %w", err)
+		return nil, err
+	}
+	bc, err := CreateBlockChainWithStore(store, address, opts...)
+	if err != nil {
+		store.Close()
+		return nil, err
 	}
-	// bolt数据库的读写事务方法, 用于执行修改数据库的操作
-	err = db.Update(func (tx *bolt.Tx) error {
-		// 创建创世块
-		cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
-		genesis := NewGenesisBlock(cbtx)
 
-		b, err := tx.CreateBucket([]byte(blocksBucket))
-		if err != nil {
-			return err
+	return bc, nil
+}
+
+// CreateBlockChainWithStore 在空的存储后端中创建新的区块链
+// address 用来接收挖出创世块的奖励, opts 可以设置链参数(如共识算法), 关闭区块链(CloseDB)时同时关闭存储
+func CreateBlockChainWithStore(store ChainStore, address string, opts ...ChainOption) (*BlockChain, error) {
+	params := DefaultChainParams
+	for _, opt := range opts {
+		opt(&params)
+	}
+	// 创世块不依赖区块链的状态, 可以在区块链创建之前封装
+	engine, err := params.Engine(nil)
+	if err != nil {
+		return nil, err
+	}
+	// 创建创世块
+	cbtx := NewCoinbaseTX(address, genesisCoinbaseData)
+	genesis, err := sealBlock(context.Background(), engine, []*Transaction{cbtx}, []byte{}, 0, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.Update(func(tx StoreTx) error {
+		if tx.Tip() != nil {
+			return errors.New("blockchain already exists in store")
 		}
-		if err = b.Put(genesis.Hash, genesis.Serialize()); err != nil {
+		if err := tx.PutBlock(genesis); err != nil {
 			return err
 		}
-		// 用键"l"("last"的缩写)记录最新区块的哈希(此时为创世块哈希)
-		if err = b.Put([]byte("l"), genesis.Hash); err != nil {
+		// 记录最新区块的哈希(此时为创世块哈希)
+		if err := tx.SetTip(genesis.Hash); err != nil {
 			return err
 		}
-		tip = genesis.Hash // 更新tip为创世块哈希(链的末端是创世块)
-		return nil
+		return tx.PutParams(params)
 	})
-
 	if err != nil {
-		db.Close()
 		return nil, fmt.Errorf("failed to initialize db: %w", err)
 	}
 
-	bc := BlockChain{tip, db}
+	return newBlockChain(store, genesis.Hash, params)
+}
 
-	return &bc, nil
+// 根据存储中的最新区块和链参数创建区块链实例
+func newBlockChain(store ChainStore, tip []byte, params ChainParams) (*BlockChain, error) {
+	bc := &BlockChain{
+		tip:           tip,
+		store:         store,
+		params:        params,
+		maxReorgDepth: DefaultMaxReorgDepth,
+		clock:         newMedianTime(),
+		maxTimeDrift:  DefaultMaxTimeDrift,
+		utxo:          newUTXOCache(store),
+	}
+	var err error
+	if bc.engine, err = params.Engine(bc); err != nil {
+		return nil, err
+	}
+	if bc.checkpoints, err = defaultCheckpoints(); err != nil {
+		return nil, err
+	}
+	// 高度索引总是启用, 旧版本创建的区块链在第一次打开时建立
+	if err = bc.enableIndex(newHeightIndex()); err != nil {
+		return nil, err
+	}
+	// 权益证明的区块链总是启用质押索引
+	if params.Consensus == ConsensusPoS {
+		if err = bc.enableIndex(newStakeIndex()); err != nil {
+			return nil, err
+		}
+	}
+	if err = bc.enableRecordedIndexes(); err != nil {
+		return nil, err
+	}
+	// UTXO 集从上次写入存储时对应的区块更新到最新区块
+	if err = bc.utxo.load(); err != nil {
+		return nil, err
+	}
+	if err = (UTXOSet{bc}).UpdateToTip(); err != nil {
+		return nil, err
+	}
+
+	return bc, nil
 }
 
+// CloseDB 将 UTXO 缓存中的修改写入存储后关闭存储
 func (bc *BlockChain) CloseDB() {
-	bc.db.Close()
+	if err := (UTXOSet{bc}).Flush(); err != nil {
+		fmt.Printf("Failed to flush UTXO set: %v\n", err)
+	}
+	bc.store.Close()
 }
 
+// FindTransaction 在主链中查找交易, 启用了交易索引时通过索引查找, 否则从最新区块开始遍历
 func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
+	if bc.TxIndexEnabled() {
+		return bc.findIndexedTransaction(ID)
+	}
 	bci := bc.Iterator()
 
 	for {
@@ -290,6 +695,11 @@ func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey)
 }
 
 func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
+	return bc.verifyTransaction(tx, nil)
+}
+
+// 验证交易签名, 前序交易先在 pending(尚未上链的交易ID -> 交易)中查找, 再在区块链中查找
+func (bc *BlockChain) verifyTransaction(tx *Transaction, pending map[string]Transaction) bool {
 	// 如果是创世交易，直接返回true
 	if tx.IsCoinbase() {
 		return true
@@ -297,57 +707,14 @@ func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
 	prevTXs := make(map[string]Transaction)
 
 	for _, vin := range tx.Vin {
+		prevID := hex.EncodeToString(vin.Txid)
+		if prevTX, ok := pending[prevID]; ok {
+			prevTXs[prevID] = prevTX
+			continue
+		}
 		prevTX, _ := bc.FindTransaction(vin.Txid)
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
 	return tx.Verify(prevTXs)
 }
-
-// 搜寻所有未花费的交易输出
-func (bc *BlockChain) FindUTXO() map[string]TXOutputs {
-	UTXO := make(map[string]TXOutputs)
-	spentTXOs := make(map[string][]int)
-	bci := bc.Iterator()
-
-	for {
-		block := bci.Next()
-
-		for _, tx := range block.Transactions {
-			// 将交易ID（字节数组）转换为十六进制字符串（方便作为map的key）
-			txID := hex.EncodeToString(tx.ID)
-
-		Outputs: // 标签，用于跳出当前循环到下一个输出
-			// 遍历当前交易的所有输出（outIdx是输出索引，out是输出本身）
-			for outIdx, out := range tx.Vout {
-				// 检查当前输出是否已被花费
-				// 末端节点一定没有被花费
-				if spentTXOs[txID] != nil {
-					// 遍历该交易中已被花费的输出索引
-					for _, spentOutIdx := range spentTXOs[txID] {
-						// 已被花费, 则跳过该输出
-						if spentOutIdx == outIdx {
-							continue Outputs
-						}
-					}
-				}
-				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
-				UTXO[txID] = outs
-			}
-
-			if !tx.IsCoinbase() {
-				// 遍历当前交易的所有输入
-				for _, in := range tx.Vin {
-					inTxID := hex.EncodeToString(in.Txid)
-					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
-				}
-			}
-		}
-
-		if len(block.PrevHash) == 0 {
-			break
-		}
-	}
-	return UTXO
-}
\ No newline at end of file
@@ -2,12 +2,11 @@ package blockchain
 
 import (
 	"fmt"
-	"github.com/boltdb/bolt"
 )
 
 type BlockChainIterator struct {
 	currentHash []byte
-	db 			*bolt.DB
+	store 		ChainStore
 }
 
 // 在区块链数据库不存在时，创建一个全新的区块链数据库
@@ -15,10 +14,11 @@ type BlockChainIterator struct {
 func (i *BlockChainIterator) Next() *Block {
 	var block *Block
 
-	if err := i.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blocksBucket))
-		encodedBlock := b.Get(i.currentHash)
-		block = DeserializeBlock(encodedBlock)
+	if err := i.store.View(func(tx StoreTx) error {
+		block = tx.Block(i.currentHash)
+		if block == nil {
+			return fmt.Errorf("block %x is not found", i.currentHash)
+		}
 
 		return nil
 	}); err != nil {
@@ -0,0 +1,171 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestBlockHashesAfter
+// go test -v ./blockchain -run TestAddBlockValidation
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 在内存存储中创建一条包含创世块和 n 个新区块的区块链
+func newTestBlockChain(t *testing.T, n int) (*BlockChain, *Wallet) {
+	wallet := NewWallet()
+	address := string(wallet.GetAddress())
+	bc, err := CreateBlockChainWithStore(NewMemoryStore(), address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(bc.CloseDB)
+
+	UTXOSet := UTXOSet{bc}
+	UTXOSet.Reindex()
+	for i := 0; i < n; i++ {
+		block := bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+		UTXOSet.Update(block)
+	}
+
+	return bc, wallet
+}
+
+// 返回父区块为 prevHash 的新区块可以使用的时间戳
+func nextTestTimestamp(t *testing.T, bc *BlockChain, prevHash []byte) int64 {
+	var timestamp int64
+	err := bc.store.View(func(tx StoreTx) error {
+		timestamp = bc.nextTimestamp(tx, prevHash)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return timestamp
+}
+
+func TestBlockHashesAfter(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 5)
+	hashes := bc.GetBlockHashes()
+	ReverseHashes(hashes)
+
+	// 不在主链上的区块被跳过
+	fork := newTestFork(t, bc, mainChainBlock(t, bc, 1), 1, string(wallet.GetAddress()))
+	assert.NoError(t, bc.AddBlock(fork[0]))
+	after := bc.GetBlockHashesAfter([][]byte{fork[0].Hash, hashes[1]}, 10)
+	assert.Equal(t, hashes[2:], after)
+
+	// 从分叉点之后开始, 按高度升序返回
+	after = bc.GetBlockHashesAfter([][]byte{hashes[2], hashes[0]}, 10)
+	assert.Equal(t, hashes[3:], after)
+
+	// 每次返回的数量受 limit 限制
+	after = bc.GetBlockHashesAfter([][]byte{hashes[0]}, 2)
+	assert.Equal(t, hashes[1:3], after)
+
+	// 定位器与本地主链没有交集时从创世块开始
+	after = bc.GetBlockHashesAfter([][]byte{[]byte("unknown")}, 10)
+	assert.Equal(t, hashes, after)
+
+	// 对方已经是最新的
+	after = bc.GetBlockHashesAfter(bc.GetBlockLocator(), 10)
+	assert.Empty(t, after)
+}
+
+func TestBlockLocator(t *testing.T) {
+	bc, _ := newTestBlockChain(t, 15)
+	hashes := bc.GetBlockHashes()
+	locator := bc.GetBlockLocator()
+
+	assert.Equal(t, hashes[:10], locator[:10], "Locator starts with the 10 latest blocks")
+	assert.Equal(t, hashes[len(hashes)-1], locator[len(locator)-1], "Locator ends with the genesis block")
+	assert.Less(t, len(locator), len(hashes))
+	// 前10个之后步长每次翻倍: 高度 4, 最后是创世块
+	assert.Equal(t, [][]byte{hashes[11], hashes[15]}, locator[10:])
+}
+
+// 在 parent 之上封装包含 coinbase 和 transactions 的区块, 不加入区块链
+func newTestBlock(t *testing.T, bc *BlockChain, parent *Block, address string, transactions ...*Transaction) *Block {
+	transactions = append([]*Transaction{NewCoinbaseTX(address, "")}, transactions...)
+	timestamp := max(nextTestTimestamp(t, bc, parent.Hash), parent.TimeStamp+1)
+	block, err := sealBlock(context.Background(), bc.Engine(), transactions, parent.Hash, parent.Height+1, timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func TestAddBlockValidation(t *testing.T) {
+	bc, alice := newTestBlockChain(t, 1)
+	address := string(alice.GetAddress())
+	bob := NewWallet()
+	genesis, first := mainChainBlock(t, bc, 0), mainChainBlock(t, bc, 1)
+
+	// 区块内容与哈希不符
+	tampered := newTestBlock(t, bc, first, address)
+	tampered.TimeStamp++
+	assert.ErrorIs(t, bc.AddBlock(tampered), ErrInvalidBlock)
+	assert.False(t, bc.HasBlock(tampered.Hash))
+
+	// 花费不存在的输出
+	unknown := spendTx(alice, NewCoinbaseTX(address, "unknown"), 0, string(bob.GetAddress()), 4, 1)
+	invalid := newTestBlock(t, bc, first, address, unknown)
+	assert.ErrorIs(t, bc.AddBlock(invalid), ErrInvalidBlock)
+	assert.False(t, bc.HasBlock(invalid.Hash))
+
+	// 主链花费创世块的 coinbase
+	spend := spendTx(alice, genesisCoinbase(bc), 0, string(bob.GetAddress()), 4, 1)
+	second := newTestBlock(t, bc, first, address, spend)
+	assert.NoError(t, bc.AddBlock(second))
+	assert.Equal(t, second.Hash, bc.Tip())
+
+	// 分叉上的交易根据分叉对应的 UTXO 集检查: 创世块的 coinbase 在分叉上还没有被花费, 高度 1 的 coinbase 不存在
+	forkSpend := spendTx(alice, genesisCoinbase(bc), 0, string(bob.GetAddress()), 3, 2)
+	fork := newTestBlock(t, bc, genesis, address, forkSpend)
+	assert.NoError(t, bc.AddBlock(fork))
+	assert.Equal(t, second.Hash, bc.Tip())
+	missing := newTestBlock(t, bc, genesis, address, spendTx(alice, first.Transactions[0], 0, string(bob.GetAddress()), 4, 1))
+	assert.ErrorIs(t, bc.AddBlock(missing), ErrInvalidBlock)
+
+	// 同一输出在分叉上不能被花费两次
+	doubleSpend := newTestBlock(t, bc, fork, address, spend)
+	assert.ErrorIs(t, bc.AddBlock(doubleSpend), ErrInvalidBlock)
+	assert.Equal(t, second.Hash, bc.Tip())
+
+	// 用自己的私钥签名花费他人的输出
+	stolen := spendTx(bob, first.Transactions[0], 0, string(bob.GetAddress()), 4, 1)
+	assert.ErrorIs(t, bc.AddBlock(newTestBlock(t, bc, second, address, stolen)), ErrInvalidBlock)
+
+	// 交易ID与交易数据不符
+	forged := spendTx(alice, first.Transactions[0], 0, string(bob.GetAddress()), 4, 1)
+	forged.ID = second.Transactions[0].ID
+	assert.ErrorIs(t, bc.AddBlock(newTestBlock(t, bc, second, address, forged)), ErrInvalidBlock)
+
+	// 重复的 coinbase 会覆盖已存在的输出
+	timestamp := max(nextTestTimestamp(t, bc, second.Hash), second.TimeStamp+1)
+	duplicate, err := sealBlock(context.Background(), bc.Engine(), []*Transaction{first.Transactions[0]}, second.Hash, second.Height+1, timestamp)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, bc.AddBlock(duplicate), ErrInvalidBlock)
+	assert.Equal(t, second.Hash, bc.Tip())
+	_, found := UTXOSet{bc}.FindOutput(first.Transactions[0].ID, 0)
+	assert.True(t, found)
+}
+
+func TestMineBlockRechecksTransactions(t *testing.T) {
+	bc, alice := newTestBlockChain(t, 0)
+	bob := NewWallet()
+	coinbase := func() *Transaction { return NewCoinbaseTX(string(alice.GetAddress()), "") }
+	spend := spendTx(alice, genesisCoinbase(bc), 0, string(bob.GetAddress()), 4, 1)
+
+	// 用同一个模板挖矿两次, 第二次时交易已被确认
+	_, err := bc.MineBlockContext(context.Background(), []*Transaction{coinbase(), spend})
+	assert.NoError(t, err)
+	tip := bc.Tip()
+	_, err = bc.MineBlockContext(context.Background(), []*Transaction{coinbase(), spend})
+	assert.ErrorIs(t, err, ErrInvalidBlock)
+	assert.Equal(t, tip, bc.Tip())
+
+	// 第一笔交易不是 coinbase 时返回错误而不是 panic
+	_, err = bc.MineBlockContext(context.Background(), []*Transaction{spend})
+	assert.ErrorIs(t, err, ErrInvalidBlock)
+}
@@ -0,0 +1,89 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// BoltStore 是基于 BoltDB 文件的存储后端, 每种数据保存在一个桶中
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore 打开或创建 BoltDB 文件 path
+// 文件被其他进程(如正在运行的节点)锁定时, 等待 dbOpenTimeout 后返回错误, 而不是一直阻塞
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: dbOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db: %w", err)
+	}
+	return &BoltStore{db}, nil
+}
+
+func (s *BoltStore) View(fn func(tx StoreTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(storeTx{boltTx{tx}})
+	})
+}
+
+func (s *BoltStore) Update(fn func(tx StoreTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(storeTx{boltTx{tx}})
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// BoltDB 事务, 桶在第一次写入时创建
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) get(bucket string, key []byte) []byte {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Get(key)
+}
+
+func (t boltTx) put(bucket string, key, value []byte) error {
+	b, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+func (t boltTx) delete(bucket string, key []byte) error {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete(key)
+}
+
+func (t boltTx) forEach(bucket string, prefix []byte, fn func(key, value []byte) error) error {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t boltTx) deleteBucket(bucket string) error {
+	if err := t.tx.DeleteBucket([]byte(bucket)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	return nil
+}
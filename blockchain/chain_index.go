@@ -0,0 +1,217 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+)
+
+const indexTipsBucket = "indextips" // 索引名 -> 索引已处理到的最新区块哈希, 有记录的索引在打开区块链时自动启用; 键 utxoBucket 记录存储中的 UTXO 集对应的区块
+
+// 随主链变化维护的索引, 索引数据保存在与索引同名的桶中
+// 区块成为主链区块时调用 connectBlock, 重组时被移出主链的区块从最新区块开始依次调用 disconnectBlock
+type chainIndex interface {
+	name() string
+	connectBlock(tx StoreTx, block *Block) error
+	disconnectBlock(tx StoreTx, block *Block) error
+}
+
+// 可选的索引, 索引名 -> 创建索引的函数
+var optionalIndexes = map[string]func() chainIndex{
+	txIndexBucket:   newTxIndex,
+	addrIndexBucket: newAddrIndex,
+}
+
+// 启用上次运行时启用过的可选索引
+func (bc *BlockChain) enableRecordedIndexes() error {
+	var names []string
+	if err := bc.store.View(func(tx StoreTx) error {
+		return tx.IndexForEach(indexTipsBucket, func(key, _ []byte) error {
+			names = append(names, string(key))
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		newIndex := optionalIndexes[name]
+		if newIndex == nil {
+			continue
+		}
+		if err := bc.enableIndex(newIndex()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 启用索引, 索引第一次启用或停用期间主链发生了变化时, 删除旧数据并从创世块开始重建
+func (bc *BlockChain) enableIndex(index chainIndex) error {
+	return bc.store.Update(func(tx StoreTx) error {
+		bc.mu.Lock()
+		defer bc.mu.Unlock()
+
+		for _, enabled := range bc.indexes {
+			if enabled.name() == index.name() {
+				return nil
+			}
+		}
+
+		tip := tx.Tip()
+		if !bytes.Equal(tx.IndexGet(indexTipsBucket, []byte(index.name())), tip) {
+			if err := tx.DropIndex(index.name()); err != nil {
+				return err
+			}
+			_, attach, err := reorgBranches(tx, nil, tx.Block(tip))
+			if err != nil {
+				return err
+			}
+			if len(attach) > 1 {
+				fmt.Printf("Building %s from %d blocks of the main chain...\n", index.name(), len(attach))
+			}
+			for i := len(attach) - 1; i >= 0; i-- {
+				if err := index.connectBlock(tx, attach[i]); err != nil {
+					return err
+				}
+			}
+			if err := tx.IndexPut(indexTipsBucket, []byte(index.name()), tip); err != nil {
+				return err
+			}
+		}
+
+		bc.indexes = append(bc.indexes, index)
+		return nil
+	})
+}
+
+// 检查名为 name 的索引是否已启用
+func (bc *BlockChain) indexEnabled(name string) bool {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	for _, index := range bc.indexes {
+		if index.name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 将已保存在 tx 中的 block 设置为最新区块, 并更新所有启用的索引
+// oldTip 为当前的最新区块, block 不延伸 oldTip 时先从索引中移除被替换的主链区块
+// 区块在加入区块链前已验证, 可选索引更新失败说明索引与主链不一致, 此时停用并删除该索引而不拒绝区块
+func (bc *BlockChain) connectTip(tx StoreTx, block, oldTip *Block) error {
+	bc.mu.RLock()
+	indexes := bc.indexes
+	bc.mu.RUnlock()
+
+	if len(indexes) > 0 {
+		detach, attach, err := reorgBranches(tx, oldTip, block)
+		if err != nil {
+			return err
+		}
+		for _, index := range indexes {
+			err := updateIndex(tx, index, detach, attach, block.Hash)
+			if err == nil {
+				continue
+			}
+			if optionalIndexes[index.name()] == nil {
+				return err
+			}
+			fmt.Printf("Disabling %s, it is inconsistent with the main chain: %v\n", index.name(), err)
+			if err := bc.dropIndex(tx, index.name()); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.SetTip(block.Hash); err != nil {
+		return err
+	}
+	bc.setTip(block.Hash)
+	return nil
+}
+
+// 从索引中移除 detach 中的区块, 再依次加入 attach 中的区块, 两者都按高度降序排列, 最后记录索引对应的最新区块 tip
+func updateIndex(tx StoreTx, index chainIndex, detach, attach []*Block, tip []byte) error {
+	for _, b := range detach {
+		if err := index.disconnectBlock(tx, b); err != nil {
+			return err
+		}
+	}
+	for i := len(attach) - 1; i >= 0; i-- {
+		if err := index.connectBlock(tx, attach[i]); err != nil {
+			return err
+		}
+	}
+	return tx.IndexPut(indexTipsBucket, []byte(index.name()), tip)
+}
+
+// 停用索引并删除索引数据, 之后再次启用时从创世块开始重建
+func (bc *BlockChain) dropIndex(tx StoreTx, name string) error {
+	if err := tx.DropIndex(name); err != nil {
+		return err
+	}
+	if err := tx.IndexDelete(indexTipsBucket, []byte(name)); err != nil {
+		return err
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	indexes := make([]chainIndex, 0, len(bc.indexes))
+	for _, index := range bc.indexes {
+		if index.name() != name {
+			indexes = append(indexes, index)
+		}
+	}
+	bc.indexes = indexes
+	return nil
+}
+
+// 从两端向前回溯到 oldTip 和 newTip 的分叉点, 按高度降序返回
+// detach 为 oldTip 一侧分叉点之后的区块, attach 为 newTip 一侧分叉点之后的区块
+// oldTip 为 nil 时 attach 为 newTip 所在链上的全部区块
+func reorgBranches(tx StoreTx, oldTip, newTip *Block) (detach, attach []*Block, err error) {
+	oldBranch, newBranch := oldTip, newTip
+	for newBranch != nil && (oldBranch == nil || !bytes.Equal(newBranch.Hash, oldBranch.Hash)) {
+		if oldBranch == nil || newBranch.Height >= oldBranch.Height {
+			attach = append(attach, newBranch)
+			newBranch = nextAncestor(tx, newBranch)
+		} else {
+			detach = append(detach, oldBranch)
+			oldBranch = nextAncestor(tx, oldBranch)
+		}
+	}
+	if newBranch == nil && oldBranch != nil {
+		return nil, nil, fmt.Errorf("blocks %x and %x have no common ancestor", oldTip.Hash, newTip.Hash)
+	}
+	return detach, attach, nil
+}
+
+// 返回主链从 from 切换到当前最新区块时被移出主链的区块(高度降序)和加入主链的区块(高度升序), 以及当前最新区块的哈希
+func (bc *BlockChain) tipChanges(from []byte) (detach, attach []*Block, tip []byte, err error) {
+	err = bc.store.View(func(tx StoreTx) error {
+		tip = tx.Tip()
+		if bytes.Equal(from, tip) {
+			return nil
+		}
+		oldTip, newTip := tx.Block(from), tx.Block(tip)
+		if oldTip == nil || newTip == nil {
+			return fmt.Errorf("block %x or %x is not found", from, tip)
+		}
+		detach, attach, err = reorgBranches(tx, oldTip, newTip)
+		return err
+	})
+	slices.Reverse(attach)
+	return detach, attach, tip, err
+}
+
+// 返回区块的父区块, 创世块返回 nil
+func nextAncestor(tx StoreTx, block *Block) *Block {
+	if len(block.PrevHash) == 0 {
+		return nil
+	}
+	return tx.Block(block.PrevHash)
+}
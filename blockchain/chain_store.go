@@ -0,0 +1,205 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+const tipKey = "l" // 区块桶中记录最新区块哈希的键("last"的缩写)
+
+// ChainStore 是区块链的存储后端, 保存区块、最新区块、链参数、UTXO 集和各种索引
+// 所有读写都在事务中进行, 一个 Update 事务中的全部写入原子地生效
+type ChainStore interface {
+	// View 在只读事务中执行 fn
+	View(fn func(tx StoreTx) error) error
+	// Update 在读写事务中执行 fn, fn 返回错误时丢弃事务中的全部写入
+	Update(fn func(tx StoreTx) error) error
+	// Close 关闭存储, 之后不能再使用
+	Close() error
+}
+
+// StoreTx 是存储后端的一个事务
+// 返回的区块、区块头和 UTXO 都是副本, 可以在事务结束后使用; 只读事务中的写入返回错误
+type StoreTx interface {
+	// Block 返回哈希为 hash 的区块, 不存在时返回 nil
+	Block(hash []byte) *Block
+	// HasBlock 检查哈希为 hash 的区块是否存在
+	HasBlock(hash []byte) bool
+	// PutBlock 保存区块, 不改变最新区块
+	PutBlock(block *Block) error
+	// Header 返回哈希为 hash 的区块的区块头, 不存在时返回 nil
+	Header(hash []byte) *BlockHeader
+
+	// Tip 返回最新区块的哈希, 区块链为空时返回 nil
+	Tip() []byte
+	// SetTip 将哈希为 hash 的区块设置为最新区块
+	SetTip(hash []byte) error
+
+	// Params 返回链参数, 旧版本创建的区块链没有保存链参数, 返回 DefaultChainParams
+	Params() (ChainParams, error)
+	// PutParams 保存链参数
+	PutParams(params ChainParams) error
+
+	// UTXO 返回交易 txid 的第 vout 个输出在 UTXO 集中的记录
+	UTXO(txid []byte, vout int) (UTXOEntry, bool)
+	// PutUTXO 将交易 txid 的第 vout 个输出加入 UTXO 集
+	PutUTXO(txid []byte, vout int, entry UTXOEntry) error
+	// DeleteUTXO 从 UTXO 集中移除交易 txid 的第 vout 个输出
+	DeleteUTXO(txid []byte, vout int) error
+	// ForEachUTXO 按交易ID和输出序号的顺序遍历 UTXO 集, fn 返回错误时停止遍历, fn 中不能修改 UTXO 集
+	// 记录无法解码(如旧版本以交易ID为键的 UTXO 集)时返回错误
+	ForEachUTXO(fn func(txid []byte, vout int, entry UTXOEntry) error) error
+	// ResetUTXO 清空 UTXO 集
+	ResetUTXO() error
+
+	// IndexGet 返回索引 index 中键 key 的值, 不存在时返回 nil
+	IndexGet(index string, key []byte) []byte
+	// IndexPut 设置索引 index 中键 key 的值
+	IndexPut(index string, key, value []byte) error
+	// IndexDelete 删除索引 index 中的键 key
+	IndexDelete(index string, key []byte) error
+	// IndexForEach 按键的字节序遍历索引 index, fn 返回错误时停止遍历, fn 中不能修改该索引
+	IndexForEach(index string, fn func(key, value []byte) error) error
+	// IndexForEachPrefix 与 IndexForEach 相同, 但只遍历以 prefix 开头的键
+	IndexForEachPrefix(index string, prefix []byte, fn func(key, value []byte) error) error
+	// DropIndex 删除整个索引 index
+	DropIndex(index string) error
+}
+
+// 存储后端需要实现的按桶组织的有序键值事务, StoreTx 的全部方法都建立在它之上
+// get 返回的切片只在事务中有效, 桶不存在时 get 返回 nil, forEach 和 deleteBucket 什么也不做
+// forEach 按键的字节序遍历以 prefix 开头的键, prefix 为空时遍历整个桶
+type kvTx interface {
+	get(bucket string, key []byte) []byte
+	put(bucket string, key, value []byte) error
+	delete(bucket string, key []byte) error
+	forEach(bucket string, prefix []byte, fn func(key, value []byte) error) error
+	deleteBucket(bucket string) error
+}
+
+// 在键值事务 kv 之上实现 StoreTx
+type storeTx struct {
+	kv kvTx
+}
+
+func (tx storeTx) Block(hash []byte) *Block {
+	data := tx.kv.get(blocksBucket, hash)
+	if data == nil {
+		return nil
+	}
+	// 存储中的区块都由 PutBlock 写入, 无法解码说明数据库已损坏
+	block, err := DeserializeBlock(data)
+	if err != nil {
+		panic(fmt.Sprintf("block %x in store: %v", hash, err))
+	}
+	return block
+}
+
+func (tx storeTx) HasBlock(hash []byte) bool {
+	return tx.kv.get(blocksBucket, hash) != nil
+}
+
+func (tx storeTx) PutBlock(block *Block) error {
+	return tx.kv.put(blocksBucket, block.Hash, block.Serialize())
+}
+
+func (tx storeTx) Header(hash []byte) *BlockHeader {
+	block := tx.Block(hash)
+	if block == nil {
+		return nil
+	}
+	header := block.Header()
+	return &header
+}
+
+func (tx storeTx) Tip() []byte {
+	return copyBytes(tx.kv.get(blocksBucket, []byte(tipKey)))
+}
+
+func (tx storeTx) SetTip(hash []byte) error {
+	return tx.kv.put(blocksBucket, []byte(tipKey), hash)
+}
+
+func (tx storeTx) Params() (ChainParams, error) {
+	params := DefaultChainParams
+	data := tx.kv.get(paramsBucket, []byte(paramsKey))
+	if data == nil {
+		return params, nil
+	}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&params)
+	return params, err
+}
+
+func (tx storeTx) PutParams(params ChainParams) error {
+	return tx.kv.put(paramsBucket, []byte(paramsKey), gobEncode(params))
+}
+
+func (tx storeTx) UTXO(txid []byte, vout int) (UTXOEntry, bool) {
+	data := tx.kv.get(utxoBucket, utxoKey(txid, vout))
+	if data == nil {
+		return UTXOEntry{}, false
+	}
+	entry, err := DeserializeUTXOEntry(data)
+	return entry, err == nil
+}
+
+func (tx storeTx) PutUTXO(txid []byte, vout int, entry UTXOEntry) error {
+	return tx.kv.put(utxoBucket, utxoKey(txid, vout), entry.Serialize())
+}
+
+func (tx storeTx) DeleteUTXO(txid []byte, vout int) error {
+	return tx.kv.delete(utxoBucket, utxoKey(txid, vout))
+}
+
+func (tx storeTx) ForEachUTXO(fn func(txid []byte, vout int, entry UTXOEntry) error) error {
+	return tx.kv.forEach(utxoBucket, nil, func(k, v []byte) error {
+		txid, vout, ok := parseUTXOKey(k)
+		if !ok {
+			return fmt.Errorf("invalid UTXO key %x", k)
+		}
+		entry, err := DeserializeUTXOEntry(v)
+		if err != nil {
+			return fmt.Errorf("invalid UTXO entry %x: %w", k, err)
+		}
+		return fn(txid, vout, entry)
+	})
+}
+
+func (tx storeTx) ResetUTXO() error {
+	return tx.kv.deleteBucket(utxoBucket)
+}
+
+func (tx storeTx) IndexGet(index string, key []byte) []byte {
+	return copyBytes(tx.kv.get(index, key))
+}
+
+func (tx storeTx) IndexPut(index string, key, value []byte) error {
+	return tx.kv.put(index, key, value)
+}
+
+func (tx storeTx) IndexDelete(index string, key []byte) error {
+	return tx.kv.delete(index, key)
+}
+
+func (tx storeTx) IndexForEach(index string, fn func(key, value []byte) error) error {
+	return tx.IndexForEachPrefix(index, nil, fn)
+}
+
+func (tx storeTx) IndexForEachPrefix(index string, prefix []byte, fn func(key, value []byte) error) error {
+	return tx.kv.forEach(index, prefix, func(k, v []byte) error {
+		return fn(copyBytes(k), copyBytes(v))
+	})
+}
+
+func (tx storeTx) DropIndex(index string) error {
+	return tx.kv.deleteBucket(index)
+}
+
+// 复制存储返回的切片, 使其在事务结束后仍然有效, nil 保持为 nil
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	return append([]byte{}, data...)
+}
@@ -0,0 +1,142 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestChainStore
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 两种存储后端必须表现一致
+func forEachStore(t *testing.T, fn func(t *testing.T, store ChainStore)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemoryStore())
+	})
+	t.Run("bolt", func(t *testing.T) {
+		store, err := OpenBoltStore(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		fn(t, store)
+	})
+}
+
+func TestChainStoreTransactions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ChainStore) {
+		block := NewGenesisBlock(NewCoinbaseTX(string(NewWallet().GetAddress()), ""))
+		entry := UTXOEntry{Output: *NewTXOutput(10, string(NewWallet().GetAddress())), Height: 3, Coinbase: true}
+
+		assert.NoError(t, store.Update(func(tx StoreTx) error {
+			assert.Nil(t, tx.Tip())
+			params, err := tx.Params()
+			assert.NoError(t, err)
+			assert.Equal(t, DefaultChainParams, params)
+
+			assert.NoError(t, tx.PutBlock(block))
+			assert.NoError(t, tx.SetTip(block.Hash))
+			assert.NoError(t, tx.PutParams(ChainParams{Consensus: ConsensusPoA, Signers: []string{"a"}}))
+			assert.NoError(t, tx.PutUTXO([]byte{2}, 0, entry))
+			assert.NoError(t, tx.PutUTXO([]byte{1}, 1, entry))
+			assert.NoError(t, tx.PutUTXO([]byte{1}, 0, entry))
+			assert.NoError(t, tx.IndexPut("test", []byte("k"), []byte("v")))
+			assert.NoError(t, tx.IndexPut("test", []byte("j"), []byte("v")))
+			assert.NoError(t, tx.IndexPut("test", []byte("kk"), []byte("v")))
+			// 事务中可以读到自己的写入
+			assert.True(t, tx.HasBlock(block.Hash))
+			return nil
+		}))
+
+		// 失败的事务不留下任何写入
+		errAbort := errors.New("abort")
+		assert.ErrorIs(t, store.Update(func(tx StoreTx) error {
+			assert.NoError(t, tx.DeleteUTXO([]byte{1}, 0))
+			assert.NoError(t, tx.DropIndex("test"))
+			assert.NoError(t, tx.SetTip([]byte{9}))
+			return errAbort
+		}), errAbort)
+
+		assert.NoError(t, store.View(func(tx StoreTx) error {
+			assert.Equal(t, block.Hash, tx.Tip())
+			assert.Equal(t, block.Hash, tx.Block(block.Hash).Hash)
+			assert.Equal(t, block.Hash, tx.Header(block.Hash).Hash)
+			assert.Nil(t, tx.Block([]byte{9}))
+			params, err := tx.Params()
+			assert.NoError(t, err)
+			assert.Equal(t, ConsensusPoA, params.Consensus)
+			assert.Equal(t, []byte("v"), tx.IndexGet("test", []byte("k")))
+			var keys []string
+			assert.NoError(t, tx.IndexForEachPrefix("test", []byte("k"), func(key, _ []byte) error {
+				keys = append(keys, string(key))
+				return nil
+			}))
+			assert.Equal(t, []string{"k", "kk"}, keys)
+
+			// UTXO 集按交易ID和输出序号遍历
+			var outpoints [][]byte
+			assert.NoError(t, tx.ForEachUTXO(func(txid []byte, vout int, e UTXOEntry) error {
+				outpoints = append(outpoints, append(txid, byte(vout)))
+				assert.Equal(t, entry, e)
+				return nil
+			}))
+			assert.Equal(t, [][]byte{{1, 0}, {1, 1}, {2, 0}}, outpoints)
+
+			// 只读事务不能写入
+			assert.Error(t, tx.SetTip([]byte{9}))
+			return nil
+		}))
+
+		assert.NoError(t, store.Update(func(tx StoreTx) error {
+			assert.NoError(t, tx.ResetUTXO())
+			assert.NoError(t, tx.PutUTXO([]byte{3}, 0, entry))
+			assert.NoError(t, tx.IndexDelete("test", []byte("k")))
+			return nil
+		}))
+		assert.NoError(t, store.View(func(tx StoreTx) error {
+			_, ok := tx.UTXO([]byte{1}, 0)
+			assert.False(t, ok)
+			e, ok := tx.UTXO([]byte{3}, 0)
+			assert.True(t, ok)
+			assert.Equal(t, entry, e)
+			assert.Nil(t, tx.IndexGet("test", []byte("k")))
+			return nil
+		}))
+	})
+}
+
+func TestChainStoreBlockChain(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ChainStore) {
+		wallet := NewWallet()
+		address := string(wallet.GetAddress())
+		bc, err := CreateBlockChainWithStore(store, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = CreateBlockChainWithStore(store, address)
+		assert.Error(t, err, "Store already holds a blockchain")
+
+		UTXOSet{bc}.Reindex()
+		for i := 0; i < 3; i++ {
+			UTXOSet{bc}.Update(bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")}))
+		}
+		balance := 0
+		for _, out := range (UTXOSet{bc}).FindUTXO(HashPubKey(wallet.PublicKey)) {
+			balance += out.Value
+		}
+		assert.Equal(t, 4*subsidy, balance)
+
+		// 从同一个存储重新创建的区块链状态相同
+		reopened, err := NewBlockChainWithStore(store)
+		assert.NoError(t, err)
+		assert.Equal(t, bc.Tip(), reopened.Tip())
+		assert.Equal(t, 3, reopened.GetBestHeight())
+		assert.Equal(t, 4, UTXOSet{reopened}.CountTransactions())
+
+		_, err = NewBlockChainWithStore(NewMemoryStore())
+		assert.Error(t, err, "Empty store has no blockchain")
+	})
+}
@@ -0,0 +1,164 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+)
+
+const paramsBucket = "params"
+const paramsKey = "chain"
+
+// 可选的共识算法
+const (
+	ConsensusPoW = "pow" // 工作量证明
+	ConsensusPoA = "poa" // 权威证明, 签名者按顺序轮流签名区块
+	ConsensusPoS = "pos" // 权益证明, 按质押数量加权选出每个高度的验证者
+)
+
+// ConsensusEngine 决定如何封装区块以及如何验证区块头
+type ConsensusEngine interface {
+	// Prepare 在封装前设置区块中与共识相关的字段, 当前节点不能封装该区块时返回错误
+	Prepare(block *Block) error
+	// Seal 封装区块并设置区块的哈希, ctx 被取消时返回 ctx 的错误
+	// opts 只对工作量证明有效
+	Seal(ctx context.Context, block *Block, opts ...SealOption) error
+	// VerifyHeader 验证区块头满足共识规则, 无效时返回 ErrInvalidBlock
+	VerifyHeader(header *BlockHeader) error
+}
+
+// Authorizer 由需要使用私钥签名区块的共识引擎实现
+type Authorizer interface {
+	// Authorize 设置签名区块使用的钱包
+	Authorize(wallet *Wallet)
+}
+
+// ChainParams 是创建区块链时确定的链参数, 保存在区块链数据库中, 同一条链上的节点使用相同的参数
+// Consensus		共识算法, ConsensusPoW、ConsensusPoA 或 ConsensusPoS
+// Signers		权威证明的签名者地址, 高度为 h 的区块由 Signers[h % len(Signers)] 签名; 也是权益证明的初始验证者, 没有任何质押时由它们轮流签名
+type ChainParams struct {
+	Consensus string
+	Signers   []string
+}
+
+// DefaultChainParams 是未指定链参数时使用的参数(工作量证明)
+var DefaultChainParams = ChainParams{Consensus: ConsensusPoW}
+
+// Engine 根据链参数创建区块链 bc 的共识引擎
+// 权益证明需要从 bc 中读取质押分布, bc 为 nil 时只检查参数是否有效
+func (p ChainParams) Engine(bc *BlockChain) (ConsensusEngine, error) {
+	switch p.Consensus {
+	case ConsensusPoW:
+		return NewPoWEngine(), nil
+	case ConsensusPoA:
+		return NewPoAEngine(p.Signers)
+	case ConsensusPoS:
+		return NewPoSEngine(p.Signers, bc)
+	default:
+		return nil, fmt.Errorf("unknown consensus %q", p.Consensus)
+	}
+}
+
+// ChainOption 用于在创建区块链时修改默认配置
+type ChainOption func(*ChainParams)
+
+// WithChainParams 设置新区块链的链参数, 默认为 DefaultChainParams
+func WithChainParams(params ChainParams) ChainOption {
+	return func(p *ChainParams) {
+		*p = params
+	}
+}
+
+// 使用共识引擎 engine 创建并封装高度为 height、时间戳为 timestamp 的区块
+func sealBlock(ctx context.Context, engine ConsensusEngine, transactions []*Transaction, prevHash []byte, height int, timestamp int64, opts ...SealOption) (*Block, error) {
+	block := &Block{
+		TimeStamp:    timestamp,
+		Transactions: transactions,
+		PrevHash:     prevHash,
+		Hash:         []byte{},
+		Height:       height,
+	}
+	if err := engine.Prepare(block); err != nil {
+		return nil, err
+	}
+	if err := engine.Seal(ctx, block, opts...); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// 将地址列表转换为公钥哈希列表
+func addressesToPubKeyHashes(addresses []string) ([][]byte, error) {
+	var hashes [][]byte
+	for _, address := range addresses {
+		if !ValidateAddress(address) {
+			return nil, fmt.Errorf("address %s is not valid", address)
+		}
+		pubKeyHash := Base58Decode([]byte(address))
+		hashes = append(hashes, pubKeyHash[1:len(pubKeyHash)-addressChecksumLen])
+	}
+	return hashes, nil
+}
+
+// 需要签名的共识算法(权威证明、权益证明)的区块哈希, 包含区块头中除哈希和签名以外的所有字段
+func signedBlockHash(h *BlockHeader) []byte {
+	data := bytes.Join([][]byte{
+		h.PrevHash,
+		h.MerkleRoot,
+		h.EvidenceHash,
+		IntToHex(h.TimeStamp),
+		IntToHex(int64(h.Height)),
+		h.Signer,
+	}, []byte{})
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// 计算区块哈希并使用 wallet 签名, wallet 必须是 Prepare 时记录在区块中的签名者, 创世块不需要签名
+func sealSigned(ctx context.Context, block *Block, wallet *Wallet) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	header := block.Header()
+	block.Hash = signedBlockHash(&header)
+	if block.Height == 0 {
+		return nil
+	}
+	if wallet == nil || !bytes.Equal(wallet.PublicKey, block.Signer) {
+		return ErrUnauthorizedSigner
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, &wallet.PrivateKey, block.Hash)
+	if err != nil {
+		return err
+	}
+	// r 和 s 各占 32 字节, 验证时从中间拆分
+	block.Signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return nil
+}
+
+// 验证区块头的哈希和签名者的签名, 创世块不需要签名
+func verifySigned(header *BlockHeader) error {
+	if !bytes.Equal(signedBlockHash(header), header.Hash) {
+		return fmt.Errorf("%w: hash of block %x does not match its header", ErrInvalidBlock, header.Hash)
+	}
+	if header.Height == 0 {
+		return nil
+	}
+
+	sigLen, keyLen := len(header.Signature), len(header.Signer)
+	r := new(big.Int).SetBytes(header.Signature[:sigLen/2])
+	s := new(big.Int).SetBytes(header.Signature[sigLen/2:])
+	x := new(big.Int).SetBytes(header.Signer[:keyLen/2])
+	y := new(big.Int).SetBytes(header.Signer[keyLen/2:])
+	pubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	if sigLen == 0 || keyLen == 0 || !ecdsa.Verify(&pubKey, header.Hash, r, s) {
+		return fmt.Errorf("%w: block %x has an invalid signature", ErrInvalidBlock, header.Hash)
+	}
+	return nil
+}
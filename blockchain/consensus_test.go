@@ -0,0 +1,80 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestPoA
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainParams(t *testing.T) {
+	_, err := ChainParams{Consensus: "unknown"}.Engine(nil)
+	assert.Error(t, err)
+	_, err = ChainParams{Consensus: ConsensusPoA}.Engine(nil)
+	assert.Error(t, err, "Proof of authority requires signers")
+	_, err = ChainParams{Consensus: ConsensusPoA, Signers: []string{"invalid"}}.Engine(nil)
+	assert.Error(t, err)
+
+	bc, _ := newTestBlockChain(t, 1)
+	assert.Equal(t, DefaultChainParams, bc.Params())
+	assert.IsType(t, &PoWEngine{}, bc.Engine())
+}
+
+func TestPoAEngine(t *testing.T) {
+	t.Chdir(t.TempDir())
+	alice, bob := NewWallet(), NewWallet()
+	params := ChainParams{
+		Consensus: ConsensusPoA,
+		Signers:   []string{string(alice.GetAddress()), string(bob.GetAddress())},
+	}
+	bc, err := CreateBlockChain(string(alice.GetAddress()), "test", WithChainParams(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := bc.Engine().(*PoAEngine)
+	coinbase := func() []*Transaction {
+		return []*Transaction{NewCoinbaseTX(string(alice.GetAddress()), "")}
+	}
+
+	// 没有签名者或没有轮到签名者时不能封装区块
+	_, err = bc.MineBlockContext(context.Background(), coinbase())
+	assert.ErrorIs(t, err, ErrUnauthorizedSigner)
+	engine.Authorize(alice)
+	_, err = bc.MineBlockContext(context.Background(), coinbase())
+	assert.ErrorIs(t, err, ErrNotInTurn, "Block 1 is sealed by the second signer")
+
+	engine.Authorize(bob)
+	block, err := bc.MineBlockContext(context.Background(), coinbase())
+	assert.NoError(t, err)
+	assert.Equal(t, bob.PublicKey, block.Signer)
+	header := block.Header()
+	assert.NoError(t, engine.VerifyHeader(&header))
+
+	forged := header
+	forged.TimeStamp++
+	assert.ErrorIs(t, engine.VerifyHeader(&forged), ErrInvalidBlock, "Hash must match the header")
+	forged = header
+	forged.Signature = append([]byte{}, header.Signature...)
+	forged.Signature[0] ^= 0xff
+	assert.ErrorIs(t, engine.VerifyHeader(&forged), ErrInvalidBlock, "Signature must be valid")
+
+	// 轮到 alice 时 bob 签名的区块无效
+	engine.Authorize(alice)
+	block, err = bc.MineBlockContext(context.Background(), coinbase())
+	assert.NoError(t, err)
+	header = block.Header()
+	header.Height++
+	header.Hash = signedBlockHash(&header)
+	assert.ErrorIs(t, engine.VerifyHeader(&header), ErrInvalidBlock, "Block must be signed by the signer in turn")
+
+	// 链参数保存在数据库中
+	bc.CloseDB()
+	bc, err = NewBlockChain("test")
+	assert.NoError(t, err)
+	defer bc.CloseDB()
+	assert.Equal(t, params, bc.Params())
+	assert.Equal(t, 2, bc.GetBestHeight())
+}
@@ -0,0 +1,125 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxReorgDepth 是默认允许的最大重组深度, 需要回滚更多区块的分叉会被拒绝
+const DefaultMaxReorgDepth = 100
+
+// DefaultCheckpoints 是编译进程序的检查点(高度 -> 区块哈希的十六进制), 所有节点都会强制执行
+// 主链上这些高度的区块不会再被替换, 发布新版本时可以加入已经足够深的区块
+var DefaultCheckpoints = map[int]string{}
+
+var (
+	// ErrCheckpointMismatch 表示区块或它所在的分叉与检查点冲突
+	ErrCheckpointMismatch = errors.New("block conflicts with a checkpoint")
+	// ErrReorgTooDeep 表示切换到区块所在的分叉需要回滚超过最大重组深度的区块
+	ErrReorgTooDeep = errors.New("reorganization is too deep")
+)
+
+// ParseCheckpoints 解析逗号分隔的检查点列表, 格式为 HEIGHT:HASH,HEIGHT:HASH
+func ParseCheckpoints(list string) (map[int][]byte, error) {
+	checkpoints := make(map[int][]byte)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		height, hash, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, fmt.Errorf("checkpoint %q is not HEIGHT:HASH", item)
+		}
+		h, err := strconv.Atoi(height)
+		if err != nil || h < 0 {
+			return nil, fmt.Errorf("checkpoint %q has an invalid height", item)
+		}
+		checkpoints[h], err = hex.DecodeString(hash)
+		if err != nil {
+			return nil, fmt.Errorf("checkpoint %q has an invalid hash: %w", item, err)
+		}
+	}
+	return checkpoints, nil
+}
+
+// 解码 DefaultCheckpoints
+func defaultCheckpoints() (map[int][]byte, error) {
+	checkpoints := make(map[int][]byte)
+	for height, hash := range DefaultCheckpoints {
+		data, err := hex.DecodeString(hash)
+		if err != nil {
+			return nil, fmt.Errorf("default checkpoint at height %d: %w", height, err)
+		}
+		checkpoints[height] = data
+	}
+	return checkpoints, nil
+}
+
+// AddCheckpoint 要求主链上高度为 height 的区块的哈希为 hash
+// 已经存在的同一高度的检查点会被替换
+func (bc *BlockChain) AddCheckpoint(height int, hash []byte) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.checkpoints[height] = hash
+}
+
+// SetMaxReorgDepth 设置允许的最大重组深度, 小于等于 0 时不限制
+func (bc *BlockChain) SetMaxReorgDepth(depth int) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.maxReorgDepth = depth
+}
+
+// 返回高度为 height 的检查点, 没有检查点时返回 nil
+func (bc *BlockChain) checkpoint(height int) []byte {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	return bc.checkpoints[height]
+}
+
+// 检查将 block 加入区块链是否违反最终性规则
+// block 的高度有检查点时哈希必须相同; block 将成为最新区块但不延伸当前主链时,
+// 从分叉点到 block 的所有检查点都必须匹配, 且需要回滚的区块数不能超过最大重组深度
+// tx 为存储事务, lastBlock 为当前的最新区块
+func (bc *BlockChain) checkFinality(tx StoreTx, block, lastBlock *Block) error {
+	if cp := bc.checkpoint(block.Height); cp != nil && !bytes.Equal(cp, block.Hash) {
+		return fmt.Errorf("%w: block %x at height %d, checkpoint %x", ErrCheckpointMismatch, block.Hash, block.Height, cp)
+	}
+	if block.Height <= lastBlock.Height || bytes.Equal(block.PrevHash, lastBlock.Hash) {
+		return nil
+	}
+
+	// 从两端向前回溯到分叉点, 同时检查新分叉上的检查点
+	newBranch, oldBranch := block, lastBlock
+	for !bytes.Equal(newBranch.Hash, oldBranch.Hash) {
+		if newBranch.Height >= oldBranch.Height {
+			if cp := bc.checkpoint(newBranch.Height); cp != nil && !bytes.Equal(cp, newBranch.Hash) {
+				return fmt.Errorf("%w: fork of block %x replaces checkpoint %x at height %d", ErrCheckpointMismatch, block.Hash, cp, newBranch.Height)
+			}
+			parent := tx.Block(newBranch.PrevHash)
+			if parent == nil {
+				return fmt.Errorf("ancestor %x of block %x is unknown", newBranch.PrevHash, block.Hash)
+			}
+			newBranch = parent
+		} else {
+			oldBranch = tx.Block(oldBranch.PrevHash)
+		}
+	}
+
+	bc.mu.RLock()
+	maxDepth := bc.maxReorgDepth
+	bc.mu.RUnlock()
+	if depth := lastBlock.Height - newBranch.Height; maxDepth > 0 && depth > maxDepth {
+		fmt.Printf("ALERT: refusing to switch to block %x, it would roll back %d blocks after fork point %x (limit %d)\n", block.Hash, depth, newBranch.Hash, maxDepth)
+		return fmt.Errorf("%w: %d blocks, limit %d", ErrReorgTooDeep, depth, maxDepth)
+	}
+	return nil
+}
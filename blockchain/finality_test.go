@@ -0,0 +1,108 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestFinality
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 在 parent 之上挖出 n 个区块组成的分叉, 不加入区块链
+func newTestFork(t *testing.T, bc *BlockChain, parent *Block, n int, address string) []*Block {
+	var fork []*Block
+	// 分叉上的区块还没有加入区块链, 使时间戳逐个递增以满足过去中位时间的规则
+	timestamp := max(nextTestTimestamp(t, bc, parent.Hash), parent.TimeStamp+1)
+	for i := 0; i < n; i++ {
+		block, err := sealBlock(context.Background(), bc.Engine(), []*Transaction{NewCoinbaseTX(address, "")}, parent.Hash, parent.Height+1, timestamp+int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fork = append(fork, block)
+		parent = block
+	}
+	return fork
+}
+
+// 返回主链上高度为 height 的区块
+func mainChainBlock(t *testing.T, bc *BlockChain, height int) *Block {
+	block, err := bc.GetBlockByHeight(height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &block
+}
+
+func TestFinalityReorgDepth(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 4)
+	address := string(wallet.GetAddress())
+	bc.SetMaxReorgDepth(2)
+
+	// 切换到从高度 1 分叉的链需要回滚 3 个区块
+	fork := newTestFork(t, bc, mainChainBlock(t, bc, 1), 4, address)
+	for _, block := range fork[:3] {
+		assert.NoError(t, bc.AddBlock(block), "Side chain blocks are stored")
+	}
+	tip := bc.Tip()
+	assert.ErrorIs(t, bc.AddBlock(fork[3]), ErrReorgTooDeep)
+	assert.Equal(t, tip, bc.Tip())
+	assert.False(t, bc.HasBlock(fork[3].Hash))
+
+	// 只回滚 2 个区块的分叉可以切换
+	fork = newTestFork(t, bc, mainChainBlock(t, bc, 2), 3, address)
+	for _, block := range fork {
+		assert.NoError(t, bc.AddBlock(block))
+	}
+	assert.Equal(t, fork[2].Hash, bc.Tip())
+
+	// 不限制重组深度
+	bc.SetMaxReorgDepth(0)
+	fork = newTestFork(t, bc, mainChainBlock(t, bc, 0), 6, address)
+	for _, block := range fork {
+		assert.NoError(t, bc.AddBlock(block))
+	}
+	assert.Equal(t, fork[5].Hash, bc.Tip())
+}
+
+func TestFinalityCheckpoints(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 4)
+	address := string(wallet.GetAddress())
+	bc.SetMaxReorgDepth(0)
+
+	// 检查点加入之前保存的分叉不能替换检查点
+	fork := newTestFork(t, bc, mainChainBlock(t, bc, 1), 4, address)
+	for _, block := range fork[:3] {
+		assert.NoError(t, bc.AddBlock(block))
+	}
+	checkpoint := mainChainBlock(t, bc, 3)
+	bc.AddCheckpoint(3, checkpoint.Hash)
+	assert.ErrorIs(t, bc.AddBlock(fork[3]), ErrCheckpointMismatch)
+	assert.Equal(t, checkpoint.Hash, mainChainBlock(t, bc, 3).Hash)
+
+	// 检查点高度上的其他区块被直接拒绝
+	fork = newTestFork(t, bc, mainChainBlock(t, bc, 2), 3, address)
+	assert.ErrorIs(t, bc.AddBlock(fork[0]), ErrCheckpointMismatch)
+	assert.False(t, bc.HasBlock(fork[0].Hash))
+
+	// 延伸检查点的分叉可以切换
+	fork = newTestFork(t, bc, checkpoint, 2, address)
+	for _, block := range fork {
+		assert.NoError(t, bc.AddBlock(block))
+	}
+	assert.Equal(t, fork[1].Hash, bc.Tip())
+}
+
+func TestParseCheckpoints(t *testing.T) {
+	checkpoints, err := ParseCheckpoints("10:00ff, 20:abcd,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[int][]byte{10: {0x00, 0xff}, 20: {0xab, 0xcd}}, checkpoints)
+
+	_, err = ParseCheckpoints("10")
+	assert.Error(t, err)
+	_, err = ParseCheckpoints("x:00")
+	assert.Error(t, err)
+	_, err = ParseCheckpoints("10:zz")
+	assert.Error(t, err)
+}
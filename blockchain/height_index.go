@@ -0,0 +1,106 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const heightIndexBucket = "heightindex" // 主链区块高度 -> 区块哈希
+const heightRangeBatch = 100            // 按高度遍历时每个事务读取的区块数
+
+// 高度索引, 记录主链上每个高度的区块哈希, 总是启用
+type heightIndex struct{}
+
+func newHeightIndex() chainIndex {
+	return heightIndex{}
+}
+
+func (heightIndex) name() string {
+	return heightIndexBucket
+}
+
+func (heightIndex) connectBlock(tx StoreTx, block *Block) error {
+	return tx.IndexPut(heightIndexBucket, heightKey(block.Height), block.Hash)
+}
+
+func (heightIndex) disconnectBlock(tx StoreTx, block *Block) error {
+	return tx.IndexDelete(heightIndexBucket, heightKey(block.Height))
+}
+
+// 高度的键, 大端序使键的字节序与高度的顺序一致
+func heightKey(height int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+	return key
+}
+
+// GetBlockHashByHeight 返回主链上高度为 height 的区块哈希, 不存在时返回 nil
+func (bc *BlockChain) GetBlockHashByHeight(height int) []byte {
+	var hash []byte
+	if height < 0 {
+		return nil
+	}
+	if err := bc.store.View(func(tx StoreTx) error {
+		hash = tx.IndexGet(heightIndexBucket, heightKey(height))
+		return nil
+	}); err != nil {
+		return nil
+	}
+	return hash
+}
+
+// GetBlockByHeight 返回主链上高度为 height 的区块
+func (bc *BlockChain) GetBlockByHeight(height int) (Block, error) {
+	hash := bc.GetBlockHashByHeight(height)
+	if hash == nil {
+		return Block{}, fmt.Errorf("no block at height %d in the main chain", height)
+	}
+	return bc.GetBlock(hash)
+}
+
+// ForEachBlockInRange 依次对主链上高度从 from 到 to(包含两端)的区块调用 fn, from 大于 to 时按高度降序遍历
+// 超出主链高度的部分被忽略, fn 返回错误时停止遍历并返回该错误
+// 遍历期间主链可能发生变化, 每批区块读取自同一时刻的主链
+func (bc *BlockChain) ForEachBlockInRange(from, to int, fn func(block *Block) error) error {
+	step := 1
+	if from > to {
+		from, to, step = to, from, -1
+	}
+	// 将范围限制在主链之内
+	best := bc.GetBestHeight()
+	if to < 0 || from > best {
+		return nil
+	}
+	from, to = max(from, 0), min(to, best)
+	if step < 0 {
+		from, to = to, from
+	}
+
+	for height := from; (to-height)*step >= 0; {
+		var blocks []*Block
+		// 在事务外调用 fn, fn 中可以继续读写区块链
+		if err := bc.store.View(func(tx StoreTx) error {
+			for ; (to-height)*step >= 0 && len(blocks) < heightRangeBatch; height += step {
+				hash := tx.IndexGet(heightIndexBucket, heightKey(height))
+				if hash == nil {
+					continue
+				}
+				block := tx.Block(hash)
+				if block == nil {
+					return fmt.Errorf("block %x at height %d is not found", hash, height)
+				}
+				blocks = append(blocks, block)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, block := range blocks {
+			if err := fn(block); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
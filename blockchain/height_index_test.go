@@ -0,0 +1,51 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestHeightIndex
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 按高度遍历区块, 返回遍历到的高度
+func heightsInRange(t *testing.T, bc *BlockChain, from, to int) []int {
+	var heights []int
+	err := bc.ForEachBlockInRange(from, to, func(block *Block) error {
+		heights = append(heights, block.Height)
+		return nil
+	})
+	assert.NoError(t, err)
+	return heights
+}
+
+func TestHeightIndex(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 4)
+	hashes := bc.GetBlockHashes()
+	for i, hash := range hashes {
+		block, err := bc.GetBlockByHeight(len(hashes) - 1 - i)
+		assert.NoError(t, err)
+		assert.Equal(t, hash, block.Hash)
+	}
+	_, err := bc.GetBlockByHeight(5)
+	assert.Error(t, err)
+
+	// 两个方向的遍历, 超出主链的部分被忽略
+	assert.Equal(t, []int{1, 2, 3}, heightsInRange(t, bc, 1, 3))
+	assert.Equal(t, []int{4, 3, 2, 1, 0}, heightsInRange(t, bc, 10, -1))
+	assert.Empty(t, heightsInRange(t, bc, 5, 10))
+	errStop := errors.New("stop")
+	assert.ErrorIs(t, bc.ForEachBlockInRange(0, 4, func(block *Block) error { return errStop }), errStop)
+
+	// 重组后高度指向新的主链区块, 被替换的高度不再有旧区块
+	fork := newTestFork(t, bc, mainChainBlock(t, bc, 1), 4, string(wallet.GetAddress()))
+	for _, block := range fork {
+		assert.NoError(t, bc.AddBlock(block))
+	}
+	for i, block := range fork {
+		assert.Equal(t, block.Hash, bc.GetBlockHashByHeight(i+2))
+	}
+	assert.Equal(t, []int{5, 4, 3, 2, 1, 0}, heightsInRange(t, bc, 5, 0))
+}
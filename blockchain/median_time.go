@@ -0,0 +1,130 @@
+package blockchain
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const medianTimeBlocks = 11                // 计算过去中位时间(MTP)使用的区块数
+const maxTimeSamples = 200                 // 最多记录的对等节点时间样本数
+const maxTimeAdjustment = 70 * time.Minute // 网络时间与本地时间的偏差超过该值时不调整, 本地时钟可能有误
+
+// DefaultMaxTimeDrift 是默认允许的区块时间戳超前于网络调整时间的最大值
+const DefaultMaxTimeDrift = 2 * time.Hour
+
+// 网络调整时间: 本地时间加上对等节点时间偏差的中位数
+// offsets	每个对等节点的时间减去本地时间, 只保留每个节点第一次的样本
+// offset	当前使用的偏差
+type medianTime struct {
+	mu      sync.Mutex
+	offsets map[string]time.Duration
+	offset  time.Duration
+}
+
+func newMedianTime() *medianTime {
+	return &medianTime{offsets: make(map[string]time.Duration)}
+}
+
+// 记录对等节点 peer 报告的时间, 重新计算偏差
+func (mt *medianTime) addSample(peer string, peerTime time.Time) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	if _, ok := mt.offsets[peer]; ok || len(mt.offsets) >= maxTimeSamples {
+		return
+	}
+	mt.offsets[peer] = time.Until(peerTime).Truncate(time.Second)
+
+	offsets := make([]time.Duration, 0, len(mt.offsets))
+	for _, offset := range mt.offsets {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	median := offsets[len(offsets)/2]
+	if median > maxTimeAdjustment || median < -maxTimeAdjustment {
+		fmt.Printf("WARNING: network time differs from the local time by %v, please check the system clock\n", median)
+		median = 0
+	}
+	mt.offset = median
+}
+
+// 返回网络调整时间
+func (mt *medianTime) now() time.Time {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	return time.Now().Add(mt.offset)
+}
+
+// AdjustedTime 返回网络调整时间, 即本地时间加上对等节点时间偏差的中位数
+func (bc *BlockChain) AdjustedTime() time.Time {
+	return bc.clock.now()
+}
+
+// SetMaxTimeDrift 设置区块时间戳允许超前于网络调整时间的最大值
+func (bc *BlockChain) SetMaxTimeDrift(drift time.Duration) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.maxTimeDrift = drift
+}
+
+// 检查时间戳没有超前网络调整时间太多
+func (bc *BlockChain) checkFutureTime(hash []byte, timestamp int64) error {
+	bc.mu.RLock()
+	drift := bc.maxTimeDrift
+	bc.mu.RUnlock()
+
+	now := bc.AdjustedTime()
+	if timestamp > now.Add(drift).Unix() {
+		return fmt.Errorf("%w: timestamp of block %x is %d seconds ahead of the network time, limit %v", ErrInvalidBlock, hash, timestamp-now.Unix(), drift)
+	}
+	return nil
+}
+
+// 返回以 hash 为最新区块的链上最近 medianTimeBlocks 个区块时间戳的中位数
+// tx 为存储事务, 区块不存在(如创世块的父区块)时返回 0
+func medianTimePast(tx StoreTx, hash []byte) int64 {
+	var timestamps []int64
+	for len(timestamps) < medianTimeBlocks {
+		block := tx.Block(hash)
+		if block == nil {
+			break
+		}
+		timestamps = append(timestamps, block.TimeStamp)
+		hash = block.PrevHash
+	}
+	if len(timestamps) == 0 {
+		return 0
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// MedianTimePast 返回最新区块及其之前共 11 个区块时间戳的中位数, 下一个区块的时间戳必须大于该值
+func (bc *BlockChain) MedianTimePast() int64 {
+	var mtp int64
+	err := bc.store.View(func(tx StoreTx) error {
+		mtp = medianTimePast(tx, bc.Tip())
+		return nil
+	})
+	if err != nil {
+		return 0
+	}
+	return mtp
+}
+
+// 检查区块的时间戳大于父区块的过去中位时间, 且没有超前网络调整时间太多
+func (bc *BlockChain) checkTimestamp(tx StoreTx, block *Block) error {
+	if mtp := medianTimePast(tx, block.PrevHash); block.TimeStamp <= mtp {
+		return fmt.Errorf("%w: timestamp of block %x is not after the median time past %d", ErrInvalidBlock, block.Hash, mtp)
+	}
+	return bc.checkFutureTime(block.Hash, block.TimeStamp)
+}
+
+// 新区块的时间戳: 网络调整时间, 但至少比父区块的过去中位时间大 1 秒
+func (bc *BlockChain) nextTimestamp(tx StoreTx, prevHash []byte) int64 {
+	return max(bc.AdjustedTime().Unix(), medianTimePast(tx, prevHash)+1)
+}
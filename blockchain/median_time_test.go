@@ -0,0 +1,70 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestMedianTime
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMedianTimeSamples(t *testing.T) {
+	mt := newMedianTime()
+	now := time.Now()
+	mt.addSample("a", now.Add(10*time.Second))
+	mt.addSample("b", now.Add(20*time.Second))
+	mt.addSample("c", now.Add(-5*time.Second))
+	mt.addSample("a", now.Add(time.Hour))
+	assert.InDelta(t, now.Add(10*time.Second).Unix(), mt.now().Unix(), 2, "Median of the offsets, one sample per peer")
+
+	// 偏差过大时认为本地时钟可能有误, 不调整
+	mt = newMedianTime()
+	mt.addSample("a", now.Add(2*time.Hour))
+	assert.InDelta(t, now.Unix(), mt.now().Unix(), 2)
+}
+
+func TestMedianTimePast(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 13)
+
+	var timestamps []int64
+	for _, hash := range bc.GetBlockHashes()[:medianTimeBlocks] {
+		block, err := bc.GetBlock(hash)
+		assert.NoError(t, err)
+		timestamps = append(timestamps, block.TimeStamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	assert.Equal(t, timestamps[5], bc.MedianTimePast())
+
+	// 新挖出的区块总是满足时间戳规则
+	block := bc.MineBlock([]*Transaction{NewCoinbaseTX(string(wallet.GetAddress()), "")})
+	assert.Greater(t, block.TimeStamp, timestamps[5])
+}
+
+func TestBlockTimestampRules(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 3)
+	tip, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+	newBlock := func(timestamp int64) *Block {
+		block, err := sealBlock(context.Background(), bc.Engine(), []*Transaction{NewCoinbaseTX(string(wallet.GetAddress()), "")}, tip.Hash, tip.Height+1, timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return block
+	}
+
+	// 时间戳必须大于过去中位时间
+	assert.ErrorIs(t, bc.AddBlock(newBlock(bc.MedianTimePast())), ErrInvalidBlock)
+	assert.ErrorIs(t, bc.SubmitBlock(newBlock(bc.MedianTimePast())), ErrInvalidBlock)
+
+	// 时间戳不能超前网络调整时间太多
+	future := newBlock(time.Now().Add(DefaultMaxTimeDrift + time.Hour).Unix())
+	assert.ErrorIs(t, bc.AddBlock(future), ErrInvalidBlock)
+	assert.False(t, bc.HasBlock(future.Hash))
+	bc.SetMaxTimeDrift(DefaultMaxTimeDrift + 2*time.Hour)
+	assert.NoError(t, bc.AddBlock(future))
+	assert.Equal(t, future.Hash, bc.Tip())
+}
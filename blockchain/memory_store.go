@@ -0,0 +1,152 @@
+package blockchain
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errReadOnlyTx = errors.New("write in a read-only transaction")
+
+// MemoryStore 是保存在内存中的存储后端, 用于单元测试和模拟, 关闭后数据丢失
+// 读事务可以并发执行, 写事务独占存储, 写入先记录在事务中, 成功后一次性生效
+type MemoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+// NewMemoryStore 创建空的内存存储
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]map[string][]byte)}
+}
+
+func (s *MemoryStore) View(fn func(tx StoreTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return fn(storeTx{&memoryTx{store: s}})
+}
+
+func (s *MemoryStore) Update(fn func(tx StoreTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTx{
+		store:    s,
+		writable: true,
+		writes:   make(map[string]map[string][]byte),
+		dropped:  make(map[string]bool),
+	}
+	if err := fn(storeTx{tx}); err != nil {
+		return err
+	}
+	tx.commit()
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// 内存存储的事务
+// writes	事务中的写入(桶 -> 键 -> 值), 值为 nil 表示删除
+// dropped	事务中删除的桶, 删除之后的写入仍记录在 writes 中
+type memoryTx struct {
+	store    *MemoryStore
+	writable bool
+	writes   map[string]map[string][]byte
+	dropped  map[string]bool
+}
+
+func (t *memoryTx) get(bucket string, key []byte) []byte {
+	if value, ok := t.writes[bucket][string(key)]; ok {
+		return value
+	}
+	if t.dropped[bucket] {
+		return nil
+	}
+	return t.store.buckets[bucket][string(key)]
+}
+
+// 记录写入, value 为 nil 表示删除
+func (t *memoryTx) set(bucket string, key, value []byte) error {
+	if !t.writable {
+		return errReadOnlyTx
+	}
+	if t.writes[bucket] == nil {
+		t.writes[bucket] = make(map[string][]byte)
+	}
+	t.writes[bucket][string(key)] = value
+	return nil
+}
+
+func (t *memoryTx) put(bucket string, key, value []byte) error {
+	// 保存副本, 调用者之后修改 value 不影响存储; 空值也要与删除区分
+	return t.set(bucket, key, append([]byte{}, value...))
+}
+
+func (t *memoryTx) delete(bucket string, key []byte) error {
+	return t.set(bucket, key, nil)
+}
+
+func (t *memoryTx) forEach(bucket string, prefix []byte, fn func(key, value []byte) error) error {
+	keys := make(map[string]bool)
+	if !t.dropped[bucket] {
+		for key := range t.store.buckets[bucket] {
+			keys[key] = true
+		}
+	}
+	for key := range t.writes[bucket] {
+		keys[key] = true
+	}
+	for key := range keys {
+		if !strings.HasPrefix(key, string(prefix)) {
+			delete(keys, key)
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		value := t.get(bucket, []byte(key))
+		if value == nil {
+			continue
+		}
+		if err := fn([]byte(key), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *memoryTx) deleteBucket(bucket string) error {
+	if !t.writable {
+		return errReadOnlyTx
+	}
+	t.dropped[bucket] = true
+	delete(t.writes, bucket)
+	return nil
+}
+
+// 将事务中的写入应用到存储, 调用者需持有 store.mu 的写锁
+func (t *memoryTx) commit() {
+	for bucket := range t.dropped {
+		delete(t.store.buckets, bucket)
+	}
+	for bucket, writes := range t.writes {
+		if t.store.buckets[bucket] == nil {
+			t.store.buckets[bucket] = make(map[string][]byte)
+		}
+		for key, value := range writes {
+			if value == nil {
+				delete(t.store.buckets[bucket], key)
+			} else {
+				t.store.buckets[bucket][key] = value
+			}
+		}
+	}
+}
@@ -0,0 +1,744 @@
+package blockchain
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTxAlreadyKnown   = errors.New("transaction is already in the mempool")
+	ErrTxConflict       = errors.New("transaction spends an output already spent by the mempool")
+	ErrMissingInputs    = errors.New("transaction spends an unknown or spent output")
+	ErrOrphanTx         = errors.New("transaction spends an output of an unknown transaction")
+	ErrInvalidSignature = errors.New("transaction has an invalid signature")
+	ErrInvalidTx        = errors.New("transaction is malformed")
+	ErrInsufficientFee  = errors.New("transaction fee rate is below the minimum relay fee rate")
+	ErrMempoolFull      = errors.New("mempool is full")
+	ErrReplacementFee   = errors.New("replacement transaction does not pay more than the transactions it replaces")
+)
+
+const defaultMaxMempoolBytes = 32 * 1024 * 1024 // 内存池默认的最大字节数
+const defaultMaxMempoolCount = 50000            // 内存池默认的最大交易数
+const defaultMempoolExpiry = 72 * time.Hour     // 交易在内存池中默认的最长停留时间
+const incrementalRelayFee = 1                   // 驱逐交易后, 最低费率在被驱逐交易的费率上增加的值(每1000字节)
+const minFeeHalfLife = 10 * time.Minute         // 驱逐后提高的最低费率每经过该时间减半
+const maxReplacementEvictions = 100             // 一笔替换交易最多导致移除的交易数量
+
+// 费率: 每1000字节的手续费
+func feeRate(fee, size int) int {
+	if size == 0 {
+		return 0
+	}
+	return fee * 1000 / size
+}
+
+// 按交易包(交易及其所有子孙交易)费率从低到高排列的内存池条目, 费率相同时按交易ID排列
+type descendantScoreIndex []*mempoolEntry
+
+func (h descendantScoreIndex) Len() int { return len(h) }
+
+func (h descendantScoreIndex) Less(i, j int) bool {
+	ri, rj := feeRate(h[i].descendantFee, h[i].descendantSize), feeRate(h[j].descendantFee, h[j].descendantSize)
+	if ri != rj {
+		return ri < rj
+	}
+	return bytes.Compare(h[i].Tx.ID, h[j].Tx.ID) < 0
+}
+
+func (h descendantScoreIndex) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].scoreIndex, h[j].scoreIndex = i, j
+}
+
+func (h *descendantScoreIndex) Push(x interface{}) {
+	entry := x.(*mempoolEntry)
+	entry.scoreIndex = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *descendantScoreIndex) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// MempoolOption 用于在创建内存池时修改默认配置
+type MempoolOption func(*Mempool)
+
+// WithMaxMempoolBytes 设置内存池中交易的最大总字节数
+func WithMaxMempoolBytes(bytes int) MempoolOption {
+	return func(mp *Mempool) {
+		mp.maxBytes = bytes
+	}
+}
+
+// WithMaxMempoolCount 设置内存池中交易的最大数量
+func WithMaxMempoolCount(count int) MempoolOption {
+	return func(mp *Mempool) {
+		mp.maxCount = count
+	}
+}
+
+// WithMempoolExpiry 设置交易在内存池中的最长停留时间
+func WithMempoolExpiry(expiry time.Duration) MempoolOption {
+	return func(mp *Mempool) {
+		mp.expiry = expiry
+	}
+}
+
+// WithMinRelayFee 设置接受交易的最低费率(每1000字节的手续费)
+func WithMinRelayFee(rate int) MempoolOption {
+	return func(mp *Mempool) {
+		mp.minRelayFee = rate
+	}
+}
+
+// MempoolStats 内存池的统计信息
+// Count		交易数量
+// Bytes		交易的总字节数
+// MinFeeRate	当前接受交易的最低费率
+// Evicted		因内存池已满被驱逐的交易总数
+// Expired		因停留时间过长被移除的交易总数
+type MempoolStats struct {
+	Count      int
+	Bytes      int
+	MinFeeRate int
+	Evicted    int
+	Expired    int
+}
+
+// 内存池中的一笔交易
+// Tx			交易本身
+// Fee			手续费, 即输入总额减去输出总额
+// Size			序列化后的字节数
+// Time			进入内存池的时间
+// parents		该交易花费的、仍在内存池中的父交易ID
+// children		花费该交易输出的、仍在内存池中的子交易ID
+// descendantFee, descendantSize	交易包(交易及其所有子孙交易)的总手续费和总字节数
+// scoreIndex	条目在 byScore 中的位置
+type mempoolEntry struct {
+	Tx       Transaction
+	Fee      int
+	Size     int
+	Time     time.Time
+	parents  map[string]bool
+	children map[string]bool
+
+	descendantFee  int
+	descendantSize int
+	scoreIndex     int
+}
+
+// Mempool 保存尚未打包进块的交易
+// 交易进入内存池前会验证签名、检查输入是否存在于 UTXO 集(或内存池中的父交易)
+// 与内存池中已有交易花费同一输出的交易, 只有在已有交易允许替换(见 SignalsReplacement)
+// 且新交易的手续费和费率都更高时, 才会替换已有交易及其子孙交易, 否则被拒绝
+// 新交易随后因内存池已满被驱逐时, 被替换的交易重新加入内存池
+// 内存池超过字节数或交易数上限时, 驱逐费率最低的交易包(交易及其子孙交易),
+// 并将最低费率提高到被驱逐交易包的费率之上, 之后随时间逐渐回落
+// entries		交易ID -> 交易
+// spent		被内存池交易花费的输出("交易ID:输出索引") -> 花费它的交易ID
+// byScore		按交易包费率从低到高排列的条目, 驱逐时直接取出费率最低的交易包
+// bytes		所有交易的总字节数
+// rollingMinFee	驱逐后提高的最低费率, lastRollingUpdate 为其上次更新的时间
+type Mempool struct {
+	bc          *BlockChain
+	maxBytes    int
+	maxCount    int
+	expiry      time.Duration
+	minRelayFee int
+
+	mu                sync.RWMutex
+	entries           map[string]*mempoolEntry
+	spent             map[string]string
+	byScore           descendantScoreIndex
+	bytes             int
+	rollingMinFee     float64
+	lastRollingUpdate time.Time
+	evicted           int
+	expired           int
+}
+
+// NewMempool 创建基于区块链 bc 验证交易的内存池
+func NewMempool(bc *BlockChain, opts ...MempoolOption) *Mempool {
+	mp := &Mempool{
+		bc:       bc,
+		maxBytes: defaultMaxMempoolBytes,
+		maxCount: defaultMaxMempoolCount,
+		expiry:   defaultMempoolExpiry,
+		entries:  make(map[string]*mempoolEntry),
+		spent:    make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(mp)
+	}
+
+	return mp
+}
+
+// 输出的唯一标识: 交易ID + 输出索引
+func outpointKey(txid []byte, vout int) string {
+	return fmt.Sprintf("%x:%d", txid, vout)
+}
+
+// Add 验证交易并加入内存池
+func (mp *Mempool) Add(tx *Transaction) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.add(tx, time.Now())
+}
+
+// 验证交易并加入内存池, added 为交易进入内存池的时间
+// 调用者需持有 mp.mu
+func (mp *Mempool) add(tx *Transaction, added time.Time) error {
+	mp.expire(time.Now())
+	entry, conflicts, err := mp.validate(tx)
+	if err != nil {
+		return err
+	}
+	entry.Time = added
+	if minFee := mp.minFeeRate(time.Now()); feeRate(entry.Fee, entry.Size) < minFee {
+		return fmt.Errorf("%w: %d < %d", ErrInsufficientFee, feeRate(entry.Fee, entry.Size), minFee)
+	}
+	// 被替换的交易(冲突交易及其子孙交易), 新交易随后被驱逐时恢复
+	var replaced []*mempoolEntry
+	if len(conflicts) > 0 {
+		if err := mp.checkReplacement(entry, conflicts); err != nil {
+			return err
+		}
+		set := make(map[string]bool)
+		for txID := range conflicts {
+			mp.descendants(txID, set)
+		}
+		for txID := range set {
+			replaced = append(replaced, mp.entries[txID])
+		}
+		for txID := range conflicts {
+			mp.remove(txID, true)
+		}
+	}
+	mp.insert(entry)
+
+	// 超出上限时驱逐费率最低的交易包, 新交易本身被驱逐则拒绝
+	txID := hex.EncodeToString(tx.ID)
+	for _, evicted := range mp.trim() {
+		if evicted == txID {
+			mp.restore(replaced)
+			return ErrMempoolFull
+		}
+	}
+	for _, entry := range replaced {
+		fmt.Printf("Replaced transaction %x in the mempool\n", entry.Tx.ID)
+	}
+
+	return nil
+}
+
+// 将被替换的交易重新加入内存池, 父交易总是先于子交易加入
+// 父交易已被驱逐的交易不再恢复, 它们本会随父交易一起被驱逐
+// 调用者需持有 mp.mu
+func (mp *Mempool) restore(entries []*mempoolEntry) {
+	for len(entries) > 0 {
+		var pending []*mempoolEntry
+		for _, entry := range entries {
+			ready := true
+			for parentID := range entry.parents {
+				if mp.entries[parentID] == nil {
+					ready = false
+					break
+				}
+			}
+			if !ready {
+				pending = append(pending, entry)
+				continue
+			}
+			// 子交易加入时重新记录, 未恢复的子交易不会留在 children 中
+			entry.children = make(map[string]bool)
+			mp.insert(entry)
+		}
+		if len(pending) == len(entries) {
+			return
+		}
+		entries = pending
+	}
+}
+
+// 当前接受交易的最低费率, 取配置的最低费率与驱逐后提高的费率中的较大者
+// 调用者需持有 mp.mu
+func (mp *Mempool) minFeeRate(now time.Time) int {
+	if mp.rollingMinFee > 0 {
+		// 每经过 minFeeHalfLife, 提高的费率减半, 低于最小增量的一半时归零
+		halfLives := float64(now.Sub(mp.lastRollingUpdate)) / float64(minFeeHalfLife)
+		mp.rollingMinFee /= math.Pow(2, halfLives)
+		mp.lastRollingUpdate = now
+		if mp.rollingMinFee < incrementalRelayFee/2.0 {
+			mp.rollingMinFee = 0
+		}
+	}
+
+	if rolling := int(math.Ceil(mp.rollingMinFee)); rolling > mp.minRelayFee {
+		return rolling
+	}
+	return mp.minRelayFee
+}
+
+// 将交易及其所有子孙交易的ID加入 set
+// 调用者需持有 mp.mu
+func (mp *Mempool) descendants(txID string, set map[string]bool) {
+	if set[txID] {
+		return
+	}
+	set[txID] = true
+	for childID := range mp.entries[txID].children {
+		mp.descendants(childID, set)
+	}
+}
+
+// 检查新交易能否替换与其冲突的交易 conflicts:
+// 冲突交易都允许替换, 新交易的费率高于每一笔冲突交易,
+// 且手续费高于所有将被移除的交易(冲突交易及其子孙交易)的手续费之和
+// 调用者需持有 mp.mu
+func (mp *Mempool) checkReplacement(entry *mempoolEntry, conflicts map[string]bool) error {
+	rate := feeRate(entry.Fee, entry.Size)
+	replaced := make(map[string]bool)
+	for txID := range conflicts {
+		conflict := mp.entries[txID]
+		if !conflict.Tx.SignalsReplacement() {
+			return fmt.Errorf("%w: %s is not replaceable", ErrTxConflict, txID)
+		}
+		if conflictRate := feeRate(conflict.Fee, conflict.Size); rate <= conflictRate {
+			return fmt.Errorf("%w: fee rate %d <= %d of %s", ErrReplacementFee, rate, conflictRate, txID)
+		}
+		mp.descendants(txID, replaced)
+	}
+	if len(replaced) > maxReplacementEvictions {
+		return fmt.Errorf("%w: replacing %d transactions", ErrTxConflict, len(replaced))
+	}
+
+	replacedFee := 0
+	for txID := range replaced {
+		if entry.parents[txID] {
+			return fmt.Errorf("%w: spends an output of replaced transaction %s", ErrTxConflict, txID)
+		}
+		replacedFee += mp.entries[txID].Fee
+	}
+	if entry.Fee <= replacedFee {
+		return fmt.Errorf("%w: fee %d <= %d", ErrReplacementFee, entry.Fee, replacedFee)
+	}
+
+	return nil
+}
+
+// 内存池超出上限时, 不断驱逐费率最低的交易包, 返回被驱逐的交易ID
+// 调用者需持有 mp.mu
+func (mp *Mempool) trim() []string {
+	var evicted []string
+
+	for len(mp.entries) > mp.maxCount || mp.bytes > mp.maxBytes {
+		worst := mp.byScore[0]
+		worstRate := feeRate(worst.descendantFee, worst.descendantSize)
+
+		removed := mp.remove(hex.EncodeToString(worst.Tx.ID), true)
+		evicted = append(evicted, removed...)
+		mp.evicted += len(removed)
+		fmt.Printf("Mempool is full, evicted %d transactions with fee rate %d\n", len(removed), worstRate)
+
+		// 之后的交易需要支付比被驱逐交易更高的费率
+		if rate := float64(worstRate + incrementalRelayFee); rate > mp.rollingMinFee {
+			mp.rollingMinFee = rate
+			mp.lastRollingUpdate = time.Now()
+		}
+	}
+
+	return evicted
+}
+
+// 移除在内存池中停留超过 expiry 的交易及其子孙交易
+// 调用者需持有 mp.mu
+func (mp *Mempool) expire(now time.Time) {
+	for txID, entry := range mp.entries {
+		if mp.entries[txID] != nil && now.Sub(entry.Time) > mp.expiry {
+			removed := mp.remove(txID, true)
+			mp.expired += len(removed)
+			fmt.Printf("Expired %d transactions from the mempool\n", len(removed))
+		}
+	}
+}
+
+// Expire 移除停留时间过长的交易, 由节点定期调用
+func (mp *Mempool) Expire() {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.expire(time.Now())
+}
+
+// 保存到文件中的内存池交易
+// Tx		交易本身
+// Time		进入内存池的时间, 重新加载后继续计算过期时间
+type mempoolRecord struct {
+	Tx   Transaction
+	Time time.Time
+}
+
+// Save 将内存池中的交易写入文件, 父交易排在子交易之前
+func (mp *Mempool) Save(file string) error {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	var records []mempoolRecord
+	for _, tx := range mp.sortedTransactions() {
+		records = append(records, mempoolRecord{tx, mp.entries[hex.EncodeToString(tx.ID)].Time})
+	}
+
+	return writeGobFile(file, records)
+}
+
+// Load 读取 Save 写入的交易, 基于当前的 UTXO 集重新验证后加入内存池
+// 已被确认、与现有交易冲突或已过期的交易被丢弃, 返回加入的交易数量
+func (mp *Mempool) Load(file string) (int, error) {
+	var records []mempoolRecord
+	if err := readGobFile(file, &records); err != nil {
+		return 0, err
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	loaded := 0
+	now := time.Now()
+	for i := range records {
+		if now.Sub(records[i].Time) > mp.expiry {
+			continue
+		}
+		if err := mp.add(&records[i].Tx, records[i].Time); err == nil {
+			loaded++
+		}
+	}
+
+	return loaded, nil
+}
+
+// Stats 返回内存池的统计信息
+func (mp *Mempool) Stats() MempoolStats {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return MempoolStats{
+		Count:      len(mp.entries),
+		Bytes:      mp.bytes,
+		MinFeeRate: mp.minFeeRate(time.Now()),
+		Evicted:    mp.evicted,
+		Expired:    mp.expired,
+	}
+}
+
+// 验证交易能否进入内存池, 返回待加入的条目, 以及内存池中与其花费同一输出的交易ID
+// 调用者需持有 mp.mu
+func (mp *Mempool) validate(tx *Transaction) (*mempoolEntry, map[string]bool, error) {
+	txID := hex.EncodeToString(tx.ID)
+	if mp.entries[txID] != nil {
+		return nil, nil, ErrTxAlreadyKnown
+	}
+	if tx.IsCoinbase() || len(tx.Vin) == 0 || len(tx.Vout) == 0 {
+		return nil, nil, ErrInvalidTx
+	}
+	if !tx.validID() {
+		return nil, nil, fmt.Errorf("%w: id %s does not match the transaction data", ErrInvalidTx, txID)
+	}
+
+	outputValue := 0
+	for _, out := range tx.Vout {
+		if out.Value <= 0 {
+			return nil, nil, ErrInvalidTx
+		}
+		outputValue += out.Value
+	}
+
+	UTXOSet := UTXOSet{mp.bc}
+	prevTXs := make(map[string]Transaction)
+	parents := make(map[string]bool)
+	seen := make(map[string]bool)
+	conflicts := make(map[string]bool)
+	inputValue := 0
+
+	for _, vin := range tx.Vin {
+		key := outpointKey(vin.Txid, vin.Vout)
+		if seen[key] {
+			return nil, nil, ErrInvalidTx
+		}
+		seen[key] = true
+		if spender, ok := mp.spent[key]; ok {
+			conflicts[spender] = true
+		}
+
+		prevID := hex.EncodeToString(vin.Txid)
+		if parent := mp.entries[prevID]; parent != nil {
+			// 花费内存池中父交易的输出
+			if vin.Vout < 0 || vin.Vout >= len(parent.Tx.Vout) {
+				return nil, nil, fmt.Errorf("%w: output %s", ErrMissingInputs, key)
+			}
+			if parent.Tx.Vout[vin.Vout].Stake {
+				return nil, nil, fmt.Errorf("%w: output %s is staked", ErrInvalidTx, key)
+			}
+			inputValue += parent.Tx.Vout[vin.Vout].Value
+			prevTXs[prevID] = parent.Tx
+			parents[prevID] = true
+			continue
+		}
+
+		// 花费已确认的输出
+		out, ok := UTXOSet.FindOutput(vin.Txid, vin.Vout)
+		if !ok {
+			// 父交易既不在内存池也不在区块链中, 可能是父交易还没有到达
+			if _, err := mp.bc.FindTransaction(vin.Txid); err != nil {
+				return nil, nil, fmt.Errorf("%w: transaction %s", ErrOrphanTx, prevID)
+			}
+			return nil, nil, fmt.Errorf("%w: output %s", ErrMissingInputs, key)
+		}
+		if out.Stake {
+			return nil, nil, fmt.Errorf("%w: output %s is staked", ErrInvalidTx, key)
+		}
+		inputValue += out.Value
+		if _, ok := prevTXs[prevID]; !ok {
+			prevTx, err := mp.bc.FindTransaction(vin.Txid)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: transaction %s", ErrMissingInputs, prevID)
+			}
+			prevTXs[prevID] = prevTx
+		}
+	}
+
+	if !tx.Verify(prevTXs) {
+		return nil, nil, ErrInvalidSignature
+	}
+	if inputValue < outputValue {
+		return nil, nil, fmt.Errorf("%w: outputs %d exceed inputs %d", ErrInvalidTx, outputValue, inputValue)
+	}
+
+	return &mempoolEntry{
+		Tx:       *tx,
+		Fee:      inputValue - outputValue,
+		Size:     len(tx.Serialize()),
+		Time:     time.Now(),
+		parents:  parents,
+		children: make(map[string]bool),
+	}, conflicts, nil
+}
+
+// 加入条目并更新输出索引和依赖关系
+// 调用者需持有 mp.mu
+func (mp *Mempool) insert(entry *mempoolEntry) {
+	txID := hex.EncodeToString(entry.Tx.ID)
+	mp.entries[txID] = entry
+	mp.bytes += entry.Size
+	for _, vin := range entry.Tx.Vin {
+		mp.spent[outpointKey(vin.Txid, vin.Vout)] = txID
+	}
+	for parentID := range entry.parents {
+		mp.entries[parentID].children[txID] = true
+	}
+
+	// 新条目没有子交易, 交易包只有它自己
+	entry.descendantFee, entry.descendantSize = entry.Fee, entry.Size
+	heap.Push(&mp.byScore, entry)
+	mp.updateAncestors(txID, entry.Fee, entry.Size)
+}
+
+// 将 fee 和 size 累加到交易 txID 的所有祖先交易的交易包, 并更新它们在 byScore 中的位置
+// 调用者需持有 mp.mu
+func (mp *Mempool) updateAncestors(txID string, fee, size int) {
+	ancestors := make(map[string]bool)
+	collectAncestors(mp.entries, txID, ancestors)
+	for id := range ancestors {
+		ancestor := mp.entries[id]
+		ancestor.descendantFee += fee
+		ancestor.descendantSize += size
+		heap.Fix(&mp.byScore, ancestor.scoreIndex)
+	}
+}
+
+// 移除交易, withDescendants 为 true 时同时移除所有依赖它的子孙交易
+// 返回被移除的交易ID
+// 调用者需持有 mp.mu
+func (mp *Mempool) remove(txID string, withDescendants bool) []string {
+	entry := mp.entries[txID]
+	if entry == nil {
+		return nil
+	}
+
+	removed := []string{txID}
+	// 先移除子孙交易, 它们仍能通过该交易找到并更新所有祖先交易的交易包
+	if withDescendants {
+		for childID := range entry.children {
+			removed = append(removed, mp.remove(childID, true)...)
+		}
+	}
+	// 留在内存池中的子孙交易不再是祖先交易的子孙交易
+	mp.updateAncestors(txID, -entry.descendantFee, -entry.descendantSize)
+	heap.Remove(&mp.byScore, entry.scoreIndex)
+	delete(mp.entries, txID)
+	mp.bytes -= entry.Size
+	for _, vin := range entry.Tx.Vin {
+		delete(mp.spent, outpointKey(vin.Txid, vin.Vout))
+	}
+	for parentID := range entry.parents {
+		if parent := mp.entries[parentID]; parent != nil {
+			delete(parent.children, txID)
+		}
+	}
+	for childID := range entry.children {
+		// 父交易已确认, 子交易不再依赖内存池
+		if child := mp.entries[childID]; child != nil {
+			delete(child.parents, txID)
+		}
+	}
+
+	return removed
+}
+
+// Remove 移除交易及其所有子孙交易, 返回被移除的交易ID
+func (mp *Mempool) Remove(txid []byte) []string {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.remove(hex.EncodeToString(txid), true)
+}
+
+// RemoveForBlock 在区块被连接到主链后更新内存池:
+// 移除已被打包的交易, 以及与区块中交易花费同一输出的冲突交易(连同其子孙交易)
+func (mp *Mempool) RemoveForBlock(block *Block) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for _, tx := range block.Transactions {
+		mp.remove(hex.EncodeToString(tx.ID), false)
+	}
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			if spender, ok := mp.spent[outpointKey(vin.Txid, vin.Vout)]; ok {
+				for _, txID := range mp.remove(spender, true) {
+					fmt.Printf("Removed conflicting transaction %s from the mempool\n", txID)
+				}
+			}
+		}
+	}
+}
+
+// MissingParents 返回交易花费的、既不在内存池也不在区块链中的父交易ID
+func (mp *Mempool) MissingParents(tx *Transaction) [][]byte {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	var missing [][]byte
+	seen := make(map[string]bool)
+	UTXOSet := UTXOSet{mp.bc}
+	for _, vin := range tx.Vin {
+		prevID := hex.EncodeToString(vin.Txid)
+		if seen[prevID] || mp.entries[prevID] != nil {
+			continue
+		}
+		seen[prevID] = true
+		if _, ok := UTXOSet.FindOutput(vin.Txid, vin.Vout); ok {
+			continue
+		}
+		if _, err := mp.bc.FindTransaction(vin.Txid); err != nil {
+			missing = append(missing, vin.Txid)
+		}
+	}
+
+	return missing
+}
+
+// 返回所有条目的副本, 供构造区块模板时在不持有锁的情况下使用
+func (mp *Mempool) snapshot() map[string]*mempoolEntry {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	entries := make(map[string]*mempoolEntry, len(mp.entries))
+	for txID, entry := range mp.entries {
+		copied := *entry
+		copied.parents = make(map[string]bool, len(entry.parents))
+		for parentID := range entry.parents {
+			copied.parents[parentID] = true
+		}
+		copied.children = make(map[string]bool, len(entry.children))
+		for childID := range entry.children {
+			copied.children[childID] = true
+		}
+		entries[txID] = &copied
+	}
+
+	return entries
+}
+
+// Has 检查交易是否在内存池中
+func (mp *Mempool) Has(txid []byte) bool {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	return mp.entries[hex.EncodeToString(txid)] != nil
+}
+
+// Get 返回内存池中的交易
+func (mp *Mempool) Get(txid []byte) (Transaction, bool) {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	entry := mp.entries[hex.EncodeToString(txid)]
+	if entry == nil {
+		return Transaction{}, false
+	}
+
+	return entry.Tx, true
+}
+
+// Size 返回内存池中的交易数量
+func (mp *Mempool) Size() int {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	return len(mp.entries)
+}
+
+// Transactions 返回内存池中的所有交易, 父交易总是排在子交易之前
+func (mp *Mempool) Transactions() []Transaction {
+	mp.mu.RLock()
+	defer mp.mu.RUnlock()
+
+	return mp.sortedTransactions()
+}
+
+// 调用者需持有 mp.mu
+func (mp *Mempool) sortedTransactions() []Transaction {
+	var txs []Transaction
+	added := make(map[string]bool)
+	var visit func(txID string)
+	visit = func(txID string) {
+		if added[txID] {
+			return
+		}
+		added[txID] = true
+		entry := mp.entries[txID]
+		for parentID := range entry.parents {
+			visit(parentID)
+		}
+		txs = append(txs, entry.Tx)
+	}
+	for txID := range mp.entries {
+		visit(txID)
+	}
+
+	return txs
+}
@@ -0,0 +1,322 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestMempool
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 构造一笔花费 prev 第 vout 个输出的交易, 向 to 支付 amount, 扣除 fee 后的余额找零给 from
+func spendTx(from *Wallet, prev *Transaction, vout int, to string, amount, fee int) *Transaction {
+	return spendTxWithSequence(from, prev, vout, to, amount, fee, SequenceFinal)
+}
+
+// 同 spendTx, 输入使用指定的 Sequence
+func spendTxWithSequence(from *Wallet, prev *Transaction, vout int, to string, amount, fee int, sequence uint32) *Transaction {
+	inputs := []TXInput{{prev.ID, vout, nil, from.PublicKey, sequence}}
+	outputs := []TXOutput{*NewTXOutput(amount, to)}
+	if change := prev.Vout[vout].Value - amount - fee; change > 0 {
+		outputs = append(outputs, *NewTXOutput(change, string(from.GetAddress())))
+	}
+
+	tx := Transaction{nil, inputs, outputs}
+	tx.ID = tx.Hash()
+	tx.Sign(from.PrivateKey, map[string]Transaction{hex.EncodeToString(prev.ID): *prev})
+
+	return &tx
+}
+
+// 返回创世块中的 coinbase 交易
+func genesisCoinbase(bc *BlockChain) *Transaction {
+	hashes := bc.GetBlockHashes()
+	genesis, _ := bc.GetBlock(hashes[len(hashes)-1])
+
+	return genesis.Transactions[0]
+}
+
+func TestMempoolAdmission(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 0)
+	mp := NewMempool(bc)
+	coinbase := genesisCoinbase(bc)
+	other := NewWallet()
+
+	tx1 := spendTx(wallet, coinbase, 0, string(other.GetAddress()), 3, 1)
+	assert.NoError(t, mp.Add(tx1))
+	assert.ErrorIs(t, mp.Add(tx1), ErrTxAlreadyKnown)
+	assert.Equal(t, 1, mp.entries[hex.EncodeToString(tx1.ID)].Fee)
+
+	// 与 tx1 花费同一输出
+	tx2 := spendTx(wallet, coinbase, 0, string(other.GetAddress()), 4, 0)
+	assert.ErrorIs(t, mp.Add(tx2), ErrTxConflict)
+
+	// 交易被篡改, ID 与内容不符
+	tampered := spendTx(wallet, coinbase, 0, string(other.GetAddress()), 5, 0)
+	tampered.Vout[0].Value = 9
+	assert.ErrorIs(t, NewMempool(bc).Add(tampered), ErrInvalidTx)
+
+	// 用自己的私钥签名花费他人的输出
+	stolen := spendTx(other, coinbase, 0, string(other.GetAddress()), 5, 0)
+	assert.ErrorIs(t, NewMempool(bc).Add(stolen), ErrInvalidSignature)
+
+	// 父交易未知
+	orphan := spendTx(wallet, tx2, 0, string(other.GetAddress()), 1, 0)
+	assert.ErrorIs(t, mp.Add(orphan), ErrOrphanTx)
+
+	// 引用已确认交易中不存在的输出
+	missing := spendTx(wallet, coinbase, 0, string(other.GetAddress()), 2, 0)
+	missing.Vin[0].Vout = 1
+	missing.ID = missing.unsignedHash()
+	assert.ErrorIs(t, mp.Add(missing), ErrMissingInputs)
+
+	assert.Equal(t, 1, mp.Size())
+}
+
+func TestMempoolDependencies(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 0)
+	mp := NewMempool(bc)
+	other := NewWallet()
+
+	parent := spendTx(wallet, genesisCoinbase(bc), 0, string(other.GetAddress()), 6, 0)
+	child := spendTx(other, parent, 0, string(wallet.GetAddress()), 5, 1)
+	assert.NoError(t, mp.Add(parent))
+	assert.NoError(t, mp.Add(child), "Child may spend the output of an unconfirmed parent")
+
+	txs := mp.Transactions()
+	assert.Equal(t, 2, len(txs))
+	assert.Equal(t, parent.ID, txs[0].ID, "Parent is ordered before its child")
+
+	// 父交易的交易包包含子交易, 费率低于子交易单独的费率
+	parentEntry, childEntry := mp.entries[hex.EncodeToString(parent.ID)], mp.entries[hex.EncodeToString(child.ID)]
+	assert.Equal(t, 1, parentEntry.descendantFee)
+	assert.Equal(t, parentEntry.Size+childEntry.Size, parentEntry.descendantSize)
+	assert.Same(t, parentEntry, mp.byScore[0])
+
+	removed := mp.Remove(parent.ID)
+	assert.ElementsMatch(t, []string{hex.EncodeToString(parent.ID), hex.EncodeToString(child.ID)}, removed)
+	assert.Equal(t, 0, mp.Size())
+	assert.Empty(t, mp.spent)
+	assert.Empty(t, mp.byScore)
+}
+
+func TestMempoolRemoveForBlock(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 0)
+	mp := NewMempool(bc)
+	coinbase := genesisCoinbase(bc)
+	other := NewWallet()
+
+	parent := spendTx(wallet, coinbase, 0, string(other.GetAddress()), 6, 0)
+	child := spendTx(other, parent, 0, string(wallet.GetAddress()), 5, 1)
+	assert.NoError(t, mp.Add(parent))
+	assert.NoError(t, mp.Add(child))
+
+	// 区块确认了父交易, 子交易保留并不再依赖内存池
+	mp.RemoveForBlock(&Block{Transactions: []*Transaction{parent}})
+	assert.False(t, mp.Has(parent.ID))
+	assert.True(t, mp.Has(child.ID))
+	assert.Empty(t, mp.entries[hex.EncodeToString(child.ID)].parents)
+
+	// 区块中的交易与内存池中的交易冲突时, 冲突交易被移除
+	mp = NewMempool(bc)
+	assert.NoError(t, mp.Add(parent))
+	assert.NoError(t, mp.Add(child))
+	conflict := spendTx(wallet, coinbase, 0, string(wallet.GetAddress()), 10, 0)
+	mp.RemoveForBlock(&Block{Transactions: []*Transaction{conflict}})
+	assert.Equal(t, 0, mp.Size())
+}
+
+// 返回区块链中所有区块的 coinbase 交易, 按高度降序排列
+func blockCoinbases(bc *BlockChain) []*Transaction {
+	var coinbases []*Transaction
+	for _, hash := range bc.GetBlockHashes() {
+		block, _ := bc.GetBlock(hash)
+		coinbases = append(coinbases, block.Transactions[0])
+	}
+
+	return coinbases
+}
+
+func TestMempoolEviction(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 2)
+	mp := NewMempool(bc, WithMaxMempoolCount(2))
+	coinbases := blockCoinbases(bc)
+	to := string(NewWallet().GetAddress())
+
+	low := spendTx(wallet, coinbases[0], 0, to, 3, 1)
+	high := spendTx(wallet, coinbases[1], 0, to, 3, 3)
+	mid := spendTx(wallet, coinbases[2], 0, to, 3, 2)
+	assert.NoError(t, mp.Add(low))
+	assert.NoError(t, mp.Add(high))
+
+	// 超出数量上限, 费率最低的交易被驱逐
+	assert.NoError(t, mp.Add(mid))
+	assert.False(t, mp.Has(low.ID))
+	assert.Equal(t, 2, mp.Size())
+
+	stats := mp.Stats()
+	assert.Equal(t, 1, stats.Evicted)
+	lowEntry := mempoolEntry{Fee: 1, Size: len(low.Serialize())}
+	assert.Equal(t, feeRate(lowEntry.Fee, lowEntry.Size)+incrementalRelayFee, stats.MinFeeRate)
+
+	// 驱逐后最低费率提高, 不付手续费的交易被拒绝
+	free := spendTx(wallet, coinbases[0], 0, to, 3, 0)
+	assert.ErrorIs(t, mp.Add(free), ErrInsufficientFee)
+
+	// 提高的最低费率随时间回落
+	mp.lastRollingUpdate = time.Now().Add(-20 * minFeeHalfLife)
+	assert.Equal(t, 0, mp.Stats().MinFeeRate)
+	mp.Remove(high.ID)
+	assert.NoError(t, mp.Add(free))
+}
+
+func TestMempoolFull(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 1)
+	mp := NewMempool(bc, WithMaxMempoolCount(1))
+	coinbases := blockCoinbases(bc)
+	to := string(NewWallet().GetAddress())
+
+	assert.NoError(t, mp.Add(spendTx(wallet, coinbases[0], 0, to, 3, 2)))
+
+	// 新交易的费率最低, 加入后立即被驱逐
+	cheap := spendTx(wallet, coinbases[1], 0, to, 3, 1)
+	assert.ErrorIs(t, mp.Add(cheap), ErrMempoolFull)
+	assert.False(t, mp.Has(cheap.ID))
+	assert.Equal(t, 1, mp.Size())
+
+	// 字节数上限同样生效
+	mp = NewMempool(bc, WithMaxMempoolBytes(1))
+	assert.ErrorIs(t, mp.Add(cheap), ErrMempoolFull)
+	assert.Equal(t, 0, mp.Stats().Bytes)
+}
+
+func TestMempoolExpiry(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 0)
+	mp := NewMempool(bc, WithMempoolExpiry(time.Hour))
+	other := NewWallet()
+
+	parent := spendTx(wallet, genesisCoinbase(bc), 0, string(other.GetAddress()), 6, 0)
+	child := spendTx(other, parent, 0, string(wallet.GetAddress()), 5, 1)
+	assert.NoError(t, mp.Add(parent))
+	assert.NoError(t, mp.Add(child))
+
+	// 父交易过期时, 子交易一起被移除
+	mp.entries[hex.EncodeToString(parent.ID)].Time = time.Now().Add(-2 * time.Hour)
+	mp.Expire()
+	assert.Equal(t, 0, mp.Size())
+	assert.Equal(t, 2, mp.Stats().Expired)
+}
+
+func TestMempoolSaveLoad(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 0)
+	mp := NewMempool(bc)
+	other := NewWallet()
+
+	parent := spendTx(wallet, genesisCoinbase(bc), 0, string(other.GetAddress()), 6, 0)
+	child := spendTx(other, parent, 0, string(wallet.GetAddress()), 5, 1)
+	assert.NoError(t, mp.Add(parent))
+	assert.NoError(t, mp.Add(child))
+	added := mp.entries[hex.EncodeToString(child.ID)].Time
+	path := filepath.Join(t.TempDir(), "mempool.dat")
+	assert.NoError(t, mp.Save(path))
+
+	loaded, err := NewMempool(bc).Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, loaded)
+
+	// 父交易在保存后被确认, 重新加载时只保留子交易, 并保留其进入内存池的时间
+	block := bc.MineBlock([]*Transaction{NewCoinbaseTX(string(wallet.GetAddress()), ""), parent})
+	UTXOSet := UTXOSet{bc}
+	UTXOSet.Update(block)
+
+	mp = NewMempool(bc)
+	loaded, err = mp.Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, loaded)
+	assert.True(t, mp.Has(child.ID))
+	assert.True(t, added.Equal(mp.entries[hex.EncodeToString(child.ID)].Time))
+
+	// 已过期的交易不再加载
+	loaded, err = NewMempool(bc, WithMempoolExpiry(time.Nanosecond)).Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, loaded)
+}
+
+func TestMempoolReplaceByFee(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 0)
+	mp := NewMempool(bc)
+	coinbase := genesisCoinbase(bc)
+	other := NewWallet()
+
+	orig := spendTxWithSequence(wallet, coinbase, 0, string(other.GetAddress()), 3, 1, MaxRBFSequence)
+	child := spendTx(other, orig, 0, string(other.GetAddress()), 2, 1)
+	assert.True(t, orig.SignalsReplacement())
+	assert.False(t, child.SignalsReplacement())
+	assert.NoError(t, mp.Add(orig))
+	assert.NoError(t, mp.Add(child))
+
+	prevTXs := map[string]Transaction{hex.EncodeToString(coinbase.ID): *coinbase}
+
+	// 手续费没有超过被替换的交易及其子交易的手续费之和
+	bumped, err := BumpFee(wallet, orig, 2, prevTXs)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, mp.Add(bumped), ErrReplacementFee)
+
+	// 新的手续费必须高于原交易的手续费
+	_, err = BumpFee(wallet, orig, 1, prevTXs)
+	assert.Error(t, err)
+
+	// 替换成功后原交易及其子孙交易被移除
+	bumped, err = BumpFee(wallet, orig, 4, prevTXs)
+	assert.NoError(t, err)
+	assert.NoError(t, mp.Add(bumped))
+	assert.True(t, mp.Has(bumped.ID))
+	assert.False(t, mp.Has(orig.ID))
+	assert.False(t, mp.Has(child.ID))
+	assert.Equal(t, 4, mp.entries[hex.EncodeToString(bumped.ID)].Fee)
+
+	// 未声明可替换的交易不能被替换
+	final := spendTx(wallet, coinbase, 0, string(other.GetAddress()), 3, 1)
+	mp = NewMempool(bc)
+	assert.NoError(t, mp.Add(final))
+	assert.ErrorIs(t, mp.Add(bumped), ErrTxConflict)
+	_, err = BumpFee(wallet, final, 4, prevTXs)
+	assert.Error(t, err)
+}
+
+func TestMempoolReplacementEvicted(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 2)
+	coinbases := blockCoinbases(bc)
+	to := string(NewWallet().GetAddress())
+
+	orig := spendTxWithSequence(wallet, coinbases[0], 0, to, 3, 1, MaxRBFSequence)
+	high := spendTx(wallet, coinbases[1], 0, to, 3, 8)
+	mp := NewMempool(bc, WithMaxMempoolBytes(len(orig.Serialize())+len(high.Serialize())))
+	assert.NoError(t, mp.Add(orig))
+	assert.NoError(t, mp.Add(high))
+
+	// 替换交易多花费一个输入, 字节数超出上限, 且费率低于 high 而被驱逐
+	inputs := []TXInput{
+		{coinbases[0].ID, 0, nil, wallet.PublicKey, MaxRBFSequence},
+		{coinbases[2].ID, 0, nil, wallet.PublicKey, SequenceFinal},
+	}
+	replacement := Transaction{nil, inputs, []TXOutput{*NewTXOutput(2*subsidy-3, to)}}
+	replacement.ID = replacement.Hash()
+	replacement.Sign(wallet.PrivateKey, map[string]Transaction{
+		hex.EncodeToString(coinbases[0].ID): *coinbases[0],
+		hex.EncodeToString(coinbases[2].ID): *coinbases[2],
+	})
+	assert.ErrorIs(t, mp.Add(&replacement), ErrMempoolFull)
+
+	// 被替换的交易恢复到内存池中
+	assert.False(t, mp.Has(replacement.ID))
+	assert.True(t, mp.Has(orig.ID))
+	assert.True(t, mp.Has(high.ID))
+	assert.Equal(t, len(orig.Serialize())+len(high.Serialize()), mp.Stats().Bytes)
+	spent := mp.spent[outpointKey(coinbases[0].ID, 0)]
+	assert.Equal(t, hex.EncodeToString(orig.ID), spent)
+}
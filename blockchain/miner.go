@@ -0,0 +1,236 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// 挖矿失败(不包括被取消和最新区块变化)后重试前的等待时间, 连续失败时加倍直到上限
+const minMiningBackoff = time.Second
+const maxMiningBackoff = time.Minute
+
+// 后台挖矿
+// 不断根据内存池构造区块模板并挖矿, 最新区块或内存池变化时放弃当前区块, 用新的模板重新开始
+// address		挖矿奖励接收地址
+// interval		内存池为空时出块的间隔, 为 0 时只在内存池中有交易时挖矿
+// workers		并行搜索 nonce 的 goroutine 数量, 为 0 时使用 CPU 核数
+// wake		最新区块或内存池变化时收到通知
+// cancel		停止挖矿, done 在挖矿 goroutine 退出时关闭
+// hashes		开始挖矿后计算过的哈希次数, started 为开始挖矿的时间
+type miner struct {
+	node     *Node
+	address  string
+	interval time.Duration
+	workers  int
+	wake     chan struct{}
+	cancel   context.CancelFunc
+	done     chan struct{}
+	hashes   atomic.Uint64
+	started  time.Time
+}
+
+// 在后台开始挖矿, 直到 ctx 被取消或调用 stop
+func startMiner(ctx context.Context, node *Node, address string, interval time.Duration, workers int) *miner {
+	ctx, cancel := context.WithCancel(ctx)
+	m := &miner{
+		node:     node,
+		address:  address,
+		interval: interval,
+		workers:  workers,
+		wake:     make(chan struct{}, 1),
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		started:  time.Now(),
+	}
+	go m.run(ctx)
+
+	return m
+}
+
+// 停止挖矿并等待正在进行的挖矿结束
+func (m *miner) stop() {
+	m.cancel()
+	<-m.done
+}
+
+// 通知最新区块或内存池已变化, 不会阻塞
+func (m *miner) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// 开始挖矿以来每秒计算的平均哈希次数
+func (m *miner) hashRate() float64 {
+	elapsed := time.Since(m.started).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(m.hashes.Load()) / elapsed
+}
+
+// 等待通知、出块间隔到达或 ctx 被取消
+func (m *miner) wait(ctx context.Context, lastBlock time.Time) {
+	var timeout <-chan time.Time
+	if m.interval > 0 {
+		timer := time.NewTimer(m.interval - time.Since(lastBlock))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-m.wake:
+	case <-timeout:
+	}
+}
+
+// 等待 d、通知或 ctx 被取消
+func (m *miner) sleep(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-m.wake:
+	case <-timer.C:
+	}
+}
+
+func (m *miner) run(ctx context.Context) {
+	defer close(m.done)
+
+	n := m.node
+	lastBlock := time.Now()
+	backoff := minMiningBackoff
+	for ctx.Err() == nil {
+		tmpl := NewBlockTemplate(n.bc, n.mempool, m.address)
+
+		// 没有交易且未到出块间隔时, 等待通知或出块间隔到达后重新构造模板
+		if len(tmpl.Transactions) == 1 && (m.interval == 0 || time.Since(lastBlock) < m.interval) {
+			m.wait(ctx, lastBlock)
+			continue
+		}
+
+		// 挖矿期间收到通知时取消, 用新的模板重新开始
+		mineCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-m.wake:
+				cancel()
+			case <-mineCtx.Done():
+			}
+		}()
+		block, err := n.bc.MineBlockContext(mineCtx, tmpl.Transactions, WithWorkers(m.workers), WithHashCounter(&m.hashes))
+		cancel()
+		if errors.Is(err, ErrNotInTurn) {
+			// 权威证明中还没有轮到当前签名者, 等待下一个区块
+			m.wait(ctx, time.Now())
+			continue
+		}
+		if err != nil {
+			// 被取消或最新区块已变化时直接用新的模板重新开始
+			if !errors.Is(err, ErrStaleTip) && !errors.Is(err, context.Canceled) {
+				// 其他错误重试前等待, 连续失败时等待时间加倍, 收到通知时提前用新的模板重试
+				fmt.Printf("Mining failed: %v, retrying in %v\n", err, backoff)
+				m.sleep(ctx, backoff)
+				backoff = min(backoff*2, maxMiningBackoff)
+			}
+			continue
+		}
+		backoff = minMiningBackoff
+		lastBlock = time.Now()
+
+		// 更新UTXO集, 从内存池中移除已打包进块的交易
+		n.updateToTip()
+
+		fmt.Printf("New block %x is mined with %d transactions (%.0f hashes/s)\n", block.Hash, len(block.Transactions)-1, m.hashRate())
+
+		// 向其他节点广播新块
+		n.broadcastInv("block", [][]byte{block.Hash}, "")
+	}
+}
+
+// MineRemote 作为外部矿工运行, 直到 ctx 被取消, 只适用于工作量证明的区块链
+// 每隔 poll 从节点 node 获取区块模板, 模板变化(最新区块或交易变化)时放弃当前区块, 挖出的区块提交给节点
+// opts 可以设置并行挖矿的 goroutine 数量
+func MineRemote(ctx context.Context, node, address string, poll time.Duration, opts ...SealOption) {
+	var hashes atomic.Uint64
+	started := time.Now()
+	opts = append(opts, WithHashCounter(&hashes))
+
+	backoff := minMiningBackoff
+	for ctx.Err() == nil {
+		tmpl, err := GetBlockTemplate(node, address)
+		if err != nil {
+			fmt.Printf("Failed to get block template: %v\n", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(poll):
+			}
+			continue
+		}
+
+		// 定期重新获取模板, 模板变化时取消挖矿
+		mineCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			ticker := time.NewTicker(poll)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-mineCtx.Done():
+					return
+				case <-ticker.C:
+					latest, err := GetBlockTemplate(node, address)
+					if err == nil && !sameTemplate(tmpl, latest) {
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+		block, err := tmpl.Mine(mineCtx, opts...)
+		cancel()
+		if err != nil {
+			// 模板变化或被取消时直接用新的模板重新开始, 其他错误与后台挖矿相同, 重试前等待并在连续失败时加倍
+			if !errors.Is(err, context.Canceled) {
+				fmt.Printf("Mining failed: %v, retrying in %v\n", err, backoff)
+				select {
+				case <-ctx.Done():
+				case <-time.After(backoff):
+				}
+				backoff = min(backoff*2, maxMiningBackoff)
+			}
+			continue
+		}
+		backoff = minMiningBackoff
+
+		rate := float64(hashes.Load()) / time.Since(started).Seconds()
+		switch err := SubmitBlock(node, block); {
+		case err == nil:
+			fmt.Printf("New block %x at height %d is accepted with %d transactions (%.0f hashes/s)\n", block.Hash, block.Height, len(block.Transactions)-1, rate)
+		case errors.Is(err, ErrStaleTip):
+			fmt.Printf("Block %x is stale\n", block.Hash)
+		default:
+			fmt.Printf("Failed to submit block %x: %v\n", block.Hash, err)
+		}
+	}
+}
+
+// 两个模板的父区块和交易(coinbase 除外)相同时, 继续挖掘旧的模板
+func sameTemplate(a, b *BlockTemplate) bool {
+	if !bytes.Equal(a.PrevHash, b.PrevHash) || len(a.Transactions) != len(b.Transactions) {
+		return false
+	}
+	for i := 1; i < len(a.Transactions); i++ {
+		if !bytes.Equal(a.Transactions[i].ID, b.Transactions[i].ID) {
+			return false
+		}
+	}
+	return true
+}
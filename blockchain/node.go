@@ -0,0 +1,591 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const peersFile = "peers_%s.dat"               // 节点停止时保存已知节点的文件
+const mempoolFile = "mempool_%s.dat"           // 节点停止时保存内存池的文件, 启动时重新加载
+const mempoolMaintenanceInterval = time.Minute // 清理过期交易并输出内存池统计信息的间隔
+
+// 默认的种子节点, 未通过 WithPeers 指定对等节点时使用
+// 种子节点只用于发现网络, 与其他节点地位完全相同
+var DefaultSeedNodes = []string{"localhost:3000"}
+
+// Node 是网络中的一个节点, 持有该节点的全部状态
+// 同一进程中可以创建多个节点, 节点之间互不影响
+// nodeID			节点ID, 用于区分数据文件
+// address			当前节点的网络地址
+// miningAddress	启动时开始挖矿的奖励接收地址, 为空时不挖矿
+// blockInterval	内存池为空时的出块间隔, 为 0 时只打包交易
+// miningWorkers	并行挖矿的 goroutine 数量, 为 0 时使用 CPU 核数
+// checkpoints		除 DefaultCheckpoints 以外额外强制执行的检查点
+// maxReorgDepth	允许的最大重组深度, 为 0 时使用 DefaultMaxReorgDepth, 小于 0 时不限制
+// maxTimeDrift		区块时间戳允许超前于网络调整时间的最大值, 为 0 时使用 DefaultMaxTimeDrift
+// txIndex			启动时启用交易索引
+// addrIndex		启动时启用地址索引
+// utxoCacheSize	UTXO 缓存的内存上限(字节), 为 0 时使用 DefaultUTXOCacheSize
+// bc				节点的区块链
+// peersSet		对等节点由 WithPeers 指定, 不加入上次运行时保存的对等节点
+// knownNodes		当前节点已知的对等节点
+// blocksInTransit	按inv逐个下载中的区块哈希
+// moreBlocksFrom	上一条区块inv已满, 下载完成后需要继续请求的节点
+// mempool			尚未打包进块的交易
+// orphans			父交易尚未到达的交易
+// orphanBlocks		父区块尚未到达的区块
+// mu 保护 knownNodes、blocksInTransit、moreBlocksFrom 和 conns(正在处理的连接)
+// miner 为 nil 时不挖矿, minerMu 保证同一时间只有一个 goroutine 在启动或停止挖矿
+// ctx 在节点停止时取消, wg 跟踪节点的后台 goroutine, handlers 跟踪正在处理的请求
+type Node struct {
+	nodeID        string
+	address       string
+	miningAddress string
+	blockInterval time.Duration
+	miningWorkers int
+	checkpoints   map[int][]byte
+	maxReorgDepth int
+	maxTimeDrift  time.Duration
+	txIndex       bool
+	addrIndex     bool
+	utxoCacheSize int
+	bc            *BlockChain
+	syncer        *syncManager
+	mempool       *Mempool
+	mempoolMu     sync.Mutex
+	mempoolTip    []byte
+	mempoolOpts   []MempoolOption
+	orphans       *orphanPool
+	orphanBlocks  *orphanBlockPool
+	peersSet      bool
+
+	mu              sync.Mutex
+	knownNodes      []string
+	blocksInTransit [][]byte
+	moreBlocksFrom  string
+	conns           map[net.Conn]struct{}
+
+	minerMu sync.Mutex
+	miner   atomic.Pointer[miner]
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	listener net.Listener
+	wg       sync.WaitGroup
+	handlers sync.WaitGroup
+	stopOnce sync.Once
+	stopErr  error
+}
+
+// NodeOption 用于在创建节点时修改默认配置
+type NodeOption func(*Node)
+
+// WithAddress 设置节点监听的网络地址, 默认为 localhost:nodeID
+func WithAddress(address string) NodeOption {
+	return func(n *Node) {
+		n.address = address
+	}
+}
+
+// WithMiningAddress 开启挖矿, 奖励发送到 address
+func WithMiningAddress(address string) NodeOption {
+	return func(n *Node) {
+		n.miningAddress = address
+	}
+}
+
+// WithBlockInterval 设置内存池为空时挖出空块的间隔, 默认只在有交易时挖矿
+func WithBlockInterval(interval time.Duration) NodeOption {
+	return func(n *Node) {
+		n.blockInterval = interval
+	}
+}
+
+// WithMiningWorkers 设置并行挖矿的 goroutine 数量, 默认为 CPU 核数
+func WithMiningWorkers(workers int) NodeOption {
+	return func(n *Node) {
+		n.miningWorkers = workers
+	}
+}
+
+// WithCheckpoints 设置额外的检查点(高度 -> 区块哈希), 主链上这些高度的区块不会被替换
+func WithCheckpoints(checkpoints map[int][]byte) NodeOption {
+	return func(n *Node) {
+		n.checkpoints = checkpoints
+	}
+}
+
+// WithMaxReorgDepth 设置允许的最大重组深度, 默认为 DefaultMaxReorgDepth, 小于 0 时不限制
+// 需要回滚更多区块的分叉会被拒绝并输出警告
+func WithMaxReorgDepth(depth int) NodeOption {
+	return func(n *Node) {
+		n.maxReorgDepth = depth
+	}
+}
+
+// WithMaxTimeDrift 设置区块时间戳允许超前于网络调整时间的最大值, 默认为 DefaultMaxTimeDrift
+func WithMaxTimeDrift(drift time.Duration) NodeOption {
+	return func(n *Node) {
+		n.maxTimeDrift = drift
+	}
+}
+
+// WithTxIndex 启用交易索引, 第一次启用时根据主链建立索引
+func WithTxIndex() NodeOption {
+	return func(n *Node) {
+		n.txIndex = true
+	}
+}
+
+// WithAddrIndex 启用地址索引, 第一次启用时根据主链建立索引
+func WithAddrIndex() NodeOption {
+	return func(n *Node) {
+		n.addrIndex = true
+	}
+}
+
+// WithUTXOCacheSize 设置 UTXO 缓存的内存上限(字节), 默认为 DefaultUTXOCacheSize
+// 缓存越大, 写入存储的次数越少, 同步和连接区块越快
+func WithUTXOCacheSize(size int) NodeOption {
+	return func(n *Node) {
+		n.utxoCacheSize = size
+	}
+}
+
+// WithPeers 设置启动时连接的对等节点, 默认为 DefaultSeedNodes
+// 设置后不再加入上次运行时保存的对等节点
+func WithPeers(peers []string) NodeOption {
+	return func(n *Node) {
+		n.knownNodes = nil
+		n.addPeersLocked(peers)
+		n.peersSet = true
+	}
+}
+
+// WithMempoolOptions 设置内存池的配置(容量上限、过期时间、最低费率等)
+func WithMempoolOptions(opts ...MempoolOption) NodeOption {
+	return func(n *Node) {
+		n.mempoolOpts = append(n.mempoolOpts, opts...)
+	}
+}
+
+// WithBlockChain 使用已打开的区块链, 不再根据 nodeID 打开数据库
+func WithBlockChain(bc *BlockChain) NodeOption {
+	return func(n *Node) {
+		n.bc = bc
+	}
+}
+
+// NewNode 创建节点, 默认打开 nodeID 对应的区块链数据库
+func NewNode(nodeID string, opts ...NodeOption) (*Node, error) {
+	n := &Node{
+		nodeID:       nodeID,
+		address:      fmt.Sprintf("localhost:%s", nodeID),
+		orphans:      newOrphanPool(),
+		orphanBlocks: newOrphanBlockPool(),
+		conns:        make(map[net.Conn]struct{}),
+	}
+	n.syncer = newSyncManager(n)
+	n.addPeersLocked(DefaultSeedNodes)
+
+	for _, opt := range opts {
+		opt(n)
+	}
+	// 没有指定对等节点时, 加上次运行时保存的对等节点
+	if !n.peersSet {
+		peers, err := loadPeers(nodeID)
+		if err != nil {
+			return nil, err
+		}
+		n.addPeersLocked(peers)
+	}
+	// 地址可能被选项修改, 确保不把自己当作对等节点
+	n.removePeerLocked(n.address)
+
+	opened := false
+	if n.bc == nil {
+		bc, err := NewBlockChain(nodeID)
+		if err != nil {
+			return nil, err
+		}
+		n.bc = bc
+		opened = true
+	}
+	if err := n.setupChain(); err != nil {
+		// 关闭由节点打开的数据库, 通过 WithBlockChain 传入的区块链由调用者关闭
+		if opened {
+			n.bc.CloseDB()
+		}
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// 将选项应用到区块链, 启用索引并创建内存池
+func (n *Node) setupChain() error {
+	for height, hash := range n.checkpoints {
+		n.bc.AddCheckpoint(height, hash)
+	}
+	if n.maxReorgDepth != 0 {
+		n.bc.SetMaxReorgDepth(n.maxReorgDepth)
+	}
+	if n.maxTimeDrift != 0 {
+		n.bc.SetMaxTimeDrift(n.maxTimeDrift)
+	}
+	if n.utxoCacheSize != 0 {
+		n.bc.SetUTXOCacheSize(n.utxoCacheSize)
+	}
+	if n.txIndex {
+		if err := n.bc.EnableTxIndex(); err != nil {
+			return err
+		}
+	}
+	if n.addrIndex {
+		if err := n.bc.EnableAddrIndex(); err != nil {
+			return err
+		}
+	}
+	n.mempool = NewMempool(n.bc, n.mempoolOpts...)
+	n.mempoolTip = n.bc.Tip()
+	// 加载上次运行时保存的交易, 文件损坏时不影响节点启动
+	loaded, err := n.mempool.Load(MempoolFile(n.nodeID))
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Failed to load mempool: %v\n", err)
+	} else if loaded > 0 {
+		fmt.Printf("Loaded %d transactions into the mempool\n", loaded)
+	}
+
+	return nil
+}
+
+// Start 开始监听网络连接并在后台处理请求
+// ctx 被取消时节点停止接受新连接, 之后需调用 Stop 等待请求处理完毕并释放资源
+func (n *Node) Start(ctx context.Context) error {
+	ln, err := net.Listen(protocol, n.address)
+	if err != nil {
+		return err
+	}
+	n.listener = ln
+	// 监听随机端口(如 127.0.0.1:0)时使用实际的地址
+	n.address = ln.Addr().String()
+	n.ctx, n.cancel = context.WithCancel(ctx)
+
+	// 向所有已知节点发送版本信息
+	// 用于节点间同步区块链版本（如区块高度等），如果本地区块链落后，会触发区块同步
+	for _, node := range n.KnownNodes() {
+		n.SendVersion(node)
+	}
+
+	if n.miningAddress != "" {
+		if err := n.StartMining(n.miningAddress); err != nil {
+			n.cancel()
+			n.listener.Close()
+			return err
+		}
+	}
+
+	n.wg.Add(4)
+	go n.acceptLoop()
+	go n.maintainMempool()
+	// 检查区块下载超时
+	go func() {
+		defer n.wg.Done()
+		n.syncer.run(n.ctx.Done())
+	}()
+	// ctx 取消时关闭监听和正在处理的连接, 使 acceptLoop 和等待请求数据的处理退出
+	go func() {
+		defer n.wg.Done()
+		<-n.ctx.Done()
+		n.listener.Close()
+		n.closeConns()
+	}()
+
+	return nil
+}
+
+// Stop 停止节点: 不再接受新连接, 等待正在处理的请求和挖矿结束,
+// 将内存池和已知节点写入磁盘, 最后关闭区块链数据库
+// 可以多次调用, 只有第一次生效
+func (n *Node) Stop() error {
+	n.stopOnce.Do(func() {
+		if n.cancel != nil {
+			n.cancel()
+			n.wg.Wait()
+			n.handlers.Wait()
+		}
+		// 等待正在进行的挖矿结束
+		n.StopMining()
+
+		if err := n.savePeers(); err != nil {
+			n.stopErr = err
+		}
+		if err := n.saveMempool(); err != nil && n.stopErr == nil {
+			n.stopErr = err
+		}
+		n.bc.CloseDB()
+	})
+
+	return n.stopErr
+}
+
+// 定期移除内存池和孤儿池中过期的交易, 并在内存池非空时输出统计信息
+func (n *Node) maintainMempool() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(mempoolMaintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n.mempool.Expire()
+		n.orphans.expireAll()
+		n.orphanBlocks.expireAll()
+		if stats := n.mempool.Stats(); stats.Count > 0 || stats.Evicted > 0 || stats.Expired > 0 {
+			fmt.Printf("Mempool: %d transactions, %d bytes, min fee rate %d, evicted %d, expired %d\n",
+				stats.Count, stats.Bytes, stats.MinFeeRate, stats.Evicted, stats.Expired)
+		}
+	}
+}
+
+// StartMining 在后台开始挖矿, 奖励发送到 address, 已在挖矿时使用新的地址重新开始
+// 只能在 Start 之后调用
+func (n *Node) StartMining(address string) error {
+	if !ValidateAddress(address) {
+		return fmt.Errorf("mining address %s is not valid", address)
+	}
+	n.minerMu.Lock()
+	defer n.minerMu.Unlock()
+
+	if n.ctx == nil || n.ctx.Err() != nil {
+		return fmt.Errorf("node is not running")
+	}
+	// 需要签名区块的共识算法使用节点钱包中 address 对应的私钥
+	if authorizer, ok := n.bc.Engine().(Authorizer); ok {
+		wallets, err := NewWallets(n.nodeID)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		wallet, ok := wallets.Wallets[address]
+		if !ok {
+			return fmt.Errorf("wallet of mining address %s is not found", address)
+		}
+		authorizer.Authorize(wallet)
+	}
+	if m := n.miner.Load(); m != nil {
+		m.stop()
+	}
+	n.miner.Store(startMiner(n.ctx, n, address, n.blockInterval, n.miningWorkers))
+	fmt.Printf("Mining to %s\n", address)
+
+	return nil
+}
+
+// StopMining 停止挖矿并等待正在进行的挖矿结束
+func (n *Node) StopMining() {
+	n.minerMu.Lock()
+	defer n.minerMu.Unlock()
+
+	if m := n.miner.Swap(nil); m != nil {
+		m.stop()
+		fmt.Println("Mining stopped")
+	}
+}
+
+// HashRate 返回开始挖矿以来每秒计算的平均哈希次数, 未挖矿时返回 0
+func (n *Node) HashRate() float64 {
+	if m := n.miner.Load(); m != nil {
+		return m.hashRate()
+	}
+	return 0
+}
+
+// IsMining 返回节点是否正在挖矿
+func (n *Node) IsMining() bool {
+	return n.miner.Load() != nil
+}
+
+// 最新区块或内存池变化时通知矿工重新构造区块模板
+// 不获取 minerMu, 避免与正在等待挖矿结束的 StopMining 互相等待
+func (n *Node) notifyMiner() {
+	if m := n.miner.Load(); m != nil {
+		m.notify()
+	}
+}
+
+// 最新区块变化后将 UTXO 集和内存池更新到最新区块, 失败时下次更新时重试
+func (n *Node) updateToTip() {
+	if err := (UTXOSet{n.bc}).UpdateToTip(); err != nil {
+		fmt.Printf("Failed to update UTXO set: %v\n", err)
+	}
+	n.updateMempool()
+}
+
+// 按内存池对应的最新区块之后的主链变化更新内存池:
+// 重组时被移出主链的区块中的交易重新加入内存池(已被新的主链确认或与其冲突的交易无法通过验证),
+// 之后移除加入主链的区块中的交易及与其冲突的交易; 只保存而没有成为主链的区块不影响内存池
+func (n *Node) updateMempool() {
+	n.mempoolMu.Lock()
+	defer n.mempoolMu.Unlock()
+
+	detach, attach, tip, err := n.bc.tipChanges(n.mempoolTip)
+	if err != nil {
+		fmt.Printf("Failed to update mempool: %v\n", err)
+		return
+	}
+	// 父交易所在的区块高度较低, 先加入
+	for i := len(detach) - 1; i >= 0; i-- {
+		for _, tx := range detach[i].Transactions[1:] {
+			if err := n.mempool.Add(tx); err == nil {
+				fmt.Printf("Returned transaction %x from detached block %x to the mempool\n", tx.ID, detach[i].Hash)
+			}
+		}
+	}
+	for _, block := range attach {
+		n.mempool.RemoveForBlock(block)
+	}
+	n.mempoolTip = tip
+}
+
+// Done 返回在节点停止接受连接时关闭的通道, 调用 Start 之前返回 nil(永远不会关闭)
+func (n *Node) Done() <-chan struct{} {
+	if n.ctx == nil {
+		return nil
+	}
+	return n.ctx.Done()
+}
+
+// 将已知节点写入磁盘, 下次启动时自动连接
+func (n *Node) savePeers() error {
+	return writeGobFile(fmt.Sprintf(peersFile, n.nodeID), n.KnownNodes())
+}
+
+// 将内存池中的交易写入磁盘, 下次启动时重新加载
+func (n *Node) saveMempool() error {
+	return n.mempool.Save(MempoolFile(n.nodeID))
+}
+
+// MempoolFile 返回节点停止时保存内存池的文件
+func MempoolFile(nodeID string) string {
+	return fmt.Sprintf(mempoolFile, nodeID)
+}
+
+// 读取上次保存的已知节点, 文件不存在时返回空列表
+func loadPeers(nodeID string) ([]string, error) {
+	var peers []string
+
+	err := readGobFile(fmt.Sprintf(peersFile, nodeID), &peers)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return peers, err
+}
+
+// 将数据编码后写入文件, 先写临时文件再重命名, 避免中途退出时留下不完整的文件
+func writeGobFile(file string, data interface{}) error {
+	var content bytes.Buffer
+	if err := gob.NewEncoder(&content).Encode(data); err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, content.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// 读取文件并解码到 data 中
+func readGobFile(file string, data interface{}) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	return gob.NewDecoder(bytes.NewReader(content)).Decode(data)
+}
+
+// Address 返回节点的网络地址
+func (n *Node) Address() string {
+	return n.address
+}
+
+// BlockChain 返回节点的区块链
+func (n *Node) BlockChain() *BlockChain {
+	return n.bc
+}
+
+// KnownNodes 返回当前已知对等节点的副本
+func (n *Node) KnownNodes() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]string{}, n.knownNodes...)
+}
+
+// Mempool 返回节点的内存池
+func (n *Node) Mempool() *Mempool {
+	return n.mempool
+}
+
+// 添加对等节点, 忽略自己和已知节点
+func (n *Node) addPeers(peers []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.addPeersLocked(peers)
+}
+
+// 调用者需持有 n.mu
+func (n *Node) addPeersLocked(peers []string) {
+	for _, peer := range peers {
+		if peer != n.address && !n.nodeIsKnownLocked(peer) {
+			n.knownNodes = append(n.knownNodes, peer)
+		}
+	}
+}
+
+// 从已知节点列表中移除节点
+func (n *Node) removePeer(peer string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.removePeerLocked(peer)
+}
+
+// 调用者需持有 n.mu
+func (n *Node) removePeerLocked(peer string) {
+	var updatedNodes []string
+	for _, node := range n.knownNodes {
+		if node != peer {
+			updatedNodes = append(updatedNodes, node)
+		}
+	}
+	n.knownNodes = updatedNodes
+}
+
+// 检查节点地址是否在已知节点列表中
+// 调用者需持有 n.mu
+func (n *Node) nodeIsKnownLocked(addr string) bool {
+	for _, node := range n.knownNodes {
+		if node == addr {
+			return true
+		}
+	}
+
+	return false
+}
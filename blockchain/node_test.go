@@ -0,0 +1,418 @@
+package blockchain
+
+// 测试方法
+// go test -race -gcflags=all=-d=checkptr=0 -v ./blockchain -run TestNode
+// boltdb 在 -race 开启的 checkptr 检查下会报错, 因此需要关闭 checkptr
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 在随机端口上启动节点, 测试结束时停止
+func startTestNode(t *testing.T, nodeID string, opts ...NodeOption) *Node {
+	opts = append([]NodeOption{WithAddress("127.0.0.1:0"), WithPeers(nil)}, opts...)
+	node, err := NewNode(nodeID, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		node.Stop()
+	})
+
+	return node
+}
+
+// 复制区块链数据库, 模拟从创世块初始化新节点
+func copyDB(t *testing.T, from, to string) {
+	src, err := os.Open(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := os.Create(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 创建只有创世块的区块链, 并复制给 others 中的节点
+func createTestGenesis(t *testing.T, nodeID string, others ...string) *Wallet {
+	t.Chdir(t.TempDir())
+
+	wallet := NewWallet()
+	bc, err := CreateBlockChain(string(wallet.GetAddress()), nodeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UTXOSet{bc}.Reindex()
+	bc.CloseDB()
+	for _, other := range others {
+		copyDB(t, fmt.Sprintf(dbFile, nodeID), fmt.Sprintf(dbFile, other))
+	}
+
+	return wallet
+}
+
+func TestNodeSyncsFromPeer(t *testing.T) {
+	wallet := createTestGenesis(t, "a", "b")
+	address := string(wallet.GetAddress())
+
+	a := startTestNode(t, "a")
+	for i := 0; i < 3; i++ {
+		a.BlockChain().MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+	}
+
+	b := startTestNode(t, "b", WithPeers([]string{a.Address()}))
+
+	assert.Eventually(t, func() bool {
+		return b.BlockChain().GetBestHeight() == 3
+	}, 10*time.Second, 50*time.Millisecond, "Node b downloads the blocks of node a")
+	assert.Equal(t, a.BlockChain().Tip(), b.BlockChain().Tip())
+	assert.Equal(t, []string{b.Address()}, a.KnownNodes(), "Node a learns about node b from its version")
+}
+
+func TestNodeRelaysTransactions(t *testing.T) {
+	wallet := createTestGenesis(t, "a", "b", "c")
+
+	a := startTestNode(t, "a")
+	b := startTestNode(t, "b", WithPeers([]string{a.Address()}))
+	c := startTestNode(t, "c", WithPeers([]string{b.Address()}))
+	assert.Eventually(t, func() bool {
+		return len(b.KnownNodes()) == 2
+	}, 5*time.Second, 50*time.Millisecond)
+
+	UTXOSet := UTXOSet{c.BlockChain()}
+	tx, err := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 3, 0, false, &UTXOSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 交易提交给链末端的节点 c, 经 b 转发到 a
+	_, err = SubmitTx([]string{c.Address()}, tx)
+	assert.NoError(t, err)
+
+	for _, node := range []*Node{a, b, c} {
+		assert.Eventually(t, func() bool {
+			return node.Mempool().Size() == 1
+		}, 5*time.Second, 50*time.Millisecond, "Transaction reaches %s", node.Address())
+	}
+}
+
+func TestNodeRequestsMissingParents(t *testing.T) {
+	wallet := createTestGenesis(t, "a", "b")
+	a := startTestNode(t, "a")
+	b := startTestNode(t, "b", WithPeers([]string{a.Address()}))
+	assert.Eventually(t, func() bool {
+		return len(a.KnownNodes()) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	other := NewWallet()
+	parent := spendTx(wallet, genesisCoinbase(b.BlockChain()), 0, string(other.GetAddress()), 6, 0)
+	child := spendTx(other, parent, 0, string(wallet.GetAddress()), 5, 0)
+	assert.NoError(t, b.Mempool().Add(parent))
+
+	// a 先收到子交易, 向 b 请求父交易后两笔交易都进入内存池
+	b.SendTx(a.Address(), child)
+	assert.Eventually(t, func() bool {
+		return a.Mempool().Has(parent.ID) && a.Mempool().Has(child.ID)
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, 0, a.orphans.size())
+}
+
+func TestNodeConnectsOrphanBlocks(t *testing.T) {
+	wallet := createTestGenesis(t, "a", "b")
+	address := string(wallet.GetAddress())
+	a := startTestNode(t, "a")
+	b := startTestNode(t, "b", WithPeers([]string{a.Address()}))
+	assert.Eventually(t, func() bool {
+		return len(a.KnownNodes()) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	var last *Block
+	for i := 0; i < 3; i++ {
+		last = b.BlockChain().MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+	}
+
+	// a 先收到最新区块, 向 b 逐个请求缺失的祖先区块后全部连接
+	b.SendBlock(a.Address(), last)
+	assert.Eventually(t, func() bool {
+		return a.BlockChain().GetBestHeight() == 3
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, last.Hash, a.BlockChain().Tip())
+	assert.Equal(t, 0, a.orphanBlocks.size())
+}
+
+func TestNodeMinesTransactions(t *testing.T) {
+	wallet := createTestGenesis(t, "a")
+	miner := string(NewWallet().GetAddress())
+	a := startTestNode(t, "a", WithMiningAddress(miner))
+	assert.True(t, a.IsMining())
+
+	UTXOSet := UTXOSet{a.BlockChain()}
+	tx, err := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 3, 2, false, &UTXOSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SubmitTx([]string{a.Address()}, tx)
+	assert.NoError(t, err)
+
+	// 矿工打包交易, 奖励包含手续费
+	assert.Eventually(t, func() bool {
+		return a.BlockChain().GetBestHeight() == 1 && a.Mempool().Size() == 0
+	}, 10*time.Second, 50*time.Millisecond)
+	block, err := a.BlockChain().GetBlock(a.BlockChain().Tip())
+	assert.NoError(t, err)
+	assert.Equal(t, tx.ID, block.Transactions[1].ID)
+	assert.Equal(t, subsidy+2, block.Transactions[0].Vout[0].Value)
+}
+
+func TestNodeMiningInterval(t *testing.T) {
+	createTestGenesis(t, "a")
+	a := startTestNode(t, "a", WithBlockInterval(50*time.Millisecond))
+	assert.False(t, a.IsMining())
+	assert.Error(t, a.StartMining("invalid"))
+
+	// 运行时开始挖矿, 内存池为空时按间隔挖出空块
+	assert.NoError(t, a.StartMining(string(NewWallet().GetAddress())))
+	assert.Eventually(t, func() bool {
+		return a.BlockChain().GetBestHeight() >= 2
+	}, 10*time.Second, 50*time.Millisecond)
+
+	a.StopMining()
+	assert.False(t, a.IsMining())
+	height := a.BlockChain().GetBestHeight()
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, height, a.BlockChain().GetBestHeight(), "No blocks are mined after StopMining")
+}
+
+func TestNodeSubmitBlock(t *testing.T) {
+	wallet := createTestGenesis(t, "a")
+	miner := string(NewWallet().GetAddress())
+	a := startTestNode(t, "a")
+
+	UTXOSet := UTXOSet{a.BlockChain()}
+	tx, err := NewUTXOTransaction(wallet, string(NewWallet().GetAddress()), 3, 2, false, &UTXOSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, a.Mempool().Add(tx))
+
+	_, err = GetBlockTemplate(a.Address(), "invalid")
+	assert.Error(t, err)
+	tmpl, err := GetBlockTemplate(a.Address(), miner)
+	assert.NoError(t, err)
+	assert.Equal(t, a.BlockChain().Tip(), tmpl.PrevHash)
+	assert.Equal(t, 1, tmpl.Height)
+	assert.Equal(t, 2, tmpl.Fees)
+	assert.Len(t, tmpl.Transactions, 2)
+
+	// coinbase 多领取奖励的区块被拒绝
+	greedy := *tmpl.Transactions[0]
+	greedy.Vout = []TXOutput{{subsidy + 3, greedy.Vout[0].PubKeyHash, false}}
+	greedy.ID = greedy.Hash()
+	block, err := NewBlockContext(context.Background(), []*Transaction{&greedy, tx}, tmpl.PrevHash, tmpl.Height)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, SubmitBlock(a.Address(), block), ErrInvalidBlock)
+
+	block, err = tmpl.Mine(context.Background())
+	assert.NoError(t, err)
+	assert.NoError(t, SubmitBlock(a.Address(), block))
+	assert.Equal(t, 1, a.BlockChain().GetBestHeight())
+	assert.Equal(t, 0, a.Mempool().Size(), "Transactions in the submitted block leave the mempool")
+	assert.ErrorIs(t, SubmitBlock(a.Address(), block), ErrStaleTip, "Block no longer extends the tip")
+}
+
+func TestNodeDropsMalformedRequests(t *testing.T) {
+	createTestGenesis(t, "a")
+	a := startTestNode(t, "a")
+
+	// 无法解码的请求被丢弃, 节点继续处理其他请求
+	for _, command := range []string{"version", "addr", "block", "inv", "getdata", "tx"} {
+		conn, err := net.Dial(protocol, a.Address())
+		assert.NoError(t, err)
+		_, err = conn.Write(append(commandToBytes(command), "malformed"...))
+		assert.NoError(t, err)
+		assert.NoError(t, conn.Close())
+	}
+	var reply submitresult
+	assert.NoError(t, rpcCall(a.Address(), "submitblock", submitblock{[]byte("malformed")}, &reply))
+	assert.Contains(t, reply.Error, ErrInvalidBlock.Error())
+
+	_, err := GetBlockTemplate(a.Address(), string(NewWallet().GetAddress()))
+	assert.NoError(t, err)
+	select {
+	case <-a.Done():
+		t.Fatal("Node stopped")
+	default:
+	}
+
+	_, err = DeserializeBlock([]byte("malformed"))
+	assert.Error(t, err)
+	_, err = DeserializeTransaction([]byte("malformed"))
+	assert.Error(t, err)
+}
+
+func TestNodeMempoolFollowsMainChain(t *testing.T) {
+	wallet := createTestGenesis(t, "a")
+	a := startTestNode(t, "a")
+	bc := a.BlockChain()
+	address := string(wallet.GetAddress())
+	genesis := mainChainBlock(t, bc, 0)
+
+	spend := spendTx(wallet, genesisCoinbase(bc), 0, string(NewWallet().GetAddress()), 4, 1)
+	assert.NoError(t, a.Mempool().Add(spend))
+	main := bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+	a.updateToTip()
+
+	// 只保存在分叉上的区块不影响内存池
+	fork := newTestBlock(t, bc, genesis, address, spend)
+	assert.NoError(t, bc.AddBlock(fork))
+	a.updateToTip()
+	assert.Equal(t, main.Hash, bc.Tip())
+	assert.True(t, a.Mempool().Has(spend.ID))
+
+	// 分叉成为主链后交易已被确认
+	forkTip := newTestBlock(t, bc, fork, address)
+	assert.NoError(t, bc.AddBlock(forkTip))
+	a.updateToTip()
+	assert.Equal(t, forkTip.Hash, bc.Tip())
+	assert.False(t, a.Mempool().Has(spend.ID))
+
+	// 切换回原来的链, 被移出主链的区块中的交易回到内存池
+	for _, block := range newTestFork(t, bc, main, 2, address) {
+		assert.NoError(t, bc.AddBlock(block))
+	}
+	a.updateToTip()
+	assert.True(t, a.Mempool().Has(spend.ID))
+}
+
+func TestNodeMempoolSnapshot(t *testing.T) {
+	wallet := createTestGenesis(t, "a")
+	a := startTestNode(t, "a")
+	file := filepath.Join(t.TempDir(), "snapshot.data")
+
+	spend := spendTx(wallet, genesisCoinbase(a.BlockChain()), 0, string(NewWallet().GetAddress()), 4, 1)
+	assert.NoError(t, a.Mempool().Add(spend))
+
+	// 运行中的节点保存和加载快照
+	saved, err := SaveMempool(a.Address(), file)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, saved)
+	a.Mempool().Remove(spend.ID)
+	loaded, size, err := LoadMempool(a.Address(), file)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, loaded)
+	assert.Equal(t, 1, size)
+	assert.True(t, a.Mempool().Has(spend.ID))
+
+	_, _, err = LoadMempool(a.Address(), filepath.Join(t.TempDir(), "missing.data"))
+	assert.Error(t, err)
+}
+
+func TestNodeBumpFee(t *testing.T) {
+	wallet := createTestGenesis(t, "a")
+	a := startTestNode(t, "a")
+	coinbase := genesisCoinbase(a.BlockChain())
+
+	orig := spendTxWithSequence(wallet, coinbase, 0, string(NewWallet().GetAddress()), 4, 1, MaxRBFSequence)
+	assert.NoError(t, a.Mempool().Add(orig))
+
+	// 从运行中的节点获取原交易和前序交易, 替换交易提交给节点
+	tx, prevTXs, err := GetMempoolTx(a.Address(), orig.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, orig.ID, tx.ID)
+	assert.Equal(t, coinbase.ID, prevTXs[hex.EncodeToString(coinbase.ID)].ID)
+	replacement, err := BumpFee(wallet, tx, 3, prevTXs)
+	assert.NoError(t, err)
+	_, err = SubmitTx([]string{a.Address()}, replacement)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return a.Mempool().Has(replacement.ID) && !a.Mempool().Has(orig.ID)
+	}, 5*time.Second, 50*time.Millisecond)
+
+	_, _, err = GetMempoolTx(a.Address(), orig.ID)
+	assert.Error(t, err)
+}
+
+func TestMineRemote(t *testing.T) {
+	createTestGenesis(t, "a")
+	a := startTestNode(t, "a")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		MineRemote(ctx, a.Address(), string(NewWallet().GetAddress()), 50*time.Millisecond, WithWorkers(2))
+	}()
+	assert.Eventually(t, func() bool {
+		return a.BlockChain().GetBestHeight() >= 2
+	}, 10*time.Second, 50*time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestNodeStop(t *testing.T) {
+	createTestGenesis(t, "a", "b")
+	a := startTestNode(t, "a")
+	b := startTestNode(t, "b", WithPeers([]string{a.Address()}))
+	assert.Eventually(t, func() bool {
+		return len(a.KnownNodes()) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// 只打开连接而不发送请求的节点不会使停止一直等待
+	idle, err := net.Dial(protocol, a.Address())
+	assert.NoError(t, err)
+	defer idle.Close()
+	assert.Eventually(t, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return len(a.conns) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- a.Stop()
+	}()
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waits for an idle connection")
+	}
+	assert.NoError(t, a.Stop(), "Stop can be called more than once")
+	<-a.Done()
+	_, err = net.Dial(protocol, a.Address())
+	assert.Error(t, err, "Stopped node no longer accepts connections")
+
+	// 已知节点被保存, 数据库已关闭可以重新打开
+	peers, err := loadPeers("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{b.Address()}, peers)
+	assert.FileExists(t, fmt.Sprintf(mempoolFile, "a"))
+	bc, err := NewBlockChain("a")
+	assert.NoError(t, err)
+	bc.CloseDB()
+
+	// 指定对等节点时不加入保存的对等节点
+	n, err := NewNode("a", WithPeers([]string{"localhost:9"}))
+	assert.NoError(t, err)
+	assert.Nil(t, n.Done(), "Not started yet")
+	assert.Equal(t, []string{"localhost:9"}, n.KnownNodes())
+	n.BlockChain().CloseDB()
+}
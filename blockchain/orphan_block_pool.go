@@ -0,0 +1,179 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const maxOrphanBlocks = 100                // 孤儿区块池中最多保存的区块数量
+const orphanBlockExpiry = 20 * time.Minute // 孤儿区块在池中的最长停留时间
+
+// 孤儿区块池中的一个区块
+// Block		区块本身
+// From			发来该区块的节点, 向其请求缺失的祖先区块
+// Expires		过期时间
+type orphanBlock struct {
+	Block   *Block
+	From    string
+	Expires time.Time
+}
+
+// 保存父区块尚未到达的区块(孤儿区块)
+// 父区块加入区块链后, 依次连接以它为祖先的孤儿区块
+// orphans		区块哈希 -> 孤儿区块
+// byParent		父区块哈希 -> 以它为父区块的孤儿区块哈希
+type orphanBlockPool struct {
+	maxCount int
+	expiry   time.Duration
+
+	mu       sync.Mutex
+	orphans  map[string]*orphanBlock
+	byParent map[string]map[string]bool
+}
+
+func newOrphanBlockPool() *orphanBlockPool {
+	return &orphanBlockPool{
+		maxCount: maxOrphanBlocks,
+		expiry:   orphanBlockExpiry,
+		orphans:  make(map[string]*orphanBlock),
+		byParent: make(map[string]map[string]bool),
+	}
+}
+
+// 验证区块头后加入孤儿区块, 区块已在池中或区块头无效时返回 false
+// 权益证明的验证者取决于父区块, 父区块到达前只验证哈希和签名(VerifyHeader 返回 ErrOrphanBlock)
+// 池已满时随机驱逐一个区块
+func (op *orphanBlockPool) add(block *Block, from string, bc *BlockChain) bool {
+	if err := bc.verifyBlock(block); err != nil && !errors.Is(err, ErrOrphanBlock) {
+		fmt.Printf("Rejected orphan block %x: %v\n", block.Hash, err)
+		return false
+	}
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	hash := hex.EncodeToString(block.Hash)
+	if op.orphans[hash] != nil {
+		return false
+	}
+
+	op.expire(time.Now())
+	for len(op.orphans) >= op.maxCount {
+		// map 的遍历顺序是随机的, 取第一个即为随机驱逐
+		for evicted := range op.orphans {
+			op.remove(evicted)
+			break
+		}
+	}
+
+	op.orphans[hash] = &orphanBlock{block, from, time.Now().Add(op.expiry)}
+	parent := hex.EncodeToString(block.PrevHash)
+	if op.byParent[parent] == nil {
+		op.byParent[parent] = make(map[string]bool)
+	}
+	op.byParent[parent][hash] = true
+
+	return true
+}
+
+// 移除孤儿区块
+// 调用者需持有 op.mu
+func (op *orphanBlockPool) remove(hash string) {
+	orphan := op.orphans[hash]
+	if orphan == nil {
+		return
+	}
+
+	delete(op.orphans, hash)
+	parent := hex.EncodeToString(orphan.Block.PrevHash)
+	delete(op.byParent[parent], hash)
+	if len(op.byParent[parent]) == 0 {
+		delete(op.byParent, parent)
+	}
+}
+
+// 移除过期的孤儿区块
+// 调用者需持有 op.mu
+func (op *orphanBlockPool) expire(now time.Time) {
+	for hash, orphan := range op.orphans {
+		if now.After(orphan.Expires) {
+			op.remove(hash)
+		}
+	}
+}
+
+// 移除过期的孤儿区块, 由节点定期调用
+func (op *orphanBlockPool) expireAll() {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	op.expire(time.Now())
+}
+
+// 检查区块是否在孤儿区块池中
+func (op *orphanBlockPool) has(hash []byte) bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	return op.orphans[hex.EncodeToString(hash)] != nil
+}
+
+// 返回孤儿区块数量
+func (op *orphanBlockPool) size() int {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	return len(op.orphans)
+}
+
+// 沿池中的孤儿区块向前回溯, 返回孤儿区块 hash 最早的缺失祖先的哈希
+// 父区块哈希构成环时(伪造的区块)没有缺失的祖先, 返回 nil
+func (op *orphanBlockPool) missingAncestor(hash []byte) []byte {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	visited := make(map[string]bool)
+	for {
+		key := hex.EncodeToString(hash)
+		orphan := op.orphans[key]
+		if orphan == nil {
+			return hash
+		}
+		if visited[key] {
+			return nil
+		}
+		visited[key] = true
+		hash = orphan.Block.PrevHash
+	}
+}
+
+// 区块 parent 加入区块链后, 将以它为父区块的孤儿区块加入区块链
+// 被加入的孤儿区块又可能是其他孤儿区块的父区块, 依次处理, 返回所有加入区块链的孤儿区块
+// 被区块链拒绝的孤儿区块被丢弃, 它的后代留在池中直到过期
+func (op *orphanBlockPool) connect(parent *Block, bc *BlockChain) []*Block {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	var connected []*Block
+	queue := []*Block{parent}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+
+		for hash := range op.byParent[hex.EncodeToString(p.Hash)] {
+			block := op.orphans[hash].Block
+			op.remove(hash)
+			if err := bc.AddBlock(block); err != nil {
+				fmt.Printf("Rejected orphan block %s: %v\n", hash, err)
+				continue
+			}
+			connected = append(connected, block)
+			queue = append(queue, block)
+		}
+	}
+
+	return connected
+}
@@ -0,0 +1,76 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestOrphanBlock
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrphanBlockPoolConnect(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 1)
+	tip, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+	blocks := newTestFork(t, bc, &tip, 3, string(wallet.GetAddress()))
+	op := newOrphanBlockPool()
+
+	// 子孙区块先于父区块到达
+	for _, block := range []*Block{blocks[2], blocks[1]} {
+		assert.ErrorIs(t, bc.AddBlock(block), ErrOrphanBlock)
+		assert.False(t, bc.HasBlock(block.Hash), "Orphans are not stored in the chain")
+		assert.True(t, op.add(block, "peer", bc))
+	}
+	assert.False(t, op.add(blocks[1], "peer", bc), "Orphan is already known")
+	assert.Equal(t, blocks[0].Hash, op.missingAncestor(blocks[2].Hash))
+
+	// 区块头无效的区块不加入池中
+	tampered := *blocks[2]
+	tampered.TimeStamp++
+	assert.ErrorIs(t, bc.AddBlock(&tampered), ErrInvalidBlock)
+	assert.False(t, op.add(&tampered, "peer", bc))
+
+	// 父区块哈希构成环时回溯停止
+	cycle := op.orphans[hex.EncodeToString(blocks[1].Hash)].Block
+	cycle.PrevHash = blocks[2].Hash
+	assert.Nil(t, op.missingAncestor(blocks[2].Hash))
+	cycle.PrevHash = blocks[0].Hash
+
+	// 父区块加入区块链后, 孤儿区块依次连接
+	assert.NoError(t, bc.AddBlock(blocks[0]))
+	connected := op.connect(blocks[0], bc)
+	if assert.Len(t, connected, 2) {
+		assert.Equal(t, blocks[1].Hash, connected[0].Hash)
+		assert.Equal(t, blocks[2].Hash, connected[1].Hash)
+	}
+	assert.Equal(t, blocks[2].Hash, bc.Tip())
+	assert.Equal(t, 0, op.size())
+	assert.Empty(t, op.byParent)
+}
+
+func TestOrphanBlockPoolLimits(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 0)
+	tip, err := bc.GetBlock(bc.Tip())
+	assert.NoError(t, err)
+	blocks := newTestFork(t, bc, &tip, 4, string(wallet.GetAddress()))
+
+	// 池已满时驱逐其他区块
+	op := newOrphanBlockPool()
+	op.maxCount = 2
+	for _, block := range blocks[1:] {
+		assert.True(t, op.add(block, "peer", bc))
+	}
+	assert.Equal(t, 2, op.size())
+	assert.True(t, op.has(blocks[3].Hash))
+
+	// 过期的区块被移除
+	op = newOrphanBlockPool()
+	op.expiry = -time.Second
+	op.add(blocks[1], "peer", bc)
+	op.expireAll()
+	assert.Equal(t, 0, op.size())
+	assert.Empty(t, op.byParent)
+}
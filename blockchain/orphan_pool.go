@@ -0,0 +1,167 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const maxOrphanTxs = 100              // 孤儿池中最多保存的交易数量
+const maxOrphanTxSize = 100 * 1024    // 超过该字节数的孤儿交易直接丢弃
+const orphanExpiry = 20 * time.Minute // 孤儿交易在孤儿池中的最长停留时间
+
+// 孤儿池中的一笔交易
+// Tx			交易本身
+// From			发来该交易的节点, 向其请求缺失的父交易
+// Expires		过期时间
+type orphanTx struct {
+	Tx      Transaction
+	From    string
+	Expires time.Time
+}
+
+// 保存父交易尚未到达的交易(孤儿交易)
+// 父交易被内存池接受后, 重新尝试将花费其输出的孤儿交易加入内存池
+// orphans		交易ID -> 孤儿交易
+// byOutpoint	孤儿交易花费的输出("交易ID:输出索引") -> 花费它的孤儿交易ID
+type orphanPool struct {
+	maxCount int
+	expiry   time.Duration
+
+	mu         sync.Mutex
+	orphans    map[string]*orphanTx
+	byOutpoint map[string]map[string]bool
+}
+
+func newOrphanPool() *orphanPool {
+	return &orphanPool{
+		maxCount:   maxOrphanTxs,
+		expiry:     orphanExpiry,
+		orphans:    make(map[string]*orphanTx),
+		byOutpoint: make(map[string]map[string]bool),
+	}
+}
+
+// 加入孤儿交易, 交易过大或已在孤儿池中时返回 false
+// 孤儿池已满时随机驱逐一笔交易
+func (op *orphanPool) add(tx *Transaction, from string) bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	txID := hex.EncodeToString(tx.ID)
+	if op.orphans[txID] != nil || len(tx.Serialize()) > maxOrphanTxSize {
+		return false
+	}
+
+	op.expire(time.Now())
+	for len(op.orphans) >= op.maxCount {
+		// map 的遍历顺序是随机的, 取第一个即为随机驱逐
+		for evicted := range op.orphans {
+			op.remove(evicted)
+			break
+		}
+	}
+
+	op.orphans[txID] = &orphanTx{*tx, from, time.Now().Add(op.expiry)}
+	for _, vin := range tx.Vin {
+		key := outpointKey(vin.Txid, vin.Vout)
+		if op.byOutpoint[key] == nil {
+			op.byOutpoint[key] = make(map[string]bool)
+		}
+		op.byOutpoint[key][txID] = true
+	}
+
+	return true
+}
+
+// 移除孤儿交易
+// 调用者需持有 op.mu
+func (op *orphanPool) remove(txID string) {
+	orphan := op.orphans[txID]
+	if orphan == nil {
+		return
+	}
+
+	delete(op.orphans, txID)
+	for _, vin := range orphan.Tx.Vin {
+		key := outpointKey(vin.Txid, vin.Vout)
+		delete(op.byOutpoint[key], txID)
+		if len(op.byOutpoint[key]) == 0 {
+			delete(op.byOutpoint, key)
+		}
+	}
+}
+
+// 移除过期的孤儿交易
+// 调用者需持有 op.mu
+func (op *orphanPool) expire(now time.Time) {
+	for txID, orphan := range op.orphans {
+		if now.After(orphan.Expires) {
+			op.remove(txID)
+		}
+	}
+}
+
+// 移除过期的孤儿交易, 由节点定期调用
+func (op *orphanPool) expireAll() {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	op.expire(time.Now())
+}
+
+// 检查交易是否在孤儿池中
+func (op *orphanPool) has(txid []byte) bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	return op.orphans[hex.EncodeToString(txid)] != nil
+}
+
+// 返回孤儿交易数量
+func (op *orphanPool) size() int {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	return len(op.orphans)
+}
+
+// 父交易 parent 被内存池接受后, 将花费其输出的孤儿交易加入内存池
+// 被接受的孤儿交易又可能是其他孤儿交易的父交易, 依次处理, 返回所有被接受的孤儿交易
+// 仍缺少其他父交易的孤儿交易继续保留, 无效的孤儿交易被丢弃
+func (op *orphanPool) processParent(parent *Transaction, mp *Mempool) []*Transaction {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	var accepted []*Transaction
+	queue := []*Transaction{parent}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+
+		for vout := range p.Vout {
+			for txID := range op.byOutpoint[outpointKey(p.ID, vout)] {
+				orphan := op.orphans[txID]
+				if orphan == nil {
+					continue
+				}
+				tx := orphan.Tx
+				err := mp.Add(&tx)
+				if errors.Is(err, ErrOrphanTx) {
+					continue
+				}
+				op.remove(txID)
+				if err != nil {
+					fmt.Printf("Rejected orphan transaction %s: %v\n", txID, err)
+					continue
+				}
+				accepted = append(accepted, &tx)
+				queue = append(queue, &tx)
+			}
+		}
+	}
+
+	return accepted
+}
@@ -0,0 +1,84 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestOrphan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrphanPoolProcessParent(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 0)
+	mp := NewMempool(bc)
+	op := newOrphanPool()
+	other := NewWallet()
+
+	parent := spendTx(wallet, genesisCoinbase(bc), 0, string(other.GetAddress()), 6, 0)
+	child := spendTx(other, parent, 0, string(wallet.GetAddress()), 5, 0)
+	grandchild := spendTx(wallet, child, 0, string(other.GetAddress()), 4, 0)
+
+	// 子孙交易先于父交易到达
+	for _, tx := range []*Transaction{grandchild, child} {
+		assert.ErrorIs(t, mp.Add(tx), ErrOrphanTx)
+		assert.True(t, op.add(tx, "peer"))
+	}
+	assert.False(t, op.add(child, "peer"), "Orphan is already known")
+	assert.Equal(t, [][]byte{parent.ID}, mp.MissingParents(child))
+
+	// 父交易被接受后, 孤儿交易依次进入内存池
+	assert.NoError(t, mp.Add(parent))
+	accepted := op.processParent(parent, mp)
+	assert.Equal(t, 2, len(accepted))
+	assert.Equal(t, child.ID, accepted[0].ID)
+	assert.Equal(t, grandchild.ID, accepted[1].ID)
+	assert.Equal(t, 3, mp.Size())
+	assert.Equal(t, 0, op.size())
+	assert.Empty(t, op.byOutpoint)
+}
+
+func TestOrphanPoolInvalidOrphan(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 0)
+	mp := NewMempool(bc)
+	op := newOrphanPool()
+	other := NewWallet()
+
+	parent := spendTx(wallet, genesisCoinbase(bc), 0, string(other.GetAddress()), 6, 0)
+	child := spendTx(other, parent, 0, string(wallet.GetAddress()), 5, 0)
+	child.Vout[0].Value = 6
+	assert.True(t, op.add(child, "peer"))
+
+	// 签名无效的孤儿交易在父交易到达后被丢弃
+	assert.NoError(t, mp.Add(parent))
+	assert.Empty(t, op.processParent(parent, mp))
+	assert.Equal(t, 0, op.size())
+	assert.Equal(t, 1, mp.Size())
+}
+
+func TestOrphanPoolLimits(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 0)
+	op := newOrphanPool()
+	op.maxCount = 2
+	to := string(NewWallet().GetAddress())
+
+	var orphans []*Transaction
+	for i := 0; i < 3; i++ {
+		parent := spendTx(wallet, genesisCoinbase(bc), 0, to, i+1, 0)
+		orphan := spendTx(wallet, parent, 1, to, 1, 0)
+		orphans = append(orphans, orphan)
+		assert.True(t, op.add(orphan, "peer"))
+	}
+	assert.Equal(t, 2, op.size(), "Orphan pool evicts a transaction when full")
+	assert.True(t, op.has(orphans[2].ID))
+
+	// 过期的孤儿交易被移除
+	op = newOrphanPool()
+	op.expiry = time.Millisecond
+	assert.True(t, op.add(orphans[0], "peer"))
+	time.Sleep(5 * time.Millisecond)
+	op.expireAll()
+	assert.Equal(t, 0, op.size())
+	assert.Empty(t, op.byOutpoint)
+}
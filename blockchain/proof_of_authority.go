@@ -0,0 +1,91 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrUnauthorizedSigner = errors.New("no signer is authorized to seal blocks")
+	ErrNotInTurn          = errors.New("signer is not in turn to seal the block")
+)
+
+// PoAEngine 是权威证明共识引擎, 配置的签名者按高度轮流签名区块
+// 创世块不需要签名
+// signers		签名者的公钥哈希, 按轮换顺序排列
+// wallet		当前节点用于签名的钱包, 为 nil 时只能验证区块
+type PoAEngine struct {
+	signers [][]byte
+
+	mu     sync.RWMutex
+	wallet *Wallet
+}
+
+// NewPoAEngine 创建签名者为 signers(地址)的权威证明共识引擎
+func NewPoAEngine(signers []string) (*PoAEngine, error) {
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("proof of authority requires at least one signer")
+	}
+	hashes, err := addressesToPubKeyHashes(signers)
+	if err != nil {
+		return nil, err
+	}
+	return &PoAEngine{signers: hashes}, nil
+}
+
+// Authorize 设置签名区块使用的钱包
+func (e *PoAEngine) Authorize(wallet *Wallet) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.wallet = wallet
+}
+
+// 返回签名区块使用的钱包
+func (e *PoAEngine) signer() *Wallet {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.wallet
+}
+
+// 高度为 height 的区块的签名者的公钥哈希
+func (e *PoAEngine) inTurn(height int) []byte {
+	return e.signers[height%len(e.signers)]
+}
+
+// Prepare 检查当前节点的钱包是否轮到签名该区块, 并在区块中记录签名者的公钥
+func (e *PoAEngine) Prepare(block *Block) error {
+	block.Nonce = 0
+	if block.Height == 0 {
+		return nil
+	}
+	wallet := e.signer()
+	if wallet == nil {
+		return ErrUnauthorizedSigner
+	}
+	if !bytes.Equal(HashPubKey(wallet.PublicKey), e.inTurn(block.Height)) {
+		return fmt.Errorf("%w: height %d", ErrNotInTurn, block.Height)
+	}
+	block.Signer = wallet.PublicKey
+	return nil
+}
+
+// Seal 计算区块哈希并使用 Prepare 时的钱包签名
+func (e *PoAEngine) Seal(ctx context.Context, block *Block, opts ...SealOption) error {
+	return sealSigned(ctx, block, e.signer())
+}
+
+// VerifyHeader 验证区块头的哈希, 以及区块由轮到的签名者签名
+func (e *PoAEngine) VerifyHeader(header *BlockHeader) error {
+	if err := verifySigned(header); err != nil || header.Height == 0 {
+		return err
+	}
+	if !bytes.Equal(HashPubKey(header.Signer), e.inTurn(header.Height)) {
+		return fmt.Errorf("%w: block %x is not signed by the signer in turn", ErrInvalidBlock, header.Hash)
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+)
+
+const evidenceWindow = 100 // 只检测最近这么多个高度内的重复签名
+
+// 质押索引, 记录主链上每个验证者的质押总额和已打包的证据数量, 权益证明的区块链总是启用
+// 键为验证者的公钥哈希, 值为质押总额和证据数量, 各 8 字节大端序
+const stakeIndexBucket = "stakeindex"
+
+// SlashingEvidence 证明同一个验证者在同一高度签名了两个不同的区块
+type SlashingEvidence struct {
+	First  BlockHeader
+	Second BlockHeader
+}
+
+// Offender 返回重复签名的验证者的公钥哈希
+func (ev *SlashingEvidence) Offender() []byte {
+	return HashPubKey(ev.First.Signer)
+}
+
+// Verify 检查两个区块头的高度和签名者相同、哈希不同, 且签名都有效
+func (ev *SlashingEvidence) Verify() error {
+	if ev.First.Height != ev.Second.Height || ev.First.Height == 0 {
+		return fmt.Errorf("%w: evidence headers have different heights", ErrInvalidBlock)
+	}
+	if !bytes.Equal(ev.First.Signer, ev.Second.Signer) {
+		return fmt.Errorf("%w: evidence headers have different signers", ErrInvalidBlock)
+	}
+	if bytes.Equal(ev.First.Hash, ev.Second.Hash) {
+		return fmt.Errorf("%w: evidence headers are the same block", ErrInvalidBlock)
+	}
+	if err := verifySigned(&ev.First); err != nil {
+		return err
+	}
+	return verifySigned(&ev.Second)
+}
+
+// PoSEngine 是权益证明共识引擎
+// 每个高度的验证者从父区块对应的质押分布中按质押数量加权确定性地选出, 随机数由父区块哈希和高度决定
+// 没有任何质押时由初始验证者轮流签名; 被重复签名证据证明作恶的验证者失去质押权重
+// 质押是永久的: 质押输出不能被花费, 也没有解除质押的交易, 因此任意区块对应的质押分布只由之前的区块创建的质押输出决定
+// validators	初始验证者的公钥哈希
+// chain		读取质押分布和已上链证据的区块链
+// wallet		当前节点用于签名的钱包, 为 nil 时只能验证区块
+// seen			最近验证过的区块头(签名者与高度 -> 区块头), 用于检测重复签名
+// pending		检测到但还没有打包进区块的证据
+type PoSEngine struct {
+	validators [][]byte
+	chain      *BlockChain
+
+	mu      sync.Mutex
+	wallet  *Wallet
+	seen    map[string]BlockHeader
+	pending []SlashingEvidence
+}
+
+// NewPoSEngine 创建初始验证者为 validators(地址)的权益证明共识引擎
+func NewPoSEngine(validators []string, chain *BlockChain) (*PoSEngine, error) {
+	if len(validators) == 0 {
+		return nil, fmt.Errorf("proof of stake requires at least one initial validator")
+	}
+	hashes, err := addressesToPubKeyHashes(validators)
+	if err != nil {
+		return nil, err
+	}
+	return &PoSEngine{validators: hashes, chain: chain, seen: make(map[string]BlockHeader)}, nil
+}
+
+// Authorize 设置签名区块使用的钱包
+func (e *PoSEngine) Authorize(wallet *Wallet) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.wallet = wallet
+}
+
+// 返回签名区块使用的钱包
+func (e *PoSEngine) signer() *Wallet {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.wallet
+}
+
+// Stakes 返回当前的有效质押分布(公钥哈希的十六进制 -> 质押总额), 不包含被惩罚的验证者
+func (e *PoSEngine) Stakes() map[string]int {
+	stakes, _, err := e.stateAt(e.chain.Tip())
+	if err != nil {
+		fmt.Printf("Failed to read stake distribution: %v\n", err)
+	}
+	return stakes
+}
+
+// 返回区块 hash 之后的有效质押分布和已被惩罚的验证者(公钥哈希的十六进制), hash 可以在分叉上
+// 从质押索引记录的主链状态出发, 撤销或应用 hash 所在分叉上的区块创建的质押输出和打包的证据
+// hash 不在区块链中时返回 ErrOrphanBlock
+func (e *PoSEngine) stateAt(hash []byte) (map[string]int, map[string]bool, error) {
+	states := make(map[string]stakeState)
+	err := e.chain.store.View(func(tx StoreTx) error {
+		target := tx.Block(hash)
+		if target == nil {
+			return fmt.Errorf("%w: block %x", ErrOrphanBlock, hash)
+		}
+		if err := tx.IndexForEach(stakeIndexBucket, func(key, value []byte) error {
+			states[hex.EncodeToString(key)] = decodeStakeState(value)
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		detach, attach, err := reorgBranches(tx, tx.Block(tx.Tip()), target)
+		if err != nil {
+			return err
+		}
+		for _, block := range detach {
+			addStakeStates(states, block, -1)
+		}
+		for _, block := range attach {
+			addStakeStates(states, block, 1)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stakes := make(map[string]int)
+	slashed := make(map[string]bool)
+	for validator, state := range states {
+		if state.evidence > 0 {
+			slashed[validator] = true
+		} else if state.stake > 0 {
+			stakes[validator] = state.stake
+		}
+	}
+	return stakes, slashed, nil
+}
+
+// 验证者的质押状态
+// stake		质押总额
+// evidence		已打包的重复签名证据数量, 大于 0 时验证者被惩罚
+type stakeState struct {
+	stake    int
+	evidence int
+}
+
+// 将区块创建的质押输出和打包的证据乘以 sign 累加到 states
+func addStakeStates(states map[string]stakeState, block *Block, sign int) {
+	for _, tx := range block.Transactions {
+		for _, out := range tx.Vout {
+			if out.Stake {
+				validator := hex.EncodeToString(out.PubKeyHash)
+				state := states[validator]
+				state.stake += sign * out.Value
+				states[validator] = state
+			}
+		}
+	}
+	for i := range block.Evidence {
+		offender := hex.EncodeToString(block.Evidence[i].Offender())
+		state := states[offender]
+		state.evidence += sign
+		states[offender] = state
+	}
+}
+
+func encodeStakeState(state stakeState) []byte {
+	value := make([]byte, 16)
+	binary.BigEndian.PutUint64(value, uint64(state.stake))
+	binary.BigEndian.PutUint64(value[8:], uint64(state.evidence))
+	return value
+}
+
+func decodeStakeState(value []byte) stakeState {
+	if len(value) != 16 {
+		return stakeState{}
+	}
+	return stakeState{int(binary.BigEndian.Uint64(value)), int(binary.BigEndian.Uint64(value[8:]))}
+}
+
+// Leader 返回父区块为 prevHash、高度为 height 的区块的验证者的公钥哈希, 父区块不在区块链中时返回 nil
+func (e *PoSEngine) Leader(prevHash []byte, height int) []byte {
+	leader, err := e.leader(prevHash, height)
+	if err != nil {
+		return nil
+	}
+	return leader
+}
+
+// 根据父区块 prevHash 对应的质押分布选出高度为 height 的验证者
+func (e *PoSEngine) leader(prevHash []byte, height int) ([]byte, error) {
+	stakes, _, err := e.stateAt(prevHash)
+	if err != nil {
+		return nil, err
+	}
+	total := 0
+	validators := make([]string, 0, len(stakes))
+	for validator, stake := range stakes {
+		total += stake
+		validators = append(validators, validator)
+	}
+	if total == 0 {
+		return e.validators[height%len(e.validators)], nil
+	}
+	sort.Strings(validators)
+
+	seed := sha256.Sum256(bytes.Join([][]byte{prevHash, IntToHex(int64(height))}, []byte{}))
+	r := new(big.Int).Mod(new(big.Int).SetBytes(seed[:]), big.NewInt(int64(total))).Int64()
+	for _, validator := range validators {
+		if r < int64(stakes[validator]) {
+			leader, _ := hex.DecodeString(validator)
+			return leader, nil
+		}
+		r -= int64(stakes[validator])
+	}
+	return nil, nil
+}
+
+// Prepare 检查当前节点的钱包是否是该区块的验证者, 记录签名者的公钥并打包待处理的证据
+func (e *PoSEngine) Prepare(block *Block) error {
+	block.Nonce = 0
+	if block.Height == 0 {
+		return nil
+	}
+	wallet := e.signer()
+	if wallet == nil {
+		return ErrUnauthorizedSigner
+	}
+	leader, err := e.leader(block.PrevHash, block.Height)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(HashPubKey(wallet.PublicKey), leader) {
+		return fmt.Errorf("%w: height %d", ErrNotInTurn, block.Height)
+	}
+	block.Signer = wallet.PublicKey
+	block.Evidence = e.pendingEvidence(block.PrevHash)
+	return nil
+}
+
+// Seal 计算区块哈希并使用 Prepare 时的钱包签名
+func (e *PoSEngine) Seal(ctx context.Context, block *Block, opts ...SealOption) error {
+	return sealSigned(ctx, block, e.signer())
+}
+
+// VerifyHeader 验证区块头的哈希和签名, 并根据父区块对应的质押分布验证签名者是选出的验证者
+// 父区块不在区块链中时无法确定验证者, 只验证哈希和签名后返回 ErrOrphanBlock
+// 同一验证者在同一高度签名了两个不同区块时记录重复签名证据, 由之后的区块打包
+func (e *PoSEngine) VerifyHeader(header *BlockHeader) error {
+	if err := verifySigned(header); err != nil || header.Height == 0 {
+		return err
+	}
+	leader, err := e.leader(header.PrevHash, header.Height)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(HashPubKey(header.Signer), leader) {
+		return fmt.Errorf("%w: block %x is not signed by the selected validator", ErrInvalidBlock, header.Hash)
+	}
+	e.observe(header)
+	return nil
+}
+
+// 记录签名有效的区块头, 检测重复签名
+func (e *PoSEngine) observe(header *BlockHeader) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := fmt.Sprintf("%x:%d", HashPubKey(header.Signer), header.Height)
+	if prev, ok := e.seen[key]; ok {
+		if !bytes.Equal(prev.Hash, header.Hash) {
+			fmt.Printf("Validator %x signed two blocks at height %d\n", HashPubKey(header.Signer), header.Height)
+			e.pending = append(e.pending, SlashingEvidence{prev, *header})
+		}
+		return
+	}
+	e.seen[key] = *header
+	for k, h := range e.seen {
+		if h.Height < header.Height-evidenceWindow {
+			delete(e.seen, k)
+		}
+	}
+}
+
+// 返回作恶者在父区块 prevHash 所在的链上尚未被惩罚的待处理证据, 已上链的证据不再保留
+func (e *PoSEngine) pendingEvidence(prevHash []byte) []SlashingEvidence {
+	_, slashed, err := e.stateAt(prevHash)
+	if err != nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var evidence []SlashingEvidence
+	included := make(map[string]bool)
+	for _, ev := range e.pending {
+		offender := hex.EncodeToString(ev.Offender())
+		if !slashed[offender] && !included[offender] {
+			included[offender] = true
+			evidence = append(evidence, ev)
+		}
+	}
+	e.pending = evidence
+	return evidence
+}
+
+// 质押索引, 随主链变化记录每个验证者的质押总额和已打包的证据, 选出验证者时不需要遍历 UTXO 集和区块链
+type stakeIndex struct{}
+
+func newStakeIndex() chainIndex {
+	return stakeIndex{}
+}
+
+func (stakeIndex) name() string {
+	return stakeIndexBucket
+}
+
+func (stakeIndex) connectBlock(tx StoreTx, block *Block) error {
+	return updateStakeIndex(tx, block, 1)
+}
+
+func (stakeIndex) disconnectBlock(tx StoreTx, block *Block) error {
+	return updateStakeIndex(tx, block, -1)
+}
+
+// 将区块创建的质押输出和打包的证据乘以 sign 累加到质押索引, 质押和证据都为 0 的验证者从索引中删除
+func updateStakeIndex(tx StoreTx, block *Block, sign int) error {
+	changes := make(map[string]stakeState)
+	addStakeStates(changes, block, sign)
+	for validator, change := range changes {
+		key, err := hex.DecodeString(validator)
+		if err != nil {
+			return err
+		}
+		state := decodeStakeState(tx.IndexGet(stakeIndexBucket, key))
+		state.stake += change.stake
+		state.evidence += change.evidence
+		if state == (stakeState{}) {
+			err = tx.IndexDelete(stakeIndexBucket, key)
+		} else {
+			err = tx.IndexPut(stakeIndexBucket, key, encodeStakeState(state))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
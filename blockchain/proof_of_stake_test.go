@@ -0,0 +1,153 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestPoS
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 由 wallets 中被选中的验证者挖出包含 txs 的区块并更新 UTXO 集
+func mineStakeBlock(t *testing.T, bc *BlockChain, wallets []*Wallet, txs ...*Transaction) *Block {
+	engine := bc.Engine().(*PoSEngine)
+	height := bc.GetBestHeight() + 1
+	leader := engine.Leader(bc.Tip(), height)
+	for _, wallet := range wallets {
+		if hex.EncodeToString(HashPubKey(wallet.PublicKey)) == hex.EncodeToString(leader) {
+			engine.Authorize(wallet)
+			coinbase := NewCoinbaseTX(string(wallet.GetAddress()), "")
+			block, err := bc.MineBlockContext(context.Background(), append([]*Transaction{coinbase}, txs...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			UTXOSet{bc}.Update(block)
+			return block
+		}
+	}
+	t.Fatalf("leader %x of height %d is unknown", leader, height)
+	return nil
+}
+
+func TestPoSEngine(t *testing.T) {
+	t.Chdir(t.TempDir())
+	alice, bob := NewWallet(), NewWallet()
+	params := ChainParams{Consensus: ConsensusPoS, Signers: []string{string(alice.GetAddress())}}
+	bc, err := CreateBlockChain(string(alice.GetAddress()), "test", WithChainParams(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.CloseDB()
+	UTXOSet := UTXOSet{bc}
+	UTXOSet.Reindex()
+	engine := bc.Engine().(*PoSEngine)
+	wallets := []*Wallet{alice, bob}
+
+	// 没有质押时由初始验证者签名
+	assert.Equal(t, HashPubKey(alice.PublicKey), engine.Leader(bc.Tip(), 1))
+	engine.Authorize(bob)
+	_, err = bc.MineBlockContext(context.Background(), []*Transaction{NewCoinbaseTX(string(bob.GetAddress()), "")})
+	assert.ErrorIs(t, err, ErrNotInTurn)
+	block := mineStakeBlock(t, bc, wallets)
+	assert.Equal(t, alice.PublicKey, block.Signer)
+
+	// alice 和 bob 各质押 5
+	aliceStake, err := NewStakeTransaction(alice, 5, 0, &UTXOSet)
+	assert.NoError(t, err)
+	_, err = NewStakeTransaction(bob, 5, 0, &UTXOSet)
+	assert.Error(t, err, "Bob has no coins yet")
+	mineStakeBlock(t, bc, wallets, aliceStake)
+	bobFunds, err := NewUTXOTransaction(alice, string(bob.GetAddress()), 5, 0, false, &UTXOSet)
+	assert.NoError(t, err)
+	mineStakeBlock(t, bc, wallets, bobFunds)
+	bobStake, err := NewStakeTransaction(bob, 5, 0, &UTXOSet)
+	assert.NoError(t, err)
+	mineStakeBlock(t, bc, wallets, bobStake)
+	assert.Equal(t, map[string]int{
+		hex.EncodeToString(HashPubKey(alice.PublicKey)): 5,
+		hex.EncodeToString(HashPubKey(bob.PublicKey)):   5,
+	}, engine.Stakes())
+
+	// 质押的输出不能被花费
+	assert.ErrorIs(t, NewMempool(bc).Add(spendTx(alice, aliceStake, 0, string(bob.GetAddress()), 5, 0)), ErrInvalidTx)
+
+	// 只有被选中的验证者可以签名, 验证者由父区块哈希和高度确定
+	height := bc.GetBestHeight() + 1
+	leader := engine.Leader(bc.Tip(), height)
+	assert.Equal(t, leader, engine.Leader(bc.Tip(), height), "Leader selection is deterministic")
+	offender, other := alice, bob
+	if hex.EncodeToString(leader) != hex.EncodeToString(HashPubKey(alice.PublicKey)) {
+		offender, other = bob, alice
+	}
+	engine.Authorize(other)
+	_, err = bc.MineBlockContext(context.Background(), []*Transaction{NewCoinbaseTX(string(other.GetAddress()), "")})
+	assert.ErrorIs(t, err, ErrNotInTurn)
+
+	// 验证者在同一高度签名两个不同区块, 证据由之后的区块打包, 作恶者失去质押权重
+	engine.Authorize(offender)
+	first, err := sealBlock(context.Background(), engine, []*Transaction{NewCoinbaseTX(string(offender.GetAddress()), "")}, bc.Tip(), height, nextTestTimestamp(t, bc, bc.Tip()))
+	assert.NoError(t, err)
+	second, err := sealBlock(context.Background(), engine, []*Transaction{NewCoinbaseTX(string(offender.GetAddress()), "")}, bc.Tip(), height, nextTestTimestamp(t, bc, bc.Tip()))
+	assert.NoError(t, err)
+	firstHeader, secondHeader := first.Header(), second.Header()
+	assert.NoError(t, engine.VerifyHeader(&firstHeader))
+	assert.NoError(t, engine.VerifyHeader(&secondHeader))
+	assert.NoError(t, bc.SubmitBlock(first))
+	UTXOSet.Update(first)
+
+	block = mineStakeBlock(t, bc, wallets)
+	if assert.Len(t, block.Evidence, 1) {
+		assert.NoError(t, block.Evidence[0].Verify())
+		assert.Equal(t, HashPubKey(offender.PublicKey), block.Evidence[0].Offender())
+	}
+	assert.Equal(t, map[string]int{hex.EncodeToString(HashPubKey(other.PublicKey)): 5}, engine.Stakes())
+	// 质押索引记录主链上的质押和证据, 作恶者的质押仍然保留
+	assert.NoError(t, bc.store.View(func(tx StoreTx) error {
+		assert.Equal(t, stakeState{5, 1}, decodeStakeState(tx.IndexGet(stakeIndexBucket, HashPubKey(offender.PublicKey))))
+		assert.Equal(t, stakeState{5, 0}, decodeStakeState(tx.IndexGet(stakeIndexBucket, HashPubKey(other.PublicKey))))
+		return nil
+	}))
+	assert.Equal(t, HashPubKey(other.PublicKey), engine.Leader(bc.Tip(), bc.GetBestHeight()+1))
+
+	// 伪造的证据无效, 包含伪造证据的区块不能加入区块链
+	forged := SlashingEvidence{firstHeader, firstHeader}
+	assert.ErrorIs(t, forged.Verify(), ErrInvalidBlock)
+	signedBlock := func(signer *Wallet, prevHash []byte, height int, evidence ...SlashingEvidence) *Block {
+		b := &Block{
+			TimeStamp:    nextTestTimestamp(t, bc, bc.Tip()),
+			Transactions: []*Transaction{NewCoinbaseTX(string(signer.GetAddress()), "")},
+			PrevHash:     prevHash,
+			Height:       height,
+			Signer:       signer.PublicKey,
+			Evidence:     evidence,
+		}
+		assert.NoError(t, sealSigned(context.Background(), b, signer))
+		return b
+	}
+	assert.ErrorIs(t, bc.AddBlock(signedBlock(other, bc.Tip(), bc.GetBestHeight()+1, forged)), ErrInvalidBlock)
+
+	// 质押分布和惩罚按父区块所在的链计算: 打包证据之前作恶者仍有质押权重
+	stakes, slashed, err := engine.stateAt(block.PrevHash)
+	assert.NoError(t, err)
+	assert.Len(t, stakes, 2)
+	assert.False(t, slashed[hex.EncodeToString(HashPubKey(offender.PublicKey))])
+	_, slashed, err = engine.stateAt(block.Hash)
+	assert.NoError(t, err)
+	assert.True(t, slashed[hex.EncodeToString(HashPubKey(offender.PublicKey))])
+
+	// 父区块不是最新区块时同样验证签名者
+	leader = engine.Leader(block.PrevHash, block.Height)
+	notLeader := alice
+	if hex.EncodeToString(leader) == hex.EncodeToString(HashPubKey(alice.PublicKey)) {
+		notLeader = bob
+	}
+	sideHeader := signedBlock(notLeader, block.PrevHash, block.Height).Header()
+	assert.ErrorIs(t, engine.VerifyHeader(&sideHeader), ErrInvalidBlock)
+
+	// 父区块未知时无法确定验证者
+	orphanHeader := signedBlock(alice, []byte("unknown"), block.Height+1).Header()
+	assert.ErrorIs(t, engine.VerifyHeader(&orphanHeader), ErrOrphanBlock)
+}
@@ -2,32 +2,77 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"math/big"
 	"math"
 	"crypto/sha256"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const targetBits = 16
-const maxNonce = math.MaxInt64
+const maxNonce = math.MaxUint32 // nonce 的搜索空间, 用尽后需要修改 coinbase 中的 extra-nonce
+const cancelCheckInterval = 1 << 12 // 每计算这么多次哈希检查一次挖矿是否被取消
 
+// 搜索完整个 nonce 空间仍没有找到符合条件的哈希
+var errNonceSpaceExhausted = errors.New("nonce space is exhausted")
+
+// workers		并行搜索 nonce 的 goroutine 数量
+// maxNonce		nonce 的最大值
+// hashes		不为 nil 时累加计算过的哈希次数, 用于统计算力
 type ProofOfWork struct {
 	block *Block
 	target *big.Int
+	workers  int
+	maxNonce int
+	hashes   *atomic.Uint64
+}
+
+// SealOption 用于修改工作量证明挖矿的配置
+type SealOption func(*ProofOfWork)
+
+// WithWorkers 设置并行搜索 nonce 的 goroutine 数量, 默认为 CPU 核数
+func WithWorkers(workers int) SealOption {
+	return func(pow *ProofOfWork) {
+		if workers > 0 {
+			pow.workers = workers
+		}
+	}
 }
 
-func NewProofOfWork(b *Block) *ProofOfWork {
+// WithHashCounter 将计算过的哈希次数累加到 counter, 用于统计算力
+func WithHashCounter(counter *atomic.Uint64) SealOption {
+	return func(pow *ProofOfWork) {
+		pow.hashes = counter
+	}
+}
+
+func NewProofOfWork(b *Block, opts ...SealOption) *ProofOfWork {
 	target := big.NewInt(1)
 	// 左移256 - targetBits位
 	// 即 左侧开始数有targetBits个0
 	target.Lsh(target, uint(256 - targetBits))
-	return &ProofOfWork{block: b, target: target}
+	pow := &ProofOfWork{block: b, target: target, workers: runtime.NumCPU(), maxNonce: maxNonce}
+	for _, opt := range opts {
+		opt(pow)
+	}
+	return pow
 }
 
 func (pow *ProofOfWork) PrepareData(nonce int) []byte {
+	return prepareData(pow.block.PrevHash, pow.block.HashTransactions(), pow.block.TimeStamp, nonce)
+}
+
+// 拼接参与哈希计算的区块数据
+func prepareData(prevHash, merkleRoot []byte, timeStamp int64, nonce int) []byte {
 	data := bytes.Join([][]byte{
-		pow.block.PrevHash,
-		pow.block.HashTransactions(),
-		IntToHex(pow.block.TimeStamp),
+		prevHash,
+		merkleRoot,
+		IntToHex(timeStamp),
 		IntToHex(int64(nonce)),
 	}, []byte{})
 	return data
@@ -35,22 +80,113 @@ func (pow *ProofOfWork) PrepareData(nonce int) []byte {
 
 // 返回符合条件的nonce值和对应的hash
 func (pow *ProofOfWork) Run() (int, []byte) {
-	nonce := 0
-	var hash [32]byte
-
-	for nonce < maxNonce {
-		data := pow.PrepareData(nonce)
-		hash = sha256.Sum256(data)
-		hashInt := new(big.Int).SetBytes(hash[:])
-		// 比较hashInt和target的大小
-		// 如果hashInt < target,则代表前面有targetBits个0,符合条件
-		if hashInt.Cmp(pow.target) == -1 {
-			break
-		} else {
-			nonce++
+	nonce, hash, _ := pow.RunContext(context.Background())
+	return nonce, hash
+}
+
+// 同 Run, ctx 被取消时停止计算并返回 ctx 的错误
+// workers 个 goroutine 并行搜索, 第 i 个 goroutine 依次尝试 i, i+workers, i+2*workers...
+// 整个 nonce 空间都不符合条件时返回 errNonceSpaceExhausted
+func (pow *ProofOfWork) RunContext(ctx context.Context) (int, []byte, error) {
+	type result struct {
+		nonce int
+		hash  []byte
+	}
+	// Merkle 根和时间戳在一次搜索中不变, 只计算一次
+	merkleRoot := pow.block.HashTransactions()
+	prevHash, timeStamp := pow.block.PrevHash, pow.block.TimeStamp
+
+	searchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	found := make(chan result, pow.workers)
+	var wg sync.WaitGroup
+
+	for i := 0; i < pow.workers; i++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			count := uint64(0)
+			defer pow.countHashes(&count)
+
+			for nonce := start; nonce <= pow.maxNonce; nonce += pow.workers {
+				if count%cancelCheckInterval == 0 {
+					if searchCtx.Err() != nil {
+						return
+					}
+					pow.countHashes(&count)
+				}
+				hash := sha256.Sum256(prepareData(prevHash, merkleRoot, timeStamp, nonce))
+				count++
+				// 比较hashInt和target的大小
+				// 如果hashInt < target,则代表前面有targetBits个0,符合条件
+				if new(big.Int).SetBytes(hash[:]).Cmp(pow.target) == -1 {
+					found <- result{nonce, hash[:]}
+					cancel()
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	select {
+	case r := <-found:
+		return r.nonce, r.hash, nil
+	default:
+	}
+	if ctx.Err() != nil {
+		return 0, nil, ctx.Err()
+	}
+	return 0, nil, errNonceSpaceExhausted
+}
+
+// PoWEngine 是基于 SHA-256 工作量证明的共识引擎
+type PoWEngine struct{}
+
+// NewPoWEngine 创建工作量证明共识引擎
+func NewPoWEngine() *PoWEngine {
+	return &PoWEngine{}
+}
+
+// Prepare 重置区块的 nonce, 工作量证明不需要其他准备
+func (e *PoWEngine) Prepare(block *Block) error {
+	block.Nonce = 0
+	return nil
+}
+
+// Seal 搜索满足难度目标的 nonce
+// nonce 空间用尽时, 修改第一笔交易(coinbase)中的 extra-nonce 和区块时间戳, 以新的 Merkle 根继续搜索
+func (e *PoWEngine) Seal(ctx context.Context, block *Block, opts ...SealOption) error {
+	pow := NewProofOfWork(block, opts...)
+	for extraNonce := 1; ; extraNonce++ {
+		nonce, hash, err := pow.RunContext(ctx)
+		if err == nil {
+			block.Hash, block.Nonce = hash[:], nonce
+			return nil
 		}
+		if !errors.Is(err, errNonceSpaceExhausted) || len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+			return err
+		}
+		block.Transactions[0].SetExtraNonce(extraNonce)
+		// 时间戳不能早于原来的值, 否则可能不再大于父区块的过去中位时间
+		block.TimeStamp = max(block.TimeStamp, time.Now().Unix())
+	}
+}
+
+// VerifyHeader 验证区块头的工作量证明
+func (e *PoWEngine) VerifyHeader(header *BlockHeader) error {
+	if !ValidateHeader(header) {
+		return fmt.Errorf("%w: block %x has invalid proof of work", ErrInvalidBlock, header.Hash)
+	}
+	return nil
+}
+
+// 将 count 累加到哈希计数器并清零
+func (pow *ProofOfWork) countHashes(count *uint64) {
+	if pow.hashes != nil {
+		pow.hashes.Add(*count)
 	}
-	return nonce, hash[:]
+	*count = 0
 }
 
 // 验证pow是否有效
@@ -59,4 +195,68 @@ func (pow *ProofOfWork) Validate() bool {
 	hash := sha256.Sum256(data)
 	hashInt := new(big.Int).SetBytes(hash[:])
 	return hashInt.Cmp(pow.target) == -1
-}
\ No newline at end of file
+}
+
+// 仅根据区块头验证pow是否有效, 同时检查区块头中的哈希与计算结果一致
+func ValidateHeader(h *BlockHeader) bool {
+	target := headerTarget(h)
+
+	hash := sha256.Sum256(prepareData(h.PrevHash, h.MerkleRoot, h.TimeStamp, h.Nonce))
+	if !bytes.Equal(hash[:], h.Hash) {
+		return false
+	}
+	hashInt := new(big.Int).SetBytes(hash[:])
+	return hashInt.Cmp(target) == -1
+}
+
+// 区块头的难度目标, 目前所有区块头都使用 targetBits 对应的目标
+// 计算工作量时按每个区块头的目标分别计算, 难度可调整后只需修改这里
+func headerTarget(h *BlockHeader) *big.Int {
+	target := big.NewInt(1)
+	return target.Lsh(target, uint(256 - targetBits))
+}
+
+// 区块头的工作量, 即找到符合其难度目标的哈希平均需要的计算次数 2^256 / (target + 1)
+// 权威证明和权益证明的区块头没有难度, 同样按难度目标计算, 每个区块的工作量相同
+func headerWork(h *BlockHeader) *big.Int {
+	target := headerTarget(h)
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, target.Add(target, big.NewInt(1)))
+}
+
+// 一组区块头累计的工作量, 即每个区块头的工作量之和
+func chainWork(headers []*BlockHeader) *big.Int {
+	work := new(big.Int)
+	for _, h := range headers {
+		work.Add(work, headerWork(h))
+	}
+	return work
+}
+
+// 比较主链与本地区块 hash 所在的链: 返回两者在分叉点之后的累计工作量
+// hash 在主链上时 forkWork 为 0, mainWork 为主链在 hash 之后的工作量
+func (bc *BlockChain) forkWork(hash []byte) (mainWork, forkWork *big.Int, err error) {
+	err = bc.store.View(func(tx StoreTx) error {
+		block := tx.Block(hash)
+		if block == nil {
+			return fmt.Errorf("block %x is not found", hash)
+		}
+		detach, attach, err := reorgBranches(tx, tx.Block(tx.Tip()), block)
+		if err != nil {
+			return err
+		}
+		mainWork, forkWork = chainWork(blockHeaders(detach)), chainWork(blockHeaders(attach))
+		return nil
+	})
+	return mainWork, forkWork, err
+}
+
+// 返回区块的区块头
+func blockHeaders(blocks []*Block) []*BlockHeader {
+	headers := make([]*BlockHeader, len(blocks))
+	for i, block := range blocks {
+		header := block.Header()
+		headers[i] = &header
+	}
+	return headers
+}
@@ -0,0 +1,97 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestValidateHeader
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateHeader(t *testing.T) {
+	genesis := NewGenesisBlock(NewCoinbaseTX("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", genesisCoinbaseData))
+	header := genesis.Header()
+	assert.True(t, ValidateHeader(&header), "Header of a mined block is valid")
+
+	header.Nonce++
+	assert.False(t, ValidateHeader(&header), "Header with a changed nonce is invalid")
+
+	header = genesis.Header()
+	header.MerkleRoot = []byte("fake merkle root")
+	assert.False(t, ValidateHeader(&header), "Header with a changed merkle root is invalid")
+
+	// 下载的区块与已验证的区块头比较所有字段
+	header = genesis.Header()
+	other := genesis.Header()
+	assert.True(t, header.equal(&other))
+	other.Signer = []byte("signer")
+	assert.False(t, header.equal(&other), "Fields outside the proof of work are compared too")
+}
+
+func TestChainWork(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 2)
+	headers := blockHeaders([]*Block{mainChainBlock(t, bc, 0), mainChainBlock(t, bc, 1), mainChainBlock(t, bc, 2)})
+	assert.Equal(t, 1, chainWork(headers).Cmp(chainWork(headers[:2])), "Longer chain has more work")
+	assert.Equal(t, headerWork(headers[0]), chainWork(headers[:1]), "Genesis chain has the work of one block")
+
+	// 只比较分叉点之后的部分
+	mainWork, forkWork, err := bc.forkWork(headers[2].Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, mainWork.Sign())
+	assert.Equal(t, 0, forkWork.Sign())
+	fork := newTestFork(t, bc, mainChainBlock(t, bc, 0), 1, string(wallet.GetAddress()))
+	assert.NoError(t, bc.AddBlock(fork[0]))
+	mainWork, forkWork, err = bc.forkWork(fork[0].Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, chainWork(headers[1:]), mainWork)
+	assert.Equal(t, chainWork(blockHeaders(fork)), forkWork)
+}
+
+func TestRunContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	block, err := NewBlockContext(ctx, []*Transaction{NewCoinbaseTX("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", "")}, nil, 1)
+	assert.ErrorIs(t, err, context.Canceled, "Canceled mining stops without a block")
+	assert.Nil(t, block)
+}
+
+// 缩小 nonce 空间, 用于测试 extra-nonce
+func withMaxNonce(max int) SealOption {
+	return func(pow *ProofOfWork) {
+		pow.maxNonce = max
+	}
+}
+
+func TestRunContextWorkers(t *testing.T) {
+	var hashes atomic.Uint64
+	coinbase := NewCoinbaseTX("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", "")
+
+	block, err := NewBlockContext(context.Background(), []*Transaction{coinbase}, nil, 1, WithWorkers(4), WithHashCounter(&hashes))
+	assert.NoError(t, err)
+	assert.True(t, NewProofOfWork(block).Validate(), "Block mined by several workers is valid")
+	assert.Greater(t, hashes.Load(), uint64(0), "Computed hashes are counted")
+}
+
+func TestExtraNonce(t *testing.T) {
+	coinbase := NewCoinbaseTX("1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", "")
+	origID := coinbase.ID
+
+	// nonce 空间只有 1024, 几乎一定需要修改 extra-nonce
+	block, err := NewBlockContext(context.Background(), []*Transaction{coinbase}, nil, 1, WithWorkers(2), withMaxNonce(1<<10))
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, block.Nonce, 1<<10)
+	assert.True(t, NewProofOfWork(block).Validate(), "Block mined with an extra-nonce is valid")
+	assert.NotEqual(t, origID, block.Transactions[0].ID, "Extra-nonce changes the coinbase")
+	assert.Equal(t, block.Transactions[0].Hash(), block.Transactions[0].ID)
+	header := block.Header()
+	assert.True(t, ValidateHeader(&header), "Header commits to the new merkle root")
+
+	// 第一笔交易不是 coinbase 时无法修改 extra-nonce, 返回 nonce 空间用尽的错误
+	tx := &Transaction{nil, []TXInput{{coinbase.ID, 0, nil, nil, SequenceFinal}}, coinbase.Vout}
+	_, err = NewBlockContext(context.Background(), []*Transaction{tx}, nil, 1, withMaxNonce(-1))
+	assert.ErrorIs(t, err, errNonceSpaceExhausted)
+}
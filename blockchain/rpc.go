@@ -0,0 +1,346 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// 外部矿工、命令行与节点之间的请求/响应命令
+// 与其他命令不同, 客户端发送请求后关闭连接的写端, 节点在同一连接上返回响应
+// 命令长度不能超过 commandLength, 因此 getblocktemplate 简写为 gettemplate
+
+const rpcTimeout = 30 * time.Second // 等待节点响应的超时时间
+
+// 获取区块模板请求
+// Address		挖矿奖励接收地址
+type gettemplate struct {
+	Address string
+}
+
+// 区块模板
+// Error		节点无法构造模板时的错误信息, 为空表示成功
+// PrevHash		父区块哈希
+// Height		待挖掘区块的高度
+// MinTime		区块时间戳的最小值
+// Transactions	序列化后的交易, coinbase 交易在最前
+// Fees			交易的手续费总和
+type template struct {
+	Error        string
+	PrevHash     []byte
+	Height       int
+	MinTime      int64
+	Transactions [][]byte
+	Fees         int
+}
+
+// 提交区块请求
+// Block		序列化后的区块数据
+type submitblock struct {
+	Block []byte
+}
+
+// 提交区块的结果
+// Error		区块被拒绝的原因, 为空表示区块已被接受
+// Stale		区块的父区块已不是最新区块
+type submitresult struct {
+	Error string
+	Stale bool
+}
+
+// 保存内存池快照请求
+// File		快照文件在节点所在机器上的路径
+type savemempool struct {
+	File string
+}
+
+// 加载内存池快照请求
+// File		快照文件在节点所在机器上的路径
+type loadmempool struct {
+	File string
+}
+
+// 保存或加载内存池快照的结果
+// Error		失败的原因, 为空表示成功
+// Count		保存或加载的交易数量
+// Size			操作完成后内存池中的交易数量
+type mempoolresult struct {
+	Error string
+	Count int
+	Size  int
+}
+
+// 获取内存池交易请求
+// TxID		交易ID
+type getmempooltx struct {
+	TxID []byte
+}
+
+// 内存池中的交易
+// Error		交易不在内存池中等错误信息, 为空表示成功
+// Transaction	序列化后的交易
+// Inputs		序列化后的交易输入引用的前序交易, 来自内存池或区块链
+type mempooltx struct {
+	Error       string
+	Transaction []byte
+	Inputs      [][]byte
+}
+
+// 处理获取区块模板请求, 从内存池中选择交易构造模板并返回
+func (n *Node) handleGetTemplate(conn net.Conn, request []byte) {
+	var payload gettemplate
+	if err := gob.NewDecoder(bytes.NewReader(request[commandLength:])).Decode(&payload); err != nil {
+		fmt.Printf("Failed to decode gettemplate: %v\n", err)
+		return
+	}
+
+	var reply template
+	if consensus := n.bc.Params().Consensus; consensus != ConsensusPoW {
+		reply.Error = fmt.Sprintf("external mining is not supported by consensus %q", consensus)
+	} else if !ValidateAddress(payload.Address) {
+		reply.Error = fmt.Sprintf("invalid address %q", payload.Address)
+	} else {
+		tmpl := NewBlockTemplate(n.bc, n.mempool, payload.Address)
+		reply.PrevHash, reply.Height, reply.MinTime, reply.Fees = tmpl.PrevHash, tmpl.Height, tmpl.MinTime, tmpl.Fees
+		for _, tx := range tmpl.Transactions {
+			reply.Transactions = append(reply.Transactions, tx.Serialize())
+		}
+	}
+
+	n.reply(conn, reply)
+}
+
+// 处理外部矿工提交的区块, 区块被接受后与本地挖出的区块一样更新 UTXO 集、内存池并广播
+func (n *Node) handleSubmitBlock(conn net.Conn, request []byte) {
+	var payload submitblock
+	if err := gob.NewDecoder(bytes.NewReader(request[commandLength:])).Decode(&payload); err != nil {
+		fmt.Printf("Failed to decode submitblock: %v\n", err)
+		return
+	}
+
+	var reply submitresult
+	block, err := DeserializeBlock(payload.Block)
+	if err != nil {
+		fmt.Printf("Rejected submitted block: %v\n", err)
+		reply.Error = fmt.Sprintf("%v: %v", ErrInvalidBlock, err)
+		n.reply(conn, reply)
+		return
+	}
+	if err := n.bc.SubmitBlock(block); err != nil {
+		fmt.Printf("Rejected submitted block %x: %v\n", block.Hash, err)
+		reply.Error, reply.Stale = err.Error(), errors.Is(err, ErrStaleTip)
+		n.reply(conn, reply)
+		return
+	}
+	n.reply(conn, reply)
+
+	n.updateToTip()
+	fmt.Printf("Accepted submitted block %x with %d transactions\n", block.Hash, len(block.Transactions)-1)
+
+	n.notifyMiner()
+	n.broadcastInv("block", [][]byte{block.Hash}, "")
+}
+
+// 处理保存内存池快照请求, 将运行中节点的内存池写入快照文件
+func (n *Node) handleSaveMempool(conn net.Conn, request []byte) {
+	var payload savemempool
+	if err := gob.NewDecoder(bytes.NewReader(request[commandLength:])).Decode(&payload); err != nil {
+		fmt.Printf("Failed to decode savemempool: %v\n", err)
+		return
+	}
+
+	var reply mempoolresult
+	if err := n.mempool.Save(payload.File); err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.Count = n.mempool.Size()
+		fmt.Printf("Saved %d transactions to %s\n", reply.Count, payload.File)
+	}
+	reply.Size = n.mempool.Size()
+
+	n.reply(conn, reply)
+}
+
+// 处理加载内存池快照请求, 快照中仍然有效的交易重新验证后加入运行中节点的内存池
+func (n *Node) handleLoadMempool(conn net.Conn, request []byte) {
+	var payload loadmempool
+	if err := gob.NewDecoder(bytes.NewReader(request[commandLength:])).Decode(&payload); err != nil {
+		fmt.Printf("Failed to decode loadmempool: %v\n", err)
+		return
+	}
+
+	var reply mempoolresult
+	loaded, err := n.mempool.Load(payload.File)
+	if err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.Count = loaded
+		fmt.Printf("Loaded %d transactions from %s\n", loaded, payload.File)
+	}
+	reply.Size = n.mempool.Size()
+	n.reply(conn, reply)
+
+	if loaded > 0 {
+		n.notifyMiner()
+	}
+}
+
+// 处理获取内存池交易请求, 返回交易及其输入引用的前序交易, 供命令行构造替换交易
+func (n *Node) handleGetMempoolTx(conn net.Conn, request []byte) {
+	var payload getmempooltx
+	if err := gob.NewDecoder(bytes.NewReader(request[commandLength:])).Decode(&payload); err != nil {
+		fmt.Printf("Failed to decode getmempooltx: %v\n", err)
+		return
+	}
+
+	var reply mempooltx
+	tx, ok := n.mempool.Get(payload.TxID)
+	if !ok {
+		reply.Error = fmt.Sprintf("transaction %x is not in the mempool", payload.TxID)
+		n.reply(conn, reply)
+		return
+	}
+	reply.Transaction = tx.Serialize()
+	for _, vin := range tx.Vin {
+		prevTx, ok := n.mempool.Get(vin.Txid)
+		if !ok {
+			var err error
+			if prevTx, err = n.bc.FindTransaction(vin.Txid); err != nil {
+				reply = mempooltx{Error: err.Error()}
+				break
+			}
+		}
+		reply.Inputs = append(reply.Inputs, prevTx.Serialize())
+	}
+
+	n.reply(conn, reply)
+}
+
+// 在请求的连接上返回响应
+func (n *Node) reply(conn net.Conn, data interface{}) {
+	conn.SetWriteDeadline(time.Now().Add(rpcTimeout))
+	if _, err := conn.Write(gobEncode(data)); err != nil {
+		fmt.Printf("Failed to send reply to %s: %v\n", conn.RemoteAddr(), err)
+	}
+}
+
+// 向节点发送请求, 并将节点的响应解码到 reply
+func rpcCall(node, command string, request, reply interface{}) error {
+	conn, err := net.DialTimeout(protocol, node, rpcTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(rpcTimeout))
+
+	data := append(commandToBytes(command), gobEncode(request)...)
+	if _, err := conn.Write(data); err != nil {
+		return err
+	}
+	// 关闭写端, 节点读到请求结尾后开始处理
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.CloseWrite(); err != nil {
+			return err
+		}
+	}
+
+	if err := gob.NewDecoder(conn).Decode(reply); err != nil {
+		return fmt.Errorf("failed to read reply from %s: %w", node, err)
+	}
+	return nil
+}
+
+// GetBlockTemplate 向节点 node 请求区块模板, 挖矿奖励和手续费发送到 address
+// 返回的模板只包含交易和区块位置, Size 和 SigOps 为 0
+func GetBlockTemplate(node, address string) (*BlockTemplate, error) {
+	var reply template
+	if err := rpcCall(node, "gettemplate", gettemplate{address}, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return nil, fmt.Errorf("%s: %s", node, reply.Error)
+	}
+
+	tmpl := &BlockTemplate{PrevHash: reply.PrevHash, Height: reply.Height, MinTime: reply.MinTime, Fees: reply.Fees}
+	for _, data := range reply.Transactions {
+		tx, err := DeserializeTransaction(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", node, err)
+		}
+		tmpl.Transactions = append(tmpl.Transactions, &tx)
+	}
+	return tmpl, nil
+}
+
+// SubmitBlock 将挖出的区块提交给节点 node
+// 区块的父区块已不是节点的最新区块时返回 ErrStaleTip, 被拒绝时返回 ErrInvalidBlock
+func SubmitBlock(node string, b *Block) error {
+	var reply submitresult
+	if err := rpcCall(node, "submitblock", submitblock{b.Serialize()}, &reply); err != nil {
+		return err
+	}
+	if reply.Stale {
+		return ErrStaleTip
+	}
+	if reply.Error != "" {
+		// 节点返回的错误信息已包含 ErrInvalidBlock 的描述, 去掉后重新包装
+		return fmt.Errorf("%w: %s", ErrInvalidBlock, strings.TrimPrefix(reply.Error, ErrInvalidBlock.Error()+": "))
+	}
+	return nil
+}
+
+// SaveMempool 让节点 node 将内存池写入快照文件 file, file 是节点所在机器上的路径
+// 返回保存的交易数量
+func SaveMempool(node, file string) (int, error) {
+	var reply mempoolresult
+	if err := rpcCall(node, "savemempool", savemempool{file}, &reply); err != nil {
+		return 0, err
+	}
+	if reply.Error != "" {
+		return 0, fmt.Errorf("%s: %s", node, reply.Error)
+	}
+	return reply.Count, nil
+}
+
+// LoadMempool 让节点 node 将快照文件 file 中仍然有效的交易加入内存池, file 是节点所在机器上的路径
+// 返回加入的交易数量和加载后内存池中的交易数量
+func LoadMempool(node, file string) (int, int, error) {
+	var reply mempoolresult
+	if err := rpcCall(node, "loadmempool", loadmempool{file}, &reply); err != nil {
+		return 0, 0, err
+	}
+	if reply.Error != "" {
+		return 0, 0, fmt.Errorf("%s: %s", node, reply.Error)
+	}
+	return reply.Count, reply.Size, nil
+}
+
+// GetMempoolTx 从节点 node 的内存池获取交易 txid, 以及交易输入引用的前序交易(交易ID -> 交易)
+func GetMempoolTx(node string, txid []byte) (*Transaction, map[string]Transaction, error) {
+	var reply mempooltx
+	if err := rpcCall(node, "getmempooltx", getmempooltx{txid}, &reply); err != nil {
+		return nil, nil, err
+	}
+	if reply.Error != "" {
+		return nil, nil, fmt.Errorf("%s: %s", node, reply.Error)
+	}
+
+	tx, err := DeserializeTransaction(reply.Transaction)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", node, err)
+	}
+	prevTXs := make(map[string]Transaction)
+	for _, data := range reply.Inputs {
+		prevTx, err := DeserializeTransaction(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", node, err)
+		}
+		prevTXs[hex.EncodeToString(prevTx.ID)] = prevTx
+	}
+	return &tx, prevTXs, nil
+}
@@ -3,32 +3,33 @@ package blockchain
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"time"
 )
 
 const protocol = "tcp"
-const nodeVersion = 1
+const nodeVersion = 2
+const headersVersion = 2 // 支持 getheaders/headers 的最低节点版本
 const commandLength = 12
-
-var nodeAddress string		// 当前节点的网络地址
-var miningAddress string	// 挖矿奖励接收地址
-var knownNodes = []string{"localhost:3000"}
-var blocksInTransit = [][]byte{}	
-var mempool = make(map[string]Transaction)
+const maxInvSize = 500                          // 每条区块inv消息最多包含的哈希数量
+const acceptRetryDelay = 100 * time.Millisecond // 接受连接出错后重试的间隔
+const requestTimeout = 30 * time.Second         // 读取请求的超时时间, 超时后关闭连接
 
 // 版本信息
 // AddrFrom		发送该信息的节点地址
 // BestHeight	该节点的区块链最高高度
 // Version		节点版本号
+// Timestamp	发送时该节点的本地时间(Unix 秒), 用于计算网络调整时间, 旧版本节点不发送
 type verzion struct {
 	Version    int
 	BestHeight int
 	AddrFrom   string
+	Timestamp  int64
 }
 
 // 地址
@@ -47,8 +48,26 @@ type block struct {
 
 // 获取区块请求
 // AddrFrom		发送该信息的节点地址
+// Locator		请求方主链的区块定位器, 对方只返回分叉点之后的区块哈希
 type getblocks struct {
 	AddrFrom string
+	Locator  [][]byte
+}
+
+// 获取区块头请求
+// AddrFrom		发送该信息的节点地址
+// Locator		请求方主链的区块定位器, 用于确定分叉点
+type getheaders struct {
+	AddrFrom string
+	Locator  [][]byte
+}
+
+// 发送区块头
+// AddrFrom		发送该信息的节点地址
+// Headers		分叉点之后的区块头, 按高度升序排列
+type headers struct {
+	AddrFrom string
+	Headers  []BlockHeader
 }
 
 // 获取数据请求
@@ -66,68 +85,93 @@ type getdata struct {
 // Type			信息类型，区块("block")或交易("tx")
 // Items		块的哈希列表或交易ID列表
 type inv struct {
-    AddrFrom string
-    Type     string
-    Items    [][]byte
+	AddrFrom string
+	Type     string
+	Items    [][]byte
 }
 
 // 发送交易
 // AddrFrom		发送该信息的节点地址
 // Transaction		序列化后的交易数据
 type tx struct {
-	AddrFrom     string
-	Transaction  []byte
+	AddrFrom    string
+	Transaction []byte
 }
 
-// 获取中央节点的地址
-func GetCentralNodeAddress() string {
-	return knownNodes[0]
+// 不断接受并处理来自其他节点的连接请求, 直到节点停止
+func (n *Node) acceptLoop() {
+	defer n.wg.Done()
+
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			// 节点停止时监听被关闭, 正常退出
+			if n.ctx.Err() != nil {
+				return
+			}
+			// 其他错误(如文件描述符耗尽)通常是暂时的, 稍后重试
+			fmt.Printf("Accept error: %v\n", err)
+			select {
+			case <-n.ctx.Done():
+				return
+			case <-time.After(acceptRetryDelay):
+			}
+			continue
+		}
+		// 节点停止时关闭所有未处理完的连接
+		if !n.trackConn(conn) {
+			conn.Close()
+			return
+		}
+		// 启动一个 goroutine(轻量级线程)异步执行，而不会阻塞当前的主程序流程
+		n.handlers.Add(1)
+		go func() {
+			defer n.handlers.Done()
+			defer n.untrackConn(conn)
+			n.handleConnection(conn)
+		}()
+	}
 }
 
-// 启动节点服务器，监听来自其他节点的连接请求
-func StartServer(nodeID, minerAddress string) {
-	// 根据端口号(nodeID)设置当前节点的网络地址
-    nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-	// 设置挖矿奖励接收地址
-    miningAddress = minerAddress
-	// 监听网络连接
-    ln, err := net.Listen(protocol, nodeAddress)
-	if err != nil {
-		log.Panic(err)
+// 记录正在处理的连接, 节点已停止时返回 false
+func (n *Node) trackConn(conn net.Conn) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.ctx.Err() != nil {
+		return false
 	}
-    defer ln.Close()
+	n.conns[conn] = struct{}{}
+	return true
+}
 
-    bc, _ := NewBlockChain(nodeID)
+func (n *Node) untrackConn(conn net.Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 
-	// 如果当前节点不是中央节点，向中央节点发送版本信息
-    if nodeAddress != GetCentralNodeAddress() {
-		// 通常用于节点间同步区块链版本（如区块高度、最新区块哈希等），目的是让当前节点与种子节点对齐账本状态（如果本地区块链落后，会触发区块同步）
-        SendVersion(GetCentralNodeAddress(), bc)
-    }
+	delete(n.conns, conn)
+}
 
-	// 不断接受并处理来自其他节点的连接请求
-    for {
-        conn, _ := ln.Accept()
-		// 启动一个 goroutine(轻量级线程)异步执行，而不会阻塞当前的主程序流程
-        go handleConnection(conn, bc)
-    }
+// 关闭所有正在处理的连接, 使阻塞在读写上的请求立即返回
+func (n *Node) closeConns() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for conn := range n.conns {
+		conn.Close()
+	}
 }
 
 // 发送数据给指定地址的节点
-func SendData(addr string, data []byte) {
+func (n *Node) SendData(addr string, data []byte) {
 	// 建立与目标节点的网络连接, protocol = "tcp"
 	conn, err := net.Dial(protocol, addr)
 	// 连接失败则说明该节点不可用
 	if err != nil {
 		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
 		// 从已知节点列表中移除该不可用节点
-		for _, node := range knownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
-		knownNodes = updatedNodes
+		n.removePeer(addr)
+		n.syncer.removePeer(addr)
 		return
 	}
 	defer conn.Close()
@@ -135,84 +179,122 @@ func SendData(addr string, data []byte) {
 	// 发送数据
 	_, err = io.Copy(conn, bytes.NewReader(data))
 	if err != nil {
-		log.Panic(err)
+		fmt.Printf("Failed to send data to %s: %v\n", addr, err)
 	}
 }
 
 // 发送信息给指定地址的节点
-func SendVersion(addr string, bc *BlockChain) {
-    bestHeight := bc.GetBestHeight()
-    payload := gobEncode(verzion{nodeVersion, bestHeight, nodeAddress})
+func (n *Node) SendVersion(addr string) {
+	bestHeight := n.bc.GetBestHeight()
+	payload := gobEncode(verzion{nodeVersion, bestHeight, n.address, time.Now().Unix()})
 
-    request := append(commandToBytes("version"), payload...)
-    SendData(addr, request)
+	request := append(commandToBytes("version"), payload...)
+	n.SendData(addr, request)
 }
 
 // 发送区块给指定地址的节点
-func SendBlock(addr string, b *Block) {
-	data := block{nodeAddress, b.Serialize()}
+func (n *Node) SendBlock(addr string, b *Block) {
+	data := block{n.address, b.Serialize()}
 	payload := gobEncode(data)
 	request := append(commandToBytes("block"), payload...)
 
-	SendData(addr, request)
+	n.SendData(addr, request)
 }
 
 // 发送inv信息给指定地址的节点
-func SendInv(address, kind string, items [][]byte) {
-	inventory := inv{nodeAddress, kind, items}
+func (n *Node) SendInv(address, kind string, items [][]byte) {
+	inventory := inv{n.address, kind, items}
 	payload := gobEncode(inventory)
 	request := append(commandToBytes("inv"), payload...)
 
-	SendData(address, request)
+	n.SendData(address, request)
 }
 
 // 发送交易给指定地址的节点
-func SendTx(addr string, tnx *Transaction) {
-	data := tx{nodeAddress, tnx.Serialize()}
+func (n *Node) SendTx(addr string, tnx *Transaction) {
+	data := tx{n.address, tnx.Serialize()}
 	payload := gobEncode(data)
 	request := append(commandToBytes("tx"), payload...)
 
-	SendData(addr, request)
+	n.SendData(addr, request)
+}
+
+// SubmitTx 依次尝试将交易提交给 nodes 中的节点, 直到有一个节点可以连接
+// 返回接收交易的节点地址
+func SubmitTx(nodes []string, tnx *Transaction) (string, error) {
+	data := tx{"", tnx.Serialize()}
+	request := append(commandToBytes("tx"), gobEncode(data)...)
+
+	for _, node := range nodes {
+		conn, err := net.Dial(protocol, node)
+		if err != nil {
+			fmt.Printf("%s is not available\n", node)
+			continue
+		}
+		_, err = io.Copy(conn, bytes.NewReader(request))
+		conn.Close()
+		if err == nil {
+			return node, nil
+		}
+	}
+
+	return "", fmt.Errorf("no node is available to accept the transaction")
 }
 
 // 发送获取区块请求给指定地址的节点
-func SendGetBlocks(address string) {
-	payload := gobEncode(getblocks{nodeAddress})
+func (n *Node) SendGetBlocks(address string, locator [][]byte) {
+	payload := gobEncode(getblocks{n.address, locator})
 	request := append(commandToBytes("getblocks"), payload...)
 
-	SendData(address, request)
+	n.SendData(address, request)
+}
+
+// 发送获取区块头请求给指定地址的节点
+func (n *Node) SendGetHeaders(address string, locator [][]byte) {
+	payload := gobEncode(getheaders{n.address, locator})
+	request := append(commandToBytes("getheaders"), payload...)
+
+	n.SendData(address, request)
+}
+
+// 发送区块头给指定地址的节点
+func (n *Node) SendHeaders(address string, items []BlockHeader) {
+	payload := gobEncode(headers{n.address, items})
+	request := append(commandToBytes("headers"), payload...)
+
+	n.SendData(address, request)
 }
 
 // 发送获取数据请求给指定地址的节点
-func SendGetData(address, kind string, id []byte) {
-	payload := gobEncode(getdata{nodeAddress, kind, id})
+func (n *Node) SendGetData(address, kind string, id []byte) {
+	payload := gobEncode(getdata{n.address, kind, id})
 	request := append(commandToBytes("getdata"), payload...)
 
-	SendData(address, request)
+	n.SendData(address, request)
 }
 
 // 将命令字符串转换为固定长度的字节数组
 func commandToBytes(command string) []byte {
-    var bytes [commandLength]byte
+	var bytes [commandLength]byte
 
-    for i, c := range command {
-        bytes[i] = byte(c)
-    }
+	for i, c := range command {
+		bytes[i] = byte(c)
+	}
 
-    return bytes[:]
+	return bytes[:]
 }
 
 // 将字节数组转换回命令字符串
 func bytesToCommand(bytes []byte) string {
-    var command []byte
+	var command []byte
 
-    for _, b := range bytes {
-        if b != 0x0 {
-            command = append(command, b)
-        }
-    }
+	for _, b := range bytes {
+		if b != 0x0 {
+			command = append(command, b)
+		}
+	}
 
-    return fmt.Sprintf("%s", command)
+	return fmt.Sprintf("%s", command)
 }
 
 // 提取请求中的命令部分
@@ -220,177 +302,288 @@ func extractCommand(request []byte) []byte {
 	return request[:commandLength]
 }
 
-// 所有已知节点向中心节点请求区块列表, 以便同步区块链
-func requestBlocks() {
-	for _, node := range knownNodes {
-		SendGetBlocks(node)
+// 向所有已知节点请求区块列表, 以便同步区块链
+func (n *Node) requestBlocks() {
+	locator := n.bc.GetBlockLocator()
+	for _, node := range n.KnownNodes() {
+		n.SendGetBlocks(node, locator)
 	}
 }
 
 // 处理来自其他节点的连接请求
-func handleConnection(conn net.Conn, bc *BlockChain) {
-	// 读取连接中的数据
-    request, err := ioutil.ReadAll(conn)
+func (n *Node) handleConnection(conn net.Conn) {
+	// 读取连接中的数据, 对方在超时时间内没有发送完请求时关闭连接
+	// 外部矿工的请求在同一连接上返回响应, 处理完成后再关闭连接
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	request, err := ioutil.ReadAll(conn)
+	defer conn.Close()
 	if err != nil {
-		log.Panic(err)
+		fmt.Printf("Failed to read request: %v\n", err)
+		return
+	}
+	if len(request) < commandLength {
+		return
 	}
 	// 提取命令
-    command := bytesToCommand(request[:commandLength])
-    fmt.Printf("Received %s command\n", command)
+	command := bytesToCommand(request[:commandLength])
+	fmt.Printf("Received %s command\n", command)
 
-	// 处理不同类型的命令
+	// 处理不同类型的命令, 请求无法解码时丢弃该请求并关闭连接
 	switch command {
 	case "addr":
-		handleAddr(request)
+		err = n.handleAddr(request)
 	case "block":
-		handleBlock(request, bc)
+		err = n.handleBlock(request)
 	case "inv":
-		handleInv(request, bc)
+		err = n.handleInv(request)
 	case "getblocks":
-		handleGetBlocks(request, bc)
+		err = n.handleGetBlocks(request)
 	case "getdata":
-		handleGetData(request, bc)
+		err = n.handleGetData(request)
+	case "getheaders":
+		err = n.handleGetHeaders(request)
+	case "getmempooltx":
+		n.handleGetMempoolTx(conn, request)
+	case "gettemplate":
+		n.handleGetTemplate(conn, request)
+	case "headers":
+		err = n.handleHeaders(request)
+	case "loadmempool":
+		n.handleLoadMempool(conn, request)
+	case "savemempool":
+		n.handleSaveMempool(conn, request)
+	case "submitblock":
+		n.handleSubmitBlock(conn, request)
 	case "tx":
-		handleTx(request, bc)
+		err = n.handleTx(request)
 	case "version":
-		handleVersion(request, bc)
+		err = n.handleVersion(request)
 	default:
 		fmt.Println("Unknown command!")
 	}
-
-    conn.Close()
+	if err != nil {
+		fmt.Printf("Dropped %s command from %s: %v\n", command, conn.RemoteAddr(), err)
+	}
 }
 
 // 处理接收到的版本信息
-func handleVersion(request []byte, bc *BlockChain) {
-    var buff bytes.Buffer
-    var payload verzion
+func (n *Node) handleVersion(request []byte) error {
+	var buff bytes.Buffer
+	var payload verzion
 
-    buff.Write(request[commandLength:])
-    dec := gob.NewDecoder(&buff)
-    dec.Decode(&payload)
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	if err := dec.Decode(&payload); err != nil {
+		return err
+	}
 
-    myBestHeight := bc.GetBestHeight()
-    foreignerBestHeight := payload.BestHeight
+	myBestHeight := n.bc.GetBestHeight()
+	foreignerBestHeight := payload.BestHeight
 
-    if myBestHeight < foreignerBestHeight {
-        SendGetBlocks(payload.AddrFrom)
-    } else if myBestHeight > foreignerBestHeight {
-        SendVersion(payload.AddrFrom, bc)
-    }
+	n.addPeers([]string{payload.AddrFrom})
+	if payload.Timestamp != 0 {
+		n.bc.clock.addSample(payload.AddrFrom, time.Unix(payload.Timestamp, 0))
+	}
 
-    if !nodeIsKnown(payload.AddrFrom) {
-        knownNodes = append(knownNodes, payload.AddrFrom)
-    }
+	// 本地区块链落后时先同步区块头, 不支持区块头同步的旧节点则请求区块列表
+	if myBestHeight < foreignerBestHeight {
+		if payload.Version >= headersVersion {
+			n.SendGetHeaders(payload.AddrFrom, n.bc.GetBlockLocator())
+		} else {
+			n.SendGetBlocks(payload.AddrFrom, n.bc.GetBlockLocator())
+		}
+	} else if myBestHeight > foreignerBestHeight {
+		n.SendVersion(payload.AddrFrom)
+	}
+	return nil
 }
 
 // 处理接收到的地址信息
-func handleAddr(request []byte) {
+func (n *Node) handleAddr(request []byte) error {
 	var buff bytes.Buffer
 	var payload addr
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := dec.Decode(&payload); err != nil {
+		return err
 	}
 
-	knownNodes = append(knownNodes, payload.AddrList...)
-	fmt.Printf("There are %d known nodes now!\n", len(knownNodes))
-	requestBlocks()
+	n.addPeers(payload.AddrList)
+	fmt.Printf("There are %d known nodes now!\n", len(n.KnownNodes()))
+	n.requestBlocks()
+	return nil
 }
 
 // 处理获取区块请求
-func handleGetBlocks(request []byte, bc *BlockChain) {
+func (n *Node) handleGetBlocks(request []byte) error {
 	var buff bytes.Buffer
 	var payload getblocks
 
 	// 读取请求中的负载数据
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := dec.Decode(&payload); err != nil {
+		return err
 	}
 
-	blocks := bc.GetBlockHashes()
-	SendInv(payload.AddrFrom, "block", blocks)
+	// 只返回分叉点之后的区块哈希, 每次最多 maxInvSize 个
+	blocks := n.bc.GetBlockHashesAfter(payload.Locator, maxInvSize)
+	if len(blocks) == 0 {
+		return nil
+	}
+	n.SendInv(payload.AddrFrom, "block", blocks)
+	return nil
+}
+
+// 处理获取区块头请求, 返回请求方分叉点之后的主链区块头
+func (n *Node) handleGetHeaders(request []byte) error {
+	var buff bytes.Buffer
+	var payload getheaders
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	if err := dec.Decode(&payload); err != nil {
+		return err
+	}
+
+	items := n.bc.GetHeadersAfter(payload.Locator, maxHeadersPerMsg)
+	n.SendHeaders(payload.AddrFrom, items)
+	return nil
+}
+
+// 处理接收到的区块头, 验证通过后从多个节点并行下载区块体
+func (n *Node) handleHeaders(request []byte) error {
+	var buff bytes.Buffer
+	var payload headers
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	if err := dec.Decode(&payload); err != nil {
+		return err
+	}
+
+	fmt.Printf("Recevied %d headers\n", len(payload.Headers))
+	if err := n.syncer.processHeaders(payload.AddrFrom, payload.Headers); err != nil {
+		fmt.Printf("Rejected headers from %s: %v\n", payload.AddrFrom, err)
+	}
+	return nil
 }
 
 // 处理获取数据请求
-func handleGetData(request []byte, bc *BlockChain) {
+func (n *Node) handleGetData(request []byte) error {
 	var buff bytes.Buffer
 	var payload getdata
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := dec.Decode(&payload); err != nil {
+		return err
 	}
 
 	// 根据请求类型发送相应的数据
 	// 请求"块"
 	if payload.Type == "block" {
-		block, err := bc.GetBlock([]byte(payload.ID))
+		block, err := n.bc.GetBlock([]byte(payload.ID))
 		if err != nil {
-			return
+			return nil
 		}
-		SendBlock(payload.AddrFrom, &block)
+		n.SendBlock(payload.AddrFrom, &block)
 	}
 	// 请求"交易"
 	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := mempool[txID]
+		tx, ok := n.mempool.Get(payload.ID)
+		if !ok {
+			return nil
+		}
 
-		SendTx(payload.AddrFrom, &tx)
+		n.SendTx(payload.AddrFrom, &tx)
 	}
+	return nil
 }
 
 // 处理接接收到的区块
-func handleBlock(request []byte, bc *BlockChain) {
+func (n *Node) handleBlock(request []byte) error {
 	var buff bytes.Buffer
 	var payload block
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := dec.Decode(&payload); err != nil {
+		return err
 	}
 
 	blockData := payload.Block
-	block := DeserializeBlock(blockData)
+	block, err := DeserializeBlock(blockData)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("Recevied a new block!")
-	// 将接收到的区块添加到本地区块链
-	bc.AddBlock(block)
-
+	// 先同步区块头时请求的区块由 syncer 按顺序连接
+	if n.syncer.processBlock(block) {
+		return nil
+	}
+	isNew := !n.bc.HasBlock(block.Hash)
+	// 将接收到的区块添加到本地区块链, 违反检查点或重组深度限制的区块被拒绝, 不再转发
+	err = n.bc.AddBlock(block)
+	if errors.Is(err, ErrOrphanBlock) {
+		// 父区块未知, 区块头有效时先保存在孤儿区块池中, 并向发送者请求最早的缺失祖先
+		if n.orphanBlocks.add(block, payload.AddrFrom, n.bc) {
+			if missing := n.orphanBlocks.missingAncestor(block.Hash); missing != nil {
+				fmt.Printf("Block %x is an orphan, requesting ancestor %x\n", block.Hash, missing)
+				n.SendGetData(payload.AddrFrom, "block", missing)
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("Rejected block %x: %v\n", block.Hash, err)
+		return nil
+	}
 	fmt.Printf("Added block %x\n", block.Hash)
+	// 以该区块为祖先的孤儿区块现在可以连接
+	for _, orphan := range n.orphanBlocks.connect(block, n.bc) {
+		fmt.Printf("Added orphan block %x\n", orphan.Hash)
+	}
+	// 只有成为主链的区块中的交易从内存池中移除
+	n.updateToTip()
+	n.notifyMiner()
 
 	// 如果还有待下载的块，继续请求下一个块
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		// 如果下载完成, 重新索引UTXO集
-		UTXOSet := UTXOSet{bc}
-		UTXOSet.Reindex()
+	n.mu.Lock()
+	var next []byte
+	if len(n.blocksInTransit) > 0 {
+		next = n.blocksInTransit[0]
+		n.blocksInTransit = n.blocksInTransit[1:]
+	}
+	moreBlocksFrom := n.moreBlocksFrom
+	if next == nil {
+		n.moreBlocksFrom = ""
 	}
+	n.mu.Unlock()
+
+	if next != nil {
+		n.SendGetData(payload.AddrFrom, "block", next)
+	} else if moreBlocksFrom != "" {
+		// 上一条inv已满, 用新的区块定位器继续请求后续区块, 直到追上对方
+		n.SendGetBlocks(moreBlocksFrom, n.bc.GetBlockLocator())
+	} else if isNew {
+		// 新区块不是同步下载得到的, 转发给其他对等节点
+		n.broadcastInv("block", [][]byte{block.Hash}, payload.AddrFrom)
+	}
+	return nil
 }
 
 // 处理接收到的inv信息
-func handleInv(request []byte, bc *BlockChain) {
+func (n *Node) handleInv(request []byte) error {
 	var buff bytes.Buffer
 	var payload inv
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := dec.Decode(&payload); err != nil {
+		return err
 	}
 
 	fmt.Printf("Recevied inventory with %d %s\n", len(payload.Items), payload.Type)
@@ -398,107 +591,97 @@ func handleInv(request []byte, bc *BlockChain) {
 	// 处理不同类型的inv信息
 	// 请求"块"
 	if payload.Type == "block" {
-		// 记录待下载的块哈希列表
-		blocksInTransit = payload.Items
-		// 请求第一个块(在我们的实现中，我们永远也不会发送有多重哈希的 inv 消息，因此这里只会请求一个块)
-		blockHash := payload.Items[0]
-		// 给 inv 消息的发送者发送 getdata 命令并更新 blocksInTransit
-		SendGetData(payload.AddrFrom, "block", blockHash)
-		// 更新 blocksInTransit 列表，移除已请求的块哈希
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+		// 只记录本地还没有的块
+		var missing [][]byte
+		for _, hash := range payload.Items {
+			if !n.bc.HasBlock(hash) && !n.orphanBlocks.has(hash) {
+				missing = append(missing, hash)
 			}
 		}
-		blocksInTransit = newInTransit
+		if len(missing) == 0 {
+			return nil
+		}
+
+		n.mu.Lock()
+		// inv已满说明对方还有更多区块, 本批下载完成后继续请求
+		if len(payload.Items) == maxInvSize {
+			n.moreBlocksFrom = payload.AddrFrom
+		}
+		// 请求第一个块, 其余的块记录在 blocksInTransit 中, 收到上一个块后再依次请求
+		// 对方按高度升序返回分叉点之后的区块, 因此逐个请求时父区块总是先到达
+		n.blocksInTransit = missing[1:]
+		n.mu.Unlock()
+		n.SendGetData(payload.AddrFrom, "block", missing[0])
 	}
 
 	// 请求"交易"
 	if payload.Type == "tx" {
-		// 提取交易ID
-		txID := payload.Items[0]
-		// 如果内存池中没有该交易，则请求该交易数据
-		if mempool[hex.EncodeToString(txID)].ID == nil {
-			SendGetData(payload.AddrFrom, "tx", txID)
+		for _, txID := range payload.Items {
+			// 如果内存池和孤儿池中都没有该交易，则请求该交易数据
+			if !n.mempool.Has(txID) && !n.orphans.has(txID) {
+				n.SendGetData(payload.AddrFrom, "tx", txID)
+			}
 		}
 	}
+	return nil
 }
 
 // 处理接收到的交易
-func handleTx(request []byte, bc *BlockChain) {
+func (n *Node) handleTx(request []byte) error {
 	var buff bytes.Buffer
 	var payload tx
 
 	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+	if err := dec.Decode(&payload); err != nil {
+		return err
 	}
 
 	// 获取交易数据并反序列化
 	txData := payload.Transaction
-	tx := DeserializeTransaction(txData)
-	// 将交易添加到内存池, 以便后续打包进块
-	mempool[hex.EncodeToString(tx.ID)] = tx
-
-	// 如果当前节点是中心节点，不挖矿, 将新的交易推送给网络中的其他节点
-	if nodeAddress == GetCentralNodeAddress() {
-		for _, node := range knownNodes {
-			if node != nodeAddress && node != payload.AddrFrom {
-				SendInv(node, "tx", [][]byte{tx.ID})
-			}
-		}
-	} else {
-		// 如果当前节点（矿工）的内存池中有两笔或更多的交易，开始挖矿
-		if len(mempool) >= 2 && len(miningAddress) > 0 {
-		MineTransactions:
-			var txs []*Transaction
-
-			// 从内存池中选择有效交易
-			for id := range mempool {
-				tx := mempool[id]
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
+	tx, err := DeserializeTransaction(txData)
+	if err != nil {
+		return err
+	}
+	// 验证交易并添加到内存池, 以便后续打包进块
+	// 已经见过的交易和无效交易不再转发, 避免在网络中循环转发
+	err = n.mempool.Add(&tx)
+	if errors.Is(err, ErrOrphanTx) {
+		// 父交易还没有到达, 暂存交易并向发送方请求缺失的父交易
+		if n.orphans.add(&tx, payload.AddrFrom) {
+			fmt.Printf("Stored orphan transaction %x\n", tx.ID)
+			for _, parent := range n.mempool.MissingParents(&tx) {
+				if !n.orphans.has(parent) {
+					n.SendGetData(payload.AddrFrom, "tx", parent)
 				}
 			}
+		}
+		return nil
+	}
+	if err != nil {
+		if !errors.Is(err, ErrTxAlreadyKnown) {
+			fmt.Printf("Rejected transaction %x: %v\n", tx.ID, err)
+		}
+		return nil
+	}
 
-			// 如果没有有效交易则退出
-			if len(txs) == 0 {
-				fmt.Println("All transactions are invalid! Waiting for new ones...")
-				return
-			}
-
-			// 创建挖矿奖励交易
-			cbTx := NewCoinbaseTX(miningAddress, "")
-			txs = append(txs, cbTx)
-
-			// 挖掘新块并将交易打包进块
-			newBlock := bc.MineBlock(txs)
-			// 更新UTXO集
-			UTXOSet := UTXOSet{bc}
-			UTXOSet.Reindex()
-
-			fmt.Println("New block is mined!")
-
-			// 从内存池中移除已打包进块的交易
-			for _, tx := range txs {
-				txID := hex.EncodeToString(tx.ID)
-				delete(mempool, txID)
-			}
+	// 所有节点都将新的交易(以及因此被接受的孤儿交易)转发给其他对等节点
+	relay := [][]byte{tx.ID}
+	for _, orphan := range n.orphans.processParent(&tx, n.mempool) {
+		relay = append(relay, orphan.ID)
+	}
+	n.broadcastInv("tx", relay, payload.AddrFrom)
 
-			// 向其他节点广播新块
-			for _, node := range knownNodes {
-				if node != nodeAddress {
-					SendInv(node, "block", [][]byte{newBlock.Hash})
-				}
-			}
+	// 开启挖矿的节点用新的交易重新构造区块模板
+	n.notifyMiner()
+	return nil
+}
 
-			// 如果内存池中还有交易，继续挖矿
-			if len(mempool) > 0 {
-				goto MineTransactions
-			}
+// 向除 except 以外的所有已知节点发送inv信息
+func (n *Node) broadcastInv(kind string, items [][]byte, except string) {
+	for _, node := range n.KnownNodes() {
+		if node != except {
+			n.SendInv(node, kind, items)
 		}
 	}
 }
@@ -516,14 +699,3 @@ func gobEncode(data interface{}) []byte {
 
 	return buff.Bytes()
 }
-
-// 检查节点地址是否在已知节点列表中
-func nodeIsKnown(addr string) bool {
-	for _, node := range knownNodes {
-		if node == addr {
-			return true
-		}
-	}
-
-	return false
-}
\ No newline at end of file
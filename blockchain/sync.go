@@ -0,0 +1,346 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const maxHeadersPerMsg = 2000                 // 每条headers消息最多包含的区块头数量
+const maxBlocksInFlightPerPeer = 16           // 每个节点同时下载的区块数量上限
+const blockDownloadTimeout = 20 * time.Second // 区块下载超时时间, 超时后向其他节点重新请求
+
+// 正在下载的区块请求
+// Peer			请求发往的节点
+// Deadline		超时时间
+type blockRequest struct {
+	Peer     string
+	Deadline time.Time
+}
+
+// 先同步区块头, 再从多个节点并行下载区块体
+// headers		已验证的区块头(哈希 -> 区块头), 只包含本地还没有的区块
+// pending		节点分多条消息发来、还没有接收完的区块头链(地址 -> 区块头链)
+// queue		待连接的区块哈希, 按高度升序排列
+// inFlight		正在下载的区块(哈希 -> 请求)
+// received		已下载但还不能连接的区块(哈希 -> 区块)
+// peers		可以提供区块下载的节点(地址 -> 正在下载的区块数)
+type syncManager struct {
+	node     *Node
+	mu       sync.Mutex
+	headers  map[string]*BlockHeader
+	pending  map[string]*headerChain
+	queue    [][]byte
+	inFlight map[string]*blockRequest
+	received map[string]*Block
+	peers    map[string]int
+}
+
+func newSyncManager(node *Node) *syncManager {
+	return &syncManager{
+		node:     node,
+		headers:  make(map[string]*BlockHeader),
+		pending:  make(map[string]*headerChain),
+		inFlight: make(map[string]*blockRequest),
+		received: make(map[string]*Block),
+		peers:    make(map[string]int),
+	}
+}
+
+// 已验证工作量证明和连接关系、但还没有比较累计工作量的区块头链
+// headers		按接收顺序排列的区块头
+// index		区块头哈希 -> 区块头
+type headerChain struct {
+	headers []*BlockHeader
+	index   map[string]*BlockHeader
+}
+
+func newHeaderChain() *headerChain {
+	return &headerChain{index: make(map[string]*BlockHeader)}
+}
+
+func (c *headerChain) add(header *BlockHeader) {
+	c.headers = append(c.headers, header)
+	c.index[hex.EncodeToString(header.Hash)] = header
+}
+
+// 处理某个节点发来的区块头
+// 验证区块头的工作量证明及连接关系; 一条消息装满时头链可能还没有结束, 保留已验证的区块头并继续向该节点请求,
+// 头链接收完后累计工作量超过本地主链时才开始下载区块体
+func (sm *syncManager) processHeaders(peer string, headers []BlockHeader) error {
+	bc := sm.node.bc
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	chain := sm.pending[peer]
+	if chain == nil {
+		chain = newHeaderChain()
+	}
+	// 头链中任何区块头无效时丢弃整条头链
+	delete(sm.pending, peer)
+	for i := range headers {
+		header := headers[i]
+		key := hex.EncodeToString(header.Hash)
+		if bc.HasBlock(header.Hash) || sm.headers[key] != nil || chain.index[key] != nil {
+			continue
+		}
+
+		prevHeight, err := sm.headerHeight(header.PrevHash, chain, bc)
+		if err != nil {
+			return err
+		}
+		if header.Height != prevHeight+1 {
+			return fmt.Errorf("header %x has height %d, expected %d", header.Hash, header.Height, prevHeight+1)
+		}
+		// 权益证明的验证者取决于父区块对应的质押分布, 父区块还没有下载时只验证哈希和签名, 连接区块时再完整验证
+		if err := bc.Engine().VerifyHeader(&header); err != nil && !errors.Is(err, ErrOrphanBlock) {
+			return fmt.Errorf("header %x: %w", header.Hash, err)
+		}
+		if err := bc.checkFutureTime(header.Hash, header.TimeStamp); err != nil {
+			return err
+		}
+		// 与检查点冲突的区块头不下载
+		if cp := bc.checkpoint(header.Height); cp != nil && !bytes.Equal(cp, header.Hash) {
+			return fmt.Errorf("header %x: %w at height %d", header.Hash, ErrCheckpointMismatch, header.Height)
+		}
+		chain.add(&header)
+	}
+
+	// 在更多区块头到达之前, 保留头链并继续向该节点请求, 头链接收完后再比较工作量
+	if len(headers) == maxHeadersPerMsg {
+		sm.pending[peer] = chain
+		last := headers[len(headers)-1].Hash
+		go sm.node.SendGetHeaders(peer, append([][]byte{last}, bc.GetBlockLocator()...))
+		return nil
+	}
+
+	accepted := chain.headers
+	if len(accepted) > 0 {
+		// 只需比较分叉点之后的部分: 头链从本地区块 parent 延伸出来, parent 也可能在本地的分叉上
+		best := accepted[len(accepted)-1]
+		branch, parent := sm.headerBranch(best, chain)
+		mainWork, forkWork, err := bc.forkWork(parent)
+		if err != nil {
+			return err
+		}
+		if forkWork.Add(forkWork, chainWork(branch)).Cmp(mainWork) <= 0 {
+			return fmt.Errorf("header chain ending at %x does not have more work than the local chain", best.Hash)
+		}
+	}
+
+	// 提供了有效区块头的节点都可以参与下载
+	if _, ok := sm.peers[peer]; !ok && (len(headers) > 0 || len(accepted) > 0) {
+		sm.peers[peer] = 0
+	}
+	if len(accepted) == 0 {
+		sm.schedule()
+		return nil
+	}
+
+	for _, header := range accepted {
+		sm.headers[hex.EncodeToString(header.Hash)] = header
+		sm.queue = append(sm.queue, header.Hash)
+	}
+	best := accepted[len(accepted)-1]
+	fmt.Printf("Accepted %d headers from %s, best height %d\n", len(accepted), peer, best.Height)
+
+	sm.schedule()
+
+	return nil
+}
+
+// 查找区块头的父区块高度, 父区块可以是正在接收的头链中的区块头、已验证的区块头或本地区块
+func (sm *syncManager) headerHeight(hash []byte, chain *headerChain, bc *BlockChain) (int, error) {
+	key := hex.EncodeToString(hash)
+	if header := chain.index[key]; header != nil {
+		return header.Height, nil
+	}
+	if header := sm.headers[key]; header != nil {
+		return header.Height, nil
+	}
+	block, err := bc.GetBlock(hash)
+	if err != nil {
+		return 0, fmt.Errorf("header parent %x is unknown", hash)
+	}
+
+	return block.Height, nil
+}
+
+// 从区块头 best 沿头链中的区块头和已验证的区块头向前回溯, 返回本地还没有的区块头和它们延伸的本地区块的哈希
+func (sm *syncManager) headerBranch(best *BlockHeader, chain *headerChain) ([]*BlockHeader, []byte) {
+	var branch []*BlockHeader
+	header := best
+	for {
+		branch = append(branch, header)
+		key := hex.EncodeToString(header.PrevHash)
+		prev := chain.index[key]
+		if prev == nil {
+			prev = sm.headers[key]
+		}
+		if prev == nil {
+			return branch, header.PrevHash
+		}
+		header = prev
+	}
+}
+
+// 将待下载的区块分配给下载数最少的节点
+// 调用者需持有 sm.mu
+func (sm *syncManager) schedule() {
+	for _, hash := range sm.queue {
+		key := hex.EncodeToString(hash)
+		if sm.inFlight[key] != nil || sm.received[key] != nil {
+			continue
+		}
+		peer := sm.pickPeer("")
+		if peer == "" {
+			return
+		}
+		sm.request(peer, hash)
+	}
+}
+
+// 选出正在下载区块数最少且未达到上限的节点, 跳过 exclude
+func (sm *syncManager) pickPeer(exclude string) string {
+	best := ""
+	for peer, count := range sm.peers {
+		if peer == exclude || count >= maxBlocksInFlightPerPeer {
+			continue
+		}
+		if best == "" || count < sm.peers[best] {
+			best = peer
+		}
+	}
+
+	return best
+}
+
+// 向节点请求区块并记录超时时间
+func (sm *syncManager) request(peer string, hash []byte) {
+	sm.inFlight[hex.EncodeToString(hash)] = &blockRequest{peer, time.Now().Add(blockDownloadTimeout)}
+	sm.peers[peer]++
+	go sm.node.SendGetData(peer, "block", hash)
+}
+
+// 处理下载到的区块, 返回该区块是否是同步过程中请求的区块
+// 按高度顺序连接所有已下载的区块, 全部完成后重建UTXO集
+func (sm *syncManager) processBlock(block *Block) bool {
+	bc := sm.node.bc
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	key := hex.EncodeToString(block.Hash)
+	header := sm.headers[key]
+	if header == nil {
+		return false
+	}
+	// 由区块内容重新计算区块头并验证哈希, 所有字段都必须与已验证的区块头相同
+	// 权益证明的父区块可能还没有连接, 此时只验证哈希和签名(ErrOrphanBlock)
+	blockHeader := block.Header()
+	if err := bc.Engine().VerifyHeader(&blockHeader); (err != nil && !errors.Is(err, ErrOrphanBlock)) || !blockHeader.equal(header) {
+		// 区块体与区块头不符, 交给其他节点重新下载
+		fmt.Printf("Block %x does not match its header\n", block.Hash)
+		sm.retry(key)
+		return true
+	}
+	if req := sm.inFlight[key]; req != nil {
+		sm.peers[req.Peer]--
+		delete(sm.inFlight, key)
+	}
+	sm.received[key] = block
+
+	// 按顺序连接已下载的区块
+	for len(sm.queue) > 0 {
+		next := hex.EncodeToString(sm.queue[0])
+		nextBlock := sm.received[next]
+		if nextBlock == nil {
+			break
+		}
+		if err := bc.AddBlock(nextBlock); err != nil {
+			fmt.Printf("Rejected block %x: %v\n", nextBlock.Hash, err)
+		} else {
+			fmt.Printf("Added block %x\n", nextBlock.Hash)
+			for _, orphan := range sm.node.orphanBlocks.connect(nextBlock, bc) {
+				fmt.Printf("Added orphan block %x\n", orphan.Hash)
+			}
+			sm.node.updateToTip()
+			sm.node.notifyMiner()
+		}
+		delete(sm.received, next)
+		delete(sm.headers, next)
+		sm.queue = sm.queue[1:]
+	}
+
+	if len(sm.queue) == 0 {
+		fmt.Println("Block download finished")
+	} else {
+		sm.schedule()
+	}
+
+	return true
+}
+
+// 向其他节点重新请求区块, 没有其他节点时仍向原节点请求
+// 调用者需持有 sm.mu
+func (sm *syncManager) retry(key string) {
+	hash, _ := hex.DecodeString(key)
+	exclude := ""
+	if req := sm.inFlight[key]; req != nil {
+		exclude = req.Peer
+		sm.peers[req.Peer]--
+		delete(sm.inFlight, key)
+	}
+
+	peer := sm.pickPeer(exclude)
+	if peer == "" {
+		peer = sm.pickPeer("")
+	}
+	if peer != "" {
+		sm.request(peer, hash)
+	}
+}
+
+// 节点不可用时停止向其下载, 重新分配其未完成的请求
+func (sm *syncManager) removePeer(peer string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	delete(sm.pending, peer)
+	if _, ok := sm.peers[peer]; !ok {
+		return
+	}
+	delete(sm.peers, peer)
+	for key, req := range sm.inFlight {
+		if req.Peer == peer {
+			delete(sm.inFlight, key)
+		}
+	}
+	sm.schedule()
+}
+
+// 定期检查下载超时的区块并重新请求, 直到 done 被关闭
+func (sm *syncManager) run(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-done:
+			return
+		case now = <-ticker.C:
+		}
+
+		sm.mu.Lock()
+		for key, req := range sm.inFlight {
+			if now.After(req.Deadline) {
+				fmt.Printf("Block %s from %s timed out, requesting again\n", key, req.Peer)
+				sm.retry(key)
+			}
+		}
+		sm.mu.Unlock()
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"math/big"
 	"strings"
 )
@@ -44,6 +43,23 @@ func (tx *Transaction) Hash() []byte {
 	return hash[:]
 }
 
+// 去掉输入中的签名后的交易哈希, 交易ID在签名之前计算, 因此应与它相等
+func (tx *Transaction) unsignedHash() []byte {
+	txCopy := *tx
+	txCopy.Vin = make([]TXInput, len(tx.Vin))
+	for i, vin := range tx.Vin {
+		vin.Signature = nil
+		txCopy.Vin[i] = vin
+	}
+
+	return txCopy.Hash()
+}
+
+// 检查交易ID是否等于交易内容的哈希, 区块的 Merkle 根由交易ID计算, ID 必须与内容对应
+func (tx *Transaction) validID() bool {
+	return bytes.Equal(tx.ID, tx.unsignedHash())
+}
+
 // 创建创世块时最早的交易(输出)
 func NewCoinbaseTX(to, data string) *Transaction {
 	if data == "" {
@@ -56,7 +72,7 @@ func NewCoinbaseTX(to, data string) *Transaction {
 		data = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TXInput{[]byte{}, -1, nil, []byte(data)} // 没有输入
+	txin := TXInput{[]byte{}, -1, nil, []byte(data), SequenceFinal} // 没有输入
 	txout := NewTXOutput(subsidy, to)
 	tx := Transaction{nil, []TXInput{txin}, []TXOutput{*txout}}
 	tx.ID = tx.Hash()
@@ -91,32 +107,121 @@ func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].Txid) == 0 && tx.Vin[0].Vout == -1
 }
 
-func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet) (*Transaction, error) {
+// SetExtraNonce 将 extra-nonce 写入 coinbase 交易并重新计算交易ID
+// coinbase 交易的输入没有签名, extra-nonce 存放在 Signature 字段中
+func (tx *Transaction) SetExtraNonce(extraNonce int) {
+	tx.Vin[0].Signature = IntToHex(int64(extraNonce))
+	tx.ID = tx.Hash()
+}
+
+// 只要有一个输入的 Sequence 不大于 MaxRBFSequence, 交易就允许在内存池中被替换
+func (tx *Transaction) SignalsReplacement() bool {
+	for _, vin := range tx.Vin {
+		if vin.Sequence <= MaxRBFSequence {
+			return true
+		}
+	}
+
+	return false
+}
+
+// 创建替换 orig 的交易, 花费相同的输入, 从 wallet 的找零中多扣除手续费, 使总手续费变为 fee
+// prevTXs 为 orig 的输入引用的前序交易
+func BumpFee(wallet *Wallet, orig *Transaction, fee int, prevTXs map[string]Transaction) (*Transaction, error) {
+	if !orig.SignalsReplacement() {
+		return nil, fmt.Errorf("ERROR: Transaction %x is not replaceable", orig.ID)
+	}
+
+	inputValue := 0
+	var inputs []TXInput
+	for _, vin := range orig.Vin {
+		prevTx, ok := prevTXs[hex.EncodeToString(vin.Txid)]
+		if !ok || vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			return nil, fmt.Errorf("ERROR: Previous transaction %x is not found", vin.Txid)
+		}
+		inputValue += prevTx.Vout[vin.Vout].Value
+		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, wallet.PublicKey, vin.Sequence})
+	}
+	outputValue := 0
+	for _, out := range orig.Vout {
+		outputValue += out.Value
+	}
+	extra := fee - (inputValue - outputValue)
+	if extra <= 0 {
+		return nil, fmt.Errorf("ERROR: New fee must be higher than the current fee %d", inputValue-outputValue)
+	}
+
+	// 找零是最后一个支付给 wallet 的非质押输出
+	outputs := append([]TXOutput{}, orig.Vout...)
+	change := -1
+	pubKeyHash := HashPubKey(wallet.PublicKey)
+	for i := range outputs {
+		if outputs[i].IsLockedWithKey(pubKeyHash) && !outputs[i].Stake {
+			change = i
+		}
+	}
+	if change == -1 || outputs[change].Value < extra {
+		return nil, fmt.Errorf("ERROR: Not enough change to pay the new fee")
+	}
+	outputs[change].Value -= extra
+	if outputs[change].Value == 0 {
+		outputs = append(outputs[:change], outputs[change+1:]...)
+	}
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("ERROR: Not enough change to pay the new fee")
+	}
+
+	tx := Transaction{nil, inputs, outputs}
+	tx.ID = tx.Hash()
+	tx.Sign(wallet.PrivateKey, prevTXs)
+
+	return &tx, nil
+}
+
+// 创建从 wallet 向 to 转账 amount 的交易, 输入总额减去 amount 和手续费 fee 后的余额找零给 wallet
+// replaceable 为 true 时交易允许被 BumpFee 创建的交易替换
+func NewUTXOTransaction(wallet *Wallet, to string, amount, fee int, replaceable bool, UTXOSet *UTXOSet) (*Transaction, error) {
+	return newTransaction(wallet, NewTXOutput(amount, to), fee, replaceable, UTXOSet)
+}
+
+// 创建 wallet 质押 amount 的交易, 质押输出属于 wallet, 在权益证明中计入 wallet 的权重
+func NewStakeTransaction(wallet *Wallet, amount, fee int, UTXOSet *UTXOSet) (*Transaction, error) {
+	return newTransaction(wallet, NewStakeTXOutput(amount, string(wallet.GetAddress())), fee, false, UTXOSet)
+}
+
+// 创建花费 wallet 的输出、支付 output 和手续费 fee 的交易, 余额找零给 wallet
+func newTransaction(wallet *Wallet, output *TXOutput, fee int, replaceable bool, UTXOSet *UTXOSet) (*Transaction, error) {
 	var inputs []TXInput
 	var outputs []TXOutput
+	amount := output.Value
 
 	pubKeyHash := HashPubKey(wallet.PublicKey)
-	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
-	if acc < amount {
+	acc, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount+fee)
+	if acc < amount+fee {
 		return nil, fmt.Errorf("ERROR: Not enough funds")
 	}
 
+	sequence := SequenceFinal
+	if replaceable {
+		sequence = MaxRBFSequence
+	}
+
 	// Build a list of inputs
 	for txid, outs := range validOutputs {
 		txID, _ := hex.DecodeString(txid)
 
 		for _, out := range outs {
-			input := TXInput{txID, out, nil, wallet.PublicKey}
+			input := TXInput{txID, out, nil, wallet.PublicKey, sequence}
 			inputs = append(inputs, input)
 		}
 	}
 
 	// 输出到接收方
-	outputs = append(outputs, *NewTXOutput(amount, to))
+	outputs = append(outputs, *output)
 	// 找零
 	from := fmt.Sprintf("%s", wallet.GetAddress())
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc - amount, from))
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from))
 	}
 
 	tx := Transaction{nil, inputs, outputs}
@@ -126,7 +231,6 @@ func NewUTXOTransaction(wallet *Wallet, to string, amount int, UTXOSet *UTXOSet)
 	return &tx, nil
 }
 
-
 // 生成当前交易的精简副本（Trimmed Copy），用于后续的签名过程。
 // 签名需要基于交易的核心信息（如输入引用的前序交易、输出金额等），但不需要包含现有签名或公钥（这些是待生成或临时的信息）。
 func (tx *Transaction) TrimmedCopy() Transaction {
@@ -134,11 +238,11 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var outputs []TXOutput
 
 	for _, vin := range tx.Vin {
-		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, nil})
+		inputs = append(inputs, TXInput{vin.Txid, vin.Vout, nil, nil, vin.Sequence})
 	}
 
 	for _, vout := range tx.Vout {
-		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash})
+		outputs = append(outputs, TXOutput{vout.Value, vout.PubKeyHash, vout.Stake})
 	}
 
 	txCopy := Transaction{tx.ID, inputs, outputs}
@@ -167,7 +271,8 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 		if err != nil {
 			panic(err)
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
+		// r 和 s 各占 32 字节, 验证时从中间拆分; 不补齐时 r 或 s 以 0 开头的签名会被拆错而无法通过验证
+		signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
 
 		tx.Vin[inID].Signature = signature
 		txCopy.Vin[inID].PubKey = nil
@@ -180,6 +285,14 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 
 	for inID, vin := range tx.Vin {
 		prevTx := prevTXs[hex.EncodeToString(vin.Txid)]
+		// 前序交易不存在或引用的输出越界时, 交易无效
+		if vin.Vout < 0 || vin.Vout >= len(prevTx.Vout) {
+			return false
+		}
+		// 签名的公钥必须属于被花费输出的所有者, 否则任何人都可以用自己的私钥花费他人的输出
+		if !prevTx.Vout[vin.Vout].IsLockedWithKey(HashPubKey(vin.PubKey)) {
+			return false
+		}
 		txCopy.Vin[inID].Signature = nil
 		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.Vout].PubKeyHash
 
@@ -196,7 +309,7 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		y.SetBytes(vin.PubKey[(keyLen / 2):])
 
 		dataToVerify := fmt.Sprintf("%x\n", txCopy)
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
+		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
 
 		// 校验：使用公钥rawPubKey，验证签名(r,s)是否对应txCopy.ID（签名时的交易哈希）
 		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
@@ -208,14 +321,15 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	return true
 }
 
-func DeserializeTransaction(data []byte) Transaction {
+// DeserializeTransaction 解码 Serialize 得到的交易数据, 数据无效时返回错误
+func DeserializeTransaction(data []byte) (Transaction, error) {
 	var transaction Transaction
 
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 	err := decoder.Decode(&transaction)
 	if err != nil {
-		log.Panic(err)
+		return Transaction{}, fmt.Errorf("failed to decode transaction: %w", err)
 	}
 
-	return transaction
-}
\ No newline at end of file
+	return transaction, nil
+}
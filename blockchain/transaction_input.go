@@ -7,13 +7,18 @@ import "bytes"
 // Vout: 一笔交易可能有多个输出，Vout 为输出的索引
 // Signature: 提供解锁输出 Txid:Vout 的数据
 // PubKey: 交易输入的公钥
+// Sequence: 不大于 MaxRBFSequence 时表示交易允许被支付更高手续费的冲突交易替换
 type TXInput struct {
 	Txid      []byte
 	Vout      int
 	Signature []byte
 	PubKey    []byte
+	Sequence  uint32
 }
 
+const SequenceFinal uint32 = 0xffffffff  // 不允许替换的输入
+const MaxRBFSequence uint32 = 0xfffffffd // 允许替换的输入的最大 Sequence
+
 // 验证输入是否属于某个公钥哈希
 func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
 	lockingHash := HashPubKey(in.PubKey)
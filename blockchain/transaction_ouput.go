@@ -9,9 +9,11 @@ import (
 // TXOutput 包含两部分
 // Value: 有多少币，就是存储在 Value 里面
 // PubKeyHash: 锁定该输出的公钥哈希（只有拥有对应私钥的人才能解锁）
+// Stake: 质押输出, 金额计入所有者在权益证明中的权重, 不能被花费
 type TXOutput struct {
 	Value        int
 	PubKeyHash   []byte
+	Stake        bool
 }
 
 type TXOutputs struct {
@@ -32,12 +34,20 @@ func (out *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
 
 // 创建一个新的TXOutput
 func NewTXOutput(value int, address string) *TXOutput {
-	txo := &TXOutput{value, nil}
+	txo := &TXOutput{value, nil, false}
 	txo.Lock([]byte(address))
 
 	return txo
 }
 
+// 创建一个质押给 address 的输出
+func NewStakeTXOutput(value int, address string) *TXOutput {
+	txo := NewTXOutput(value, address)
+	txo.Stake = true
+
+	return txo
+}
+
 func (outs TXOutputs) Serialize() []byte {
 	var buff bytes.Buffer
 
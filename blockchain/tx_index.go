@@ -0,0 +1,98 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+const txIndexBucket = "txindex" // 交易ID -> 交易在主链中的位置
+
+// TxLocation 是交易在主链中的位置
+// BlockHash	包含交易的区块哈希
+// Position		交易在区块中的序号
+type TxLocation struct {
+	BlockHash []byte
+	Position  int
+}
+
+// 交易索引, 记录主链上每笔交易所在的区块和序号, 使按交易ID查找交易不需要遍历区块链
+type txIndex struct{}
+
+func newTxIndex() chainIndex {
+	return txIndex{}
+}
+
+func (txIndex) name() string {
+	return txIndexBucket
+}
+
+func (txIndex) connectBlock(tx StoreTx, block *Block) error {
+	for i, t := range block.Transactions {
+		if err := tx.IndexPut(txIndexBucket, t.ID, gobEncode(TxLocation{block.Hash, i})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (txIndex) disconnectBlock(tx StoreTx, block *Block) error {
+	for _, t := range block.Transactions {
+		if err := tx.IndexDelete(txIndexBucket, t.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnableTxIndex 启用交易索引, 之后 FindTransaction 直接通过索引查找交易
+// 第一次启用时根据主链建立索引, 启用后在数据库中保持启用, 之后打开区块链时自动启用
+func (bc *BlockChain) EnableTxIndex() error {
+	return bc.enableIndex(newTxIndex())
+}
+
+// TxIndexEnabled 检查交易索引是否已启用
+func (bc *BlockChain) TxIndexEnabled() bool {
+	return bc.indexEnabled(txIndexBucket)
+}
+
+// LocateTransaction 通过交易索引查找交易在主链中的位置, 交易不在主链上时返回 false
+// 交易索引未启用时返回错误
+func (bc *BlockChain) LocateTransaction(ID []byte) (TxLocation, bool, error) {
+	var loc TxLocation
+	if !bc.TxIndexEnabled() {
+		return loc, false, fmt.Errorf("transaction index is not enabled")
+	}
+
+	var data []byte
+	if err := bc.store.View(func(tx StoreTx) error {
+		data = tx.IndexGet(txIndexBucket, ID)
+		return nil
+	}); err != nil {
+		return loc, false, err
+	}
+	if data == nil {
+		return loc, false, nil
+	}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&loc)
+	return loc, err == nil, err
+}
+
+// 通过交易索引查找交易
+func (bc *BlockChain) findIndexedTransaction(ID []byte) (Transaction, error) {
+	loc, found, err := bc.LocateTransaction(ID)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if !found {
+		return Transaction{}, fmt.Errorf("transaction %x is not found", ID)
+	}
+	block, err := bc.GetBlock(loc.BlockHash)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if loc.Position >= len(block.Transactions) || !bytes.Equal(block.Transactions[loc.Position].ID, ID) {
+		return Transaction{}, fmt.Errorf("transaction index is inconsistent at %x", ID)
+	}
+	return *block.Transactions[loc.Position], nil
+}
@@ -0,0 +1,59 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestTxIndex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxIndex(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 3)
+	address := string(wallet.GetAddress())
+	block := mainChainBlock(t, bc, 2)
+	txid := block.Transactions[0].ID
+
+	_, _, err := bc.LocateTransaction(txid)
+	assert.Error(t, err, "Index is not enabled")
+
+	// 第一次启用时根据主链建立索引
+	assert.NoError(t, bc.EnableTxIndex())
+	assert.True(t, bc.TxIndexEnabled())
+	loc, found, err := bc.LocateTransaction(txid)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, TxLocation{block.Hash, 0}, loc)
+	tx, err := bc.FindTransaction(txid)
+	assert.NoError(t, err)
+	assert.Equal(t, txid, tx.ID)
+
+	// 新区块加入主链时更新索引
+	mined := bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+	_, found, _ = bc.LocateTransaction(mined.Transactions[0].ID)
+	assert.True(t, found)
+
+	// 重组时移出主链的区块从索引中删除, 新分叉上的区块加入索引
+	fork := newTestFork(t, bc, block, 3, address)
+	for _, b := range fork {
+		assert.NoError(t, bc.AddBlock(b))
+	}
+	assert.Equal(t, fork[2].Hash, bc.Tip())
+	_, found, _ = bc.LocateTransaction(mined.Transactions[0].ID)
+	assert.False(t, found)
+	_, err = bc.FindTransaction(mined.Transactions[0].ID)
+	assert.Error(t, err)
+	for _, b := range fork {
+		loc, found, _ := bc.LocateTransaction(b.Transactions[0].ID)
+		assert.True(t, found)
+		assert.Equal(t, b.Hash, loc.BlockHash)
+	}
+
+	// 重新打开区块链时索引保持启用
+	reopened, err := NewBlockChainWithStore(bc.store)
+	assert.NoError(t, err)
+	assert.True(t, reopened.TxIndexEnabled())
+	_, found, _ = reopened.LocateTransaction(fork[0].Transactions[0].ID)
+	assert.True(t, found)
+}
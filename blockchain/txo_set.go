@@ -1,43 +1,79 @@
 package blockchain
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
 	"encoding/hex"
+	"fmt"
 	"log"
-
-	"github.com/boltdb/bolt"
 )
 
-const utxoBucket = "chainstate"// BoltDB中存储UTXO的桶名称(表)
+const utxoBucket = "chainstate"// 存储UTXO的桶名称(表), 键为交易ID + 输出序号
+const utxoUndoBucket = "utxoundo" // 区块哈希 -> 区块花费的 UTXO, 用于从 UTXO 集中撤销区块
 
 // unspent transaction output set
 type UTXOSet struct {
 	Blockchain *BlockChain// 关联的区块链实例，用于获取全链数据
 }
 
+// UTXOEntry 是 UTXO 集中的一个未花费输出
+// Output		输出本身(金额、锁定输出的公钥哈希、是否质押)
+// Height		创建该输出的交易所在区块的高度
+// Coinbase		创建该输出的交易是否为 coinbase 交易
+type UTXOEntry struct {
+	Output   TXOutput
+	Height   int
+	Coinbase bool
+}
+
+func (entry UTXOEntry) Serialize() []byte {
+	return gobEncode(entry)
+}
+
+func DeserializeUTXOEntry(data []byte) (UTXOEntry, error) {
+	var entry UTXOEntry
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry)
+	return entry, err
+}
+
+// 区块花费的一个 UTXO, 撤销区块时放回 UTXO 集
+type spentUTXO struct {
+	Txid  []byte
+	Vout  int
+	Entry UTXOEntry
+}
+
+// UTXO 的键, 交易ID之后是大端序的输出序号, 同一交易的输出排列在一起
+func utxoKey(txid []byte, vout int) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte{}, txid...), uint32(vout))
+}
+
+// 解析 UTXO 的键
+func parseUTXOKey(key []byte) ([]byte, int, bool) {
+	if len(key) <= 4 {
+		return nil, 0, false
+	}
+	n := len(key) - 4
+	return append([]byte{}, key[:n]...), int(binary.BigEndian.Uint32(key[n:])), true
+}
+
 // 根据公钥哈希（对应一个地址）和目标金额，找到足够支付该金额的 UTXO，并返回累计金额和这些 UTXO 的位置（交易 ID + 输出索引）
 func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[string][]int) {
 	unspentOutputs := make(map[string][]int)
 	accumulated := 0
-	db := u.Blockchain.db
-
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor() // 创建游标，用于遍历桶中所有数据
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			txID := hex.EncodeToString(k)// 交易ID转为字符串
-			outs := DeserializeOutputs(v)// 反序列化，将字节流转为TXOutputs
-
-			// 遍历当前交易的所有输出
-			for outIdx, out := range outs.Outputs {
-				// 检查输出是否属于该pubHash(地址)，且累计金额未达目标
-				if out.IsLockedWithKey(pubkeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-				}
-			}
-		}
 
+	// 按交易ID和输出序号遍历UTXO集中的所有数据
+	err := u.forEach(func(k []byte, outIdx int, entry UTXOEntry) error {
+		txID := hex.EncodeToString(k)// 交易ID转为字符串
+		out := entry.Output
+
+		// 检查输出是否属于该pubHash(地址)，且累计金额未达目标
+		// 质押输出不能被花费
+		if out.IsLockedWithKey(pubkeyHash) && !out.Stake && accumulated < amount {
+			accumulated += out.Value
+			unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
+		}
 		return nil
 	})
 	if err != nil {
@@ -50,22 +86,11 @@ func (u UTXOSet) FindSpendableOutputs(pubkeyHash []byte, amount int) (int, map[s
 // 根据公钥哈希（地址），直接从 UTXO 集查询该地址所有的未花费交易输出（UTXO), 用于计算余额（余额 = 所有 UTXO 的 value 之和）
 func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	var UTXOs []TXOutput
-	db := u.Blockchain.db
-
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			outs := DeserializeOutputs(v)
 
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
-			}
+	err := u.forEach(func(_ []byte, _ int, entry UTXOEntry) error {
+		if entry.Output.IsLockedWithKey(pubKeyHash) {
+			UTXOs = append(UTXOs, entry.Output)
 		}
-
 		return nil
 	})
 	if err != nil {
@@ -75,133 +100,144 @@ func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
 	return UTXOs
 }
 
-// 统计 UTXO 集中包含多少笔交易（每笔交易可能有多个 UTXO）
-func (u UTXOSet) CountTransactions() int {
-	db := u.Blockchain.db
-	counter := 0
+// 在 UTXO 集中查找交易 txid 的第 vout 个未花费输出, 不存在(或已花费)时返回 false
+func (u UTXOSet) FindOutput(txid []byte, vout int) (TXOutput, bool) {
+	entry, found := u.FindEntry(txid, vout)
+	return entry.Output, found
+}
 
-	err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-		c := b.Cursor()
+// FindEntry 在 UTXO 集中查找交易 txid 的第 vout 个未花费输出, 同时返回创建它的区块高度和是否为 coinbase 输出
+func (u UTXOSet) FindEntry(txid []byte, vout int) (UTXOEntry, bool) {
+	c := u.Blockchain.utxo
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		// 遍历桶中所有键（每个键对应一笔交易），每有一个键则计数+1
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			counter++
-		}
+	entry, found, err := c.get(string(utxoKey(txid, vout)))
+	if err != nil {
+		log.Panic(err)
+	}
 
+	return entry, found
+}
+
+// StakeDistribution 返回 UTXO 集中的质押分布(公钥哈希的十六进制 -> 质押总额)
+func (u UTXOSet) StakeDistribution() map[string]int {
+	stakes := make(map[string]int)
+
+	err := u.forEach(func(_ []byte, _ int, entry UTXOEntry) error {
+		if out := entry.Output; out.Stake {
+			stakes[hex.EncodeToString(out.PubKeyHash)] += out.Value
+		}
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
 
-	return counter
+	return stakes
 }
 
-// 当 UTXO 集损坏或需要与区块链同步时，从区块链全量数据重建 UTXO 集
-func (u UTXOSet) Reindex() {
-	db := u.Blockchain.db
-	bucketName := []byte(utxoBucket)
-
-	// 第一步：删除旧的UTXO桶并创建新桶
-	err := db.Update(func(tx *bolt.Tx) error {
-		err := tx.DeleteBucket(bucketName)
-		if err != nil && err != bolt.ErrBucketNotFound {
-			log.Panic(err)
-		}
+// 统计 UTXO 集中包含多少笔交易（每笔交易可能有多个 UTXO）
+func (u UTXOSet) CountTransactions() int {
+	counter := 0
 
-		_, err = tx.CreateBucket(bucketName)
-		if err != nil {
-			log.Panic(err)
+	// 同一交易的输出排列在一起，每遇到一个新的交易ID则计数+1
+	var last []byte
+	err := u.forEach(func(txid []byte, _ int, _ UTXOEntry) error {
+		if !bytes.Equal(txid, last) {
+			counter++
+			last = txid
 		}
-
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
 
-	// 第二步：从区块链中获取当前所有UTXO
-	UTXO := u.Blockchain.FindUTXO()
+	return counter
+}
 
-	// 第三步：将UTXO写入新桶
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(bucketName)
+// 遍历 UTXO 集, 包括缓存中还没有写入存储的修改
+func (u UTXOSet) forEach(fn func(txid []byte, vout int, entry UTXOEntry) error) error {
+	c := u.Blockchain.utxo
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		for txID, outs := range UTXO {
-			key, err := hex.DecodeString(txID)
-			if err != nil {
-				log.Panic(err)
-			}
+	return c.forEach(fn)
+}
 
-			err = b.Put(key, outs.Serialize())
-			if err != nil {
-				log.Panic(err)
-			}
-		}
+// 当 UTXO 集损坏或需要与区块链同步时，从区块链全量数据重建 UTXO 集
+// 清空 UTXO 集后从创世块开始依次应用主链上的区块, 完成后写入存储
+func (u UTXOSet) Reindex() {
+	c := u.Blockchain.utxo
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		return nil
-	})
+	if err := c.reset(); err != nil {
+		log.Panic(err)
+	}
+	if err := c.updateToTip(); err != nil {
+		log.Panic(err)
+	}
+	if err := c.flush(); err != nil {
+		log.Panic(err)
+	}
+}
+
+// UpdateToTip 将 UTXO 集更新到区块链的最新区块: 撤销重组后不在主链上的区块, 再依次应用新的主链区块
+// 修改保存在缓存中, 缓存超过内存上限或距离上次写入的时间过长时写入存储
+func (u UTXOSet) UpdateToTip() error {
+	c := u.Blockchain.utxo
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.updateToTip()
 }
 
 // 当一个新块被添加到区块链时，更新 UTXO 集（移除被消耗的 UTXO，添加新产生的 UTXO）
+// block 必须延伸 UTXO 集对应的最新区块
 func (u UTXOSet) Update(block *Block) {
-	db := u.Blockchain.db
-
-	err := db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(utxoBucket))
-
-		// 遍历区块中的所有交易
-		for _, tx := range block.Transactions {
-			// 处理非coinbase交易（coinbase交易没有输入，不需要消耗UTXO）
-			if tx.IsCoinbase() == false {
-				// 遍历交易的所有输入（Vin），这些输入引用了之前的UTXO，需要将其从UTXO集中移除
-				for _, vin := range tx.Vin {
-					updatedOuts := TXOutputs{} // 存储剩余的未花费输出
-					// 根据输入引用的交易ID，从UTXO集中获取对应的输出列表
-					outsBytes := b.Get(vin.Txid)
-					outs := DeserializeOutputs(outsBytes)
-
-					// 遍历该交易的所有输出，保留未被当前输入引用的输出
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.Vout {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-
-					// 如果剩余输出为空，则删除该交易的UTXO记录；否则更新记录
-					if len(updatedOuts.Outputs) == 0 {
-						err := b.Delete(vin.Txid)
-						if err != nil {
-							log.Panic(err)
-						}
-					} else {
-						// 序列化剩余输出并更新到数据库
-						err := b.Put(vin.Txid, updatedOuts.Serialize())
-						if err != nil {
-							log.Panic(err)
-						}
-					}
-
-				}
-			}
-
-			// 处理当前交易的输出（Vout），将其作为新的UTXO加入集合
-			newOutputs := TXOutputs{}
-			for _, out := range tx.Vout {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
-			}
-
-			// 将新输出序列化后存入UTXO集（键：当前交易ID；值：新输出列表）
-			err := b.Put(tx.ID, newOutputs.Serialize())
-			if err != nil {
-				log.Panic(err)
-			}
-		}
+	c := u.Blockchain.utxo
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		return nil
-	})
-	if err != nil {
+	if err := c.connect(block); err != nil {
+		log.Panic(err)
+	}
+	if err := c.maybeFlush(); err != nil {
 		log.Panic(err)
 	}
-}
\ No newline at end of file
+}
+
+// Undo 从 UTXO 集中撤销 block: 移除区块创建的 UTXO, 放回区块花费的 UTXO
+// block 必须是最后一个应用到 UTXO 集的区块
+func (u UTXOSet) Undo(block *Block) error {
+	c := u.Blockchain.utxo
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.disconnect(block); err != nil {
+		return err
+	}
+	return c.maybeFlush()
+}
+
+// Flush 将 UTXO 缓存中的修改写入存储, 关闭区块链时自动调用
+func (u UTXOSet) Flush() error {
+	c := u.Blockchain.utxo
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.flush()
+}
+
+// 检查 UTXO 集是否为旧版本以交易ID为键的格式, 旧格式需要重建
+func utxoOutdated(store ChainStore) bool {
+	errFirst := fmt.Errorf("first entry")
+	err := store.View(func(tx StoreTx) error {
+		return tx.ForEachUTXO(func(_ []byte, _ int, _ UTXOEntry) error {
+			return errFirst
+		})
+	})
+	return err != nil && err != errFirst
+}
@@ -0,0 +1,80 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestUTXOSet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUTXOSetOutpoints(t *testing.T) {
+	bc, alice := newTestBlockChain(t, 1)
+	bob, carol := NewWallet(), NewWallet()
+	utxo := UTXOSet{bc}
+
+	// 第 0 个输出付给 bob, 第 1 个输出是找零
+	spend := spendTx(alice, genesisCoinbase(bc), 0, string(bob.GetAddress()), 4, 1)
+	block := bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), ""), spend})
+	utxo.Update(block)
+
+	_, found := utxo.FindEntry(genesisCoinbase(bc).ID, 0)
+	assert.False(t, found, "Spent output leaves the UTXO set")
+	entry, found := utxo.FindEntry(block.Transactions[0].ID, 0)
+	assert.True(t, found)
+	assert.Equal(t, UTXOEntry{block.Transactions[0].Vout[0], 2, true}, entry)
+
+	// 花费第 0 个输出之后, 找零仍然是第 1 个输出
+	next := spendTx(bob, spend, 0, string(carol.GetAddress()), 4, 0)
+	nextBlock := bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), ""), next})
+	utxo.Update(nextBlock)
+	_, found = utxo.FindEntry(spend.ID, 0)
+	assert.False(t, found)
+	entry, found = utxo.FindEntry(spend.ID, 1)
+	assert.True(t, found)
+	assert.Equal(t, UTXOEntry{spend.Vout[1], 2, false}, entry)
+	entry, found = utxo.FindEntry(next.ID, 0)
+	assert.True(t, found)
+	assert.Equal(t, 3, entry.Height)
+	assert.Equal(t, 5, utxo.CountTransactions())
+
+	// 撤销区块后恢复花费的输出, 移除区块创建的输出
+	assert.NoError(t, utxo.Undo(nextBlock))
+	entry, found = utxo.FindEntry(spend.ID, 0)
+	assert.True(t, found)
+	assert.Equal(t, UTXOEntry{spend.Vout[0], 2, false}, entry)
+	_, found = utxo.FindEntry(next.ID, 0)
+	assert.False(t, found)
+	assert.Error(t, utxo.Undo(nextBlock), "Undo data is consumed")
+
+	// 重新应用区块与重建的结果相同
+	utxo.Update(nextBlock)
+	before := utxo.FindUTXO(HashPubKey(alice.PublicKey))
+	utxo.Reindex()
+	assert.ElementsMatch(t, before, utxo.FindUTXO(HashPubKey(alice.PublicKey)))
+	assert.NoError(t, utxo.Undo(nextBlock), "Reindex records undo data")
+}
+
+func TestUTXOSetUpgrade(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 2)
+	coinbase := genesisCoinbase(bc)
+
+	// 旧版本的 UTXO 集以交易ID为键, 值为交易的所有未花费输出
+	assert.NoError(t, bc.store.Update(func(tx StoreTx) error {
+		if err := tx.ResetUTXO(); err != nil {
+			return err
+		}
+		return tx.IndexPut(utxoBucket, coinbase.ID, TXOutputs{coinbase.Vout}.Serialize())
+	}))
+	assert.True(t, utxoOutdated(bc.store))
+
+	reopened, err := NewBlockChainWithStore(bc.store)
+	assert.NoError(t, err)
+	assert.False(t, utxoOutdated(reopened.store))
+	assert.Equal(t, 3, UTXOSet{reopened}.CountTransactions())
+	entry, found := UTXOSet{reopened}.FindEntry(coinbase.ID, 0)
+	assert.True(t, found)
+	assert.Equal(t, UTXOEntry{coinbase.Vout[0], 0, true}, entry)
+	assert.Len(t, UTXOSet{reopened}.FindUTXO(HashPubKey(wallet.PublicKey)), 3)
+}
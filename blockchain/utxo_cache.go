@@ -0,0 +1,499 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const utxoFlushInterval = time.Minute // 距离上次刷新超过该时间后, 应用下一个区块时刷新缓存
+const utxoCacheEntryOverhead = 128    // 估算缓存占用的内存时, 每条记录除键和公钥哈希以外的开销(字节)
+
+// DefaultUTXOCacheSize 是 UTXO 缓存默认的内存上限(字节)
+const DefaultUTXOCacheSize = 32 << 20
+
+// UTXO 缓存中的一条记录
+// entry	输出的 UTXO 记录
+// spent	输出已被花费或不存在, 未命中的查询也会缓存, 避免重复读取存储
+// dirty	记录还没有写入存储
+type cachedUTXO struct {
+	entry UTXOEntry
+	spent bool
+	dirty bool
+}
+
+// UTXO 集的写回缓存, 区块对 UTXO 集的修改先保存在内存中, 之后一次性写入存储
+// 每次刷新在一个事务中写入修改过的记录、撤销数据和缓存对应的最新区块, 存储中的 UTXO 集总是与某个区块一致,
+// 程序异常退出后从存储中记录的区块开始重新应用之后的主链区块
+// entries		UTXO 的键 -> 缓存的记录
+// undo			区块哈希 -> 还没有写入存储的撤销数据, nil 表示从存储中删除
+// tip			缓存对应的最新区块, 为 nil 时 UTXO 集为空
+// flushedTip	存储中的 UTXO 集对应的最新区块
+// size			缓存占用内存的估计值, 超过 maxSize 时刷新并清空缓存
+// mu 保护以上所有字段, 查询和修改 UTXO 集都需要持有
+type utxoCache struct {
+	store ChainStore
+
+	mu         sync.Mutex
+	entries    map[string]*cachedUTXO
+	undo       map[string][]byte
+	tip        []byte
+	flushedTip []byte
+	size       int
+	maxSize    int
+	lastFlush  time.Time
+}
+
+func newUTXOCache(store ChainStore) *utxoCache {
+	return &utxoCache{
+		store:     store,
+		entries:   make(map[string]*cachedUTXO),
+		undo:      make(map[string][]byte),
+		maxSize:   DefaultUTXOCacheSize,
+		lastFlush: time.Now(),
+	}
+}
+
+// 读取存储中的 UTXO 集对应的区块
+// 没有记录(之前的版本创建的数据库)或 UTXO 集为旧版本的格式时清空 UTXO 集, 之后从创世块开始重建
+func (c *utxoCache) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var tip []byte
+	if err := c.store.View(func(tx StoreTx) error {
+		tip = tx.IndexGet(indexTipsBucket, []byte(utxoBucket))
+		return nil
+	}); err != nil {
+		return err
+	}
+	outdated := utxoOutdated(c.store)
+	if outdated {
+		fmt.Println("Rebuilding UTXO set in the per-output format...")
+	}
+	if tip == nil || outdated {
+		return c.reset()
+	}
+	c.tip, c.flushedTip = tip, tip
+	return nil
+}
+
+// 清空存储和缓存中的 UTXO 集
+func (c *utxoCache) reset() error {
+	err := c.store.Update(func(tx StoreTx) error {
+		if err := tx.ResetUTXO(); err != nil {
+			return err
+		}
+		if err := tx.DropIndex(utxoUndoBucket); err != nil {
+			return err
+		}
+		return tx.IndexDelete(indexTipsBucket, []byte(utxoBucket))
+	})
+	if err != nil {
+		return err
+	}
+	c.tip, c.flushedTip = nil, nil
+	c.discard()
+	return nil
+}
+
+// 丢弃缓存中的全部记录, 包括还没有写入存储的修改, 缓存回到存储中的状态
+func (c *utxoCache) discard() {
+	c.entries = make(map[string]*cachedUTXO)
+	c.undo = make(map[string][]byte)
+	c.tip = c.flushedTip
+	c.size = 0
+}
+
+// 查询 UTXO, 缓存未命中时从存储读取并加入缓存
+func (c *utxoCache) get(key string) (UTXOEntry, bool, error) {
+	if cached, ok := c.entries[key]; ok {
+		return cached.entry, !cached.spent, nil
+	}
+
+	var entry UTXOEntry
+	found := false
+	if err := c.store.View(func(tx StoreTx) error {
+		txid, vout, _ := parseUTXOKey([]byte(key))
+		entry, found = tx.UTXO(txid, vout)
+		return nil
+	}); err != nil {
+		return entry, false, err
+	}
+	c.entries[key] = &cachedUTXO{entry: entry, spent: !found}
+	c.size += cachedSize(key, entry)
+	return entry, found, nil
+}
+
+// 在缓存中添加(entry 不为 nil)或花费(entry 为 nil)一个 UTXO
+func (c *utxoCache) set(key string, entry *UTXOEntry) {
+	if cached, ok := c.entries[key]; ok {
+		c.size -= cachedSize(key, cached.entry)
+	}
+	cached := &cachedUTXO{spent: entry == nil, dirty: true}
+	if entry != nil {
+		cached.entry = *entry
+	}
+	c.entries[key] = cached
+	c.size += cachedSize(key, cached.entry)
+}
+
+func cachedSize(key string, entry UTXOEntry) int {
+	return len(key) + len(entry.Output.PubKeyHash) + utxoCacheEntryOverhead
+}
+
+// 将区块应用到 UTXO 集, 区块必须延伸缓存对应的最新区块
+// 区块中的交易在加入区块链时已检查过, 花费不存在的输出说明 UTXO 集与区块链不一致, 返回错误
+func (c *utxoCache) connect(block *Block) error {
+	if !bytes.Equal(block.PrevHash, c.tip) {
+		return fmt.Errorf("block %x does not extend the UTXO set at %x", block.Hash, c.tip)
+	}
+
+	var spent []spentUTXO
+	inBlock := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, vin := range tx.Vin {
+				key := string(utxoKey(vin.Txid, vin.Vout))
+				entry, found, err := c.get(key)
+				if err != nil {
+					return err
+				}
+				if !found {
+					return fmt.Errorf("block %x spends an unknown or spent output %x:%d", block.Hash, vin.Txid, vin.Vout)
+				}
+				c.set(key, nil)
+				// 同一区块中创建的输出在撤销区块时随交易一起移除, 不需要放回
+				if !inBlock[string(vin.Txid)] {
+					spent = append(spent, spentUTXO{vin.Txid, vin.Vout, entry})
+				}
+			}
+		}
+
+		for outIdx, out := range tx.Vout {
+			// 不覆盖已存在的输出, 否则撤销区块时原来的输出无法恢复
+			key := string(utxoKey(tx.ID, outIdx))
+			if _, found, err := c.get(key); err != nil {
+				return err
+			} else if found {
+				return fmt.Errorf("block %x creates an existing output %x:%d", block.Hash, tx.ID, outIdx)
+			}
+			c.set(key, &UTXOEntry{out, block.Height, tx.IsCoinbase()})
+		}
+		inBlock[string(tx.ID)] = true
+	}
+
+	data := gobEncode(spent)
+	c.undo[string(block.Hash)] = data
+	c.size += len(block.Hash) + len(data) + utxoCacheEntryOverhead
+	c.tip = block.Hash
+	return nil
+}
+
+// 从 UTXO 集中撤销区块: 移除区块创建的 UTXO, 放回区块花费的 UTXO, 区块必须是缓存对应的最新区块
+func (c *utxoCache) disconnect(block *Block) error {
+	if !bytes.Equal(block.Hash, c.tip) {
+		return fmt.Errorf("block %x is not the tip of the UTXO set", block.Hash)
+	}
+	spent, err := c.undoData(block.Hash)
+	if err != nil {
+		return err
+	}
+
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+		for outIdx := range tx.Vout {
+			c.set(string(utxoKey(tx.ID, outIdx)), nil)
+		}
+	}
+	for _, s := range spent {
+		c.set(string(utxoKey(s.Txid, s.Vout)), &s.Entry)
+	}
+
+	c.undo[string(block.Hash)] = nil
+	c.tip = nil
+	if len(block.PrevHash) > 0 {
+		c.tip = block.PrevHash
+	}
+	return nil
+}
+
+// 读取区块花费的 UTXO, 还没有写入存储的撤销数据保存在缓存中
+func (c *utxoCache) undoData(hash []byte) ([]spentUTXO, error) {
+	data, ok := c.undo[string(hash)]
+	if !ok {
+		if err := c.store.View(func(tx StoreTx) error {
+			data = tx.IndexGet(utxoUndoBucket, hash)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if data == nil {
+		return nil, fmt.Errorf("no undo data for block %x", hash)
+	}
+	var spent []spentUTXO
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&spent); err != nil {
+		return nil, err
+	}
+	return spent, nil
+}
+
+// 将 UTXO 集更新到区块链的最新区块: 撤销已不在主链上的区块, 再依次应用新的主链区块
+// 失败时丢弃缓存中还没有写入存储的修改, 下次更新时从存储中的状态重新开始
+func (c *utxoCache) updateToTip() error {
+	var detach, attach []*Block
+	err := c.store.View(func(tx StoreTx) error {
+		var oldTip *Block
+		if c.tip != nil {
+			if oldTip = tx.Block(c.tip); oldTip == nil {
+				return fmt.Errorf("UTXO set tip %x is not found", c.tip)
+			}
+		}
+		var err error
+		detach, attach, err = reorgBranches(tx, oldTip, tx.Block(tx.Tip()))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(attach) > 1 {
+		fmt.Printf("Updating UTXO set with %d blocks of the main chain...\n", len(attach))
+	}
+
+	for _, block := range detach {
+		if err := c.disconnect(block); err != nil {
+			c.discard()
+			return err
+		}
+		if err := c.maybeFlush(); err != nil {
+			return err
+		}
+	}
+	for i := len(attach) - 1; i >= 0; i-- {
+		if err := c.connect(attach[i]); err != nil {
+			c.discard()
+			return err
+		}
+		if err := c.maybeFlush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UTXO 缓存之上的临时视图, 修改只保存在视图中, 不影响 UTXO 集
+// 用于根据任意区块(包括分叉上的区块)对应的 UTXO 集检查交易, 使用期间调用者需持有缓存的锁
+// entries	UTXO 的键 -> 视图中修改过的记录, nil 表示已花费
+type utxoView struct {
+	cache   *utxoCache
+	entries map[string]*UTXOEntry
+}
+
+// 返回区块 hash 对应的 UTXO 集的视图: 从缓存对应的最新区块撤销到分叉点, 再依次应用 hash 所在分叉上的区块
+// 应用的区块在加入区块链时已检查过交易
+func (c *utxoCache) viewAt(hash []byte) (*utxoView, error) {
+	var detach, attach []*Block
+	err := c.store.View(func(tx StoreTx) error {
+		target := tx.Block(hash)
+		if target == nil {
+			return fmt.Errorf("block %x is not found", hash)
+		}
+		var tip *Block
+		if c.tip != nil {
+			if tip = tx.Block(c.tip); tip == nil {
+				return fmt.Errorf("UTXO set tip %x is not found", c.tip)
+			}
+		}
+		var err error
+		detach, attach, err = reorgBranches(tx, tip, target)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	view := &utxoView{cache: c, entries: make(map[string]*UTXOEntry)}
+	for _, block := range detach {
+		if err := view.disconnect(block); err != nil {
+			return nil, err
+		}
+	}
+	for i := len(attach) - 1; i >= 0; i-- {
+		view.connect(attach[i])
+	}
+	return view, nil
+}
+
+// 查询视图中的 UTXO, 视图中没有修改过时从缓存中查询
+func (v *utxoView) get(txid []byte, vout int) (UTXOEntry, bool, error) {
+	key := string(utxoKey(txid, vout))
+	if entry, ok := v.entries[key]; ok {
+		if entry == nil {
+			return UTXOEntry{}, false, nil
+		}
+		return *entry, true, nil
+	}
+	return v.cache.get(key)
+}
+
+// 在视图中应用区块
+func (v *utxoView) connect(block *Block) {
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, vin := range tx.Vin {
+				v.entries[string(utxoKey(vin.Txid, vin.Vout))] = nil
+			}
+		}
+		for outIdx, out := range tx.Vout {
+			v.entries[string(utxoKey(tx.ID, outIdx))] = &UTXOEntry{out, block.Height, tx.IsCoinbase()}
+		}
+	}
+}
+
+// 在视图中撤销区块, 使用缓存或存储中的撤销数据
+func (v *utxoView) disconnect(block *Block) error {
+	spent, err := v.cache.undoData(block.Hash)
+	if err != nil {
+		return err
+	}
+	for _, tx := range block.Transactions {
+		for outIdx := range tx.Vout {
+			v.entries[string(utxoKey(tx.ID, outIdx))] = nil
+		}
+	}
+	for i := range spent {
+		v.entries[string(utxoKey(spent[i].Txid, spent[i].Vout))] = &spent[i].Entry
+	}
+	return nil
+}
+
+// 缓存超过内存上限或距离上次刷新的时间过长时刷新
+func (c *utxoCache) maybeFlush() error {
+	if c.size <= c.maxSize && time.Since(c.lastFlush) < utxoFlushInterval {
+		return nil
+	}
+	return c.flush()
+}
+
+// 在一个事务中将缓存中的修改、撤销数据和缓存对应的最新区块写入存储
+// 之后缓存中的记录都与存储一致, 仍超过内存上限时清空缓存
+func (c *utxoCache) flush() error {
+	if len(c.undo) > 0 || !bytes.Equal(c.tip, c.flushedTip) {
+		err := c.store.Update(func(tx StoreTx) error {
+			for key, cached := range c.entries {
+				if !cached.dirty {
+					continue
+				}
+				txid, vout, _ := parseUTXOKey([]byte(key))
+				var err error
+				if cached.spent {
+					err = tx.DeleteUTXO(txid, vout)
+				} else {
+					err = tx.PutUTXO(txid, vout, cached.entry)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			for hash, data := range c.undo {
+				var err error
+				if data == nil {
+					err = tx.IndexDelete(utxoUndoBucket, []byte(hash))
+				} else {
+					err = tx.IndexPut(utxoUndoBucket, []byte(hash), data)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if c.tip == nil {
+				return tx.IndexDelete(indexTipsBucket, []byte(utxoBucket))
+			}
+			return tx.IndexPut(indexTipsBucket, []byte(utxoBucket), c.tip)
+		})
+		if err != nil {
+			return err
+		}
+		c.flushedTip = c.tip
+		c.undo = make(map[string][]byte)
+	}
+	c.lastFlush = time.Now()
+
+	c.size = 0
+	for key, cached := range c.entries {
+		if cached.spent {
+			delete(c.entries, key)
+			continue
+		}
+		cached.dirty = false
+		c.size += cachedSize(key, cached.entry)
+	}
+	if c.size > c.maxSize {
+		c.entries = make(map[string]*cachedUTXO)
+		c.size = 0
+	}
+	return nil
+}
+
+// 按交易ID和输出序号的顺序遍历 UTXO 集, 存储中的记录被缓存中的修改覆盖
+func (c *utxoCache) forEach(fn func(txid []byte, vout int, entry UTXOEntry) error) error {
+	// 缓存中新增或修改的记录, 按键排序后与存储中的记录归并
+	var added []string
+	for key, cached := range c.entries {
+		if cached.dirty && !cached.spent {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	emit := func(key string) error {
+		txid, vout, _ := parseUTXOKey([]byte(key))
+		return fn(txid, vout, c.entries[key].entry)
+	}
+
+	return c.store.View(func(tx StoreTx) error {
+		err := tx.ForEachUTXO(func(txid []byte, vout int, entry UTXOEntry) error {
+			key := string(utxoKey(txid, vout))
+			for len(added) > 0 && added[0] < key {
+				if err := emit(added[0]); err != nil {
+					return err
+				}
+				added = added[1:]
+			}
+			if len(added) > 0 && added[0] == key {
+				added = added[1:]
+			}
+			if cached, ok := c.entries[key]; ok {
+				if cached.spent {
+					return nil
+				}
+				entry = cached.entry
+			}
+			return fn(txid, vout, entry)
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range added {
+			if err := emit(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetUTXOCacheSize 设置 UTXO 缓存的内存上限(字节), 缓存超过上限时写入存储并清空
+func (bc *BlockChain) SetUTXOCacheSize(size int) {
+	c := bc.utxo
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxSize = size
+	if err := c.maybeFlush(); err != nil {
+		fmt.Printf("Failed to flush UTXO set: %v\n", err)
+	}
+}
@@ -0,0 +1,100 @@
+package blockchain
+
+// 测试方法
+// go test -v ./blockchain -run TestUTXOCache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 返回存储中的 UTXO 集对应的区块和记录数, 不包括缓存中的修改
+func storedUTXO(t *testing.T, bc *BlockChain) ([]byte, int) {
+	var tip []byte
+	count := 0
+	assert.NoError(t, bc.store.View(func(tx StoreTx) error {
+		tip = tx.IndexGet(indexTipsBucket, []byte(utxoBucket))
+		return tx.ForEachUTXO(func(_ []byte, _ int, _ UTXOEntry) error {
+			count++
+			return nil
+		})
+	}))
+	return tip, count
+}
+
+func TestUTXOCacheFlush(t *testing.T) {
+	bc, wallet := newTestBlockChain(t, 0)
+	address := string(wallet.GetAddress())
+	genesis := bc.Tip()
+	utxo := UTXOSet{bc}
+
+	for i := 0; i < 2; i++ {
+		bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+		assert.NoError(t, utxo.UpdateToTip())
+	}
+	assert.NoError(t, utxo.UpdateToTip(), "Already at the tip")
+	assert.Equal(t, 3, utxo.CountTransactions())
+	assert.Len(t, utxo.FindUTXO(HashPubKey(wallet.PublicKey)), 3)
+
+	// 修改还保存在缓存中, 存储中的 UTXO 集仍对应创世块
+	tip, count := storedUTXO(t, bc)
+	assert.Equal(t, genesis, tip)
+	assert.Equal(t, 1, count)
+
+	// 重新打开时从存储中记录的区块开始应用之后的主链区块
+	reopened, err := NewBlockChainWithStore(bc.store)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, UTXOSet{reopened}.CountTransactions())
+
+	// 刷新在一个事务中写入修改和对应的最新区块
+	assert.NoError(t, utxo.Flush())
+	tip, count = storedUTXO(t, bc)
+	assert.Equal(t, bc.Tip(), tip)
+	assert.Equal(t, 3, count)
+	for _, cached := range bc.utxo.entries {
+		assert.False(t, cached.dirty)
+	}
+
+	// 超过内存上限时应用区块后立即刷新并清空缓存
+	bc.SetUTXOCacheSize(1)
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(address, "")})
+	assert.NoError(t, utxo.UpdateToTip())
+	tip, count = storedUTXO(t, bc)
+	assert.Equal(t, bc.Tip(), tip)
+	assert.Equal(t, 4, count)
+	assert.Empty(t, bc.utxo.entries)
+	assert.Equal(t, 4, utxo.CountTransactions())
+}
+
+func TestUTXOCacheReorg(t *testing.T) {
+	bc, alice := newTestBlockChain(t, 1)
+	bob := NewWallet()
+	utxo := UTXOSet{bc}
+	coinbase := genesisCoinbase(bc)
+
+	spend := spendTx(alice, coinbase, 0, string(bob.GetAddress()), 4, 1)
+	bc.MineBlock([]*Transaction{NewCoinbaseTX(string(alice.GetAddress()), ""), spend})
+	assert.NoError(t, utxo.UpdateToTip())
+	_, found := utxo.FindOutput(coinbase.ID, 0)
+	assert.False(t, found)
+	assert.Len(t, utxo.FindUTXO(HashPubKey(bob.PublicKey)), 1)
+
+	// 切换到从高度 1 分叉的链, 撤销花费 coinbase 的区块
+	fork := newTestFork(t, bc, mainChainBlock(t, bc, 1), 2, string(NewWallet().GetAddress()))
+	for _, block := range fork {
+		assert.NoError(t, bc.AddBlock(block))
+	}
+	assert.NoError(t, utxo.UpdateToTip())
+	entry, found := utxo.FindEntry(coinbase.ID, 0)
+	assert.True(t, found)
+	assert.Equal(t, UTXOEntry{coinbase.Vout[0], 0, true}, entry)
+	assert.Empty(t, utxo.FindUTXO(HashPubKey(bob.PublicKey)))
+
+	// 结果与从创世块重建相同
+	before := utxo.FindUTXO(HashPubKey(alice.PublicKey))
+	count := utxo.CountTransactions()
+	utxo.Reindex()
+	assert.ElementsMatch(t, before, utxo.FindUTXO(HashPubKey(alice.PublicKey)))
+	assert.Equal(t, count, utxo.CountTransactions())
+}
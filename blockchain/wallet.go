@@ -32,7 +32,8 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 	if err != nil {
 		panic(fmt.Sprintf("failed to generate key pair: %v", err))
 	}
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	// X 和 Y 各占 32 字节, 验证时从中间拆分; 已保存的钱包仍使用原来的公钥和地址
+	pubKey := append(private.PublicKey.X.FillBytes(make([]byte, 32)), private.PublicKey.Y.FillBytes(make([]byte, 32))...)
 
 	return *private, pubKey
 }
@@ -8,15 +8,26 @@ package cli
 // 3. 创建区块链: ./go-blockchain createblockchain -address ADDRESS
 // 4. 获取余额: ./go-blockchain getbalance -address ADDRESS
 // 5. 打印区块链: ./go-blockchain printchain
+//    或打印一段高度: ./go-blockchain printchain -from 10 -to 20
 // 6. 转账: ./go-blockchain send -from FROM -to TO -amount AMOUNT -mine
+//    或提交给指定节点: ./go-blockchain send -from FROM -to TO -amount AMOUNT -node localhost:3001
 // 7. 重建 UTXO 索引: ./go-blockchain reindexutxo
-// 8. 启动节点: NODE_ID=3000 ./go-blockchain startnode -miner ADDRESS
+// 8. 启动节点: NODE_ID=3000 ./go-blockchain startnode -miner ADDRESS -peers localhost:3001,localhost:3002
+// 9. 外部矿工: ./go-blockchain miner -address ADDRESS -node localhost:3000
+// 10. 质押: ./go-blockchain stake -from FROM -amount AMOUNT -mine
+// 11. 查询交易: ./go-blockchain gettransaction -txid TXID
+// 12. 查询区块: ./go-blockchain getblock -height HEIGHT
+// 13. 地址的交易记录: ./go-blockchain listtransactions -address ADDRESS -skip 0 -count 10
 
 import (
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/ReisenCW/go-simple-blockchain/blockchain"
 )
 
 type CLI struct {
@@ -34,14 +45,29 @@ func (cli *CLI) validateArgs() {
 
 func (cli *CLI) printUsage() {
 	fmt.Println("Usage:")
-	fmt.Println("  getbalance -address ADDRESS - Get balance of ADDRESS")
-	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
-	fmt.Println("  printchain - Print all the blocks of the blockchain")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT -mine - Send AMOUNT of coins from FROM address to TO. Mine on the same node, when -mine is set.")
+	fmt.Println("  getbalance -address ADDRESS - Get balance of ADDRESS, from the address index when it is enabled")
+	fmt.Println("  listtransactions -address ADDRESS -skip N -count N - List the main chain transactions of ADDRESS from newest to oldest. Builds the address index on first use")
+	fmt.Println("  createblockchain -address ADDRESS -consensus pow|poa|pos -signers ADDRESSES - Create a blockchain and send genesis block reward to ADDRESS. With -consensus poa the comma separated SIGNERS seal blocks in rotation, with -consensus pos they seal blocks in rotation until coins are staked")
+	fmt.Println("  printchain -from HEIGHT -to HEIGHT - Print the main chain blocks from height FROM to TO, descending when FROM is greater. Prints from the tip to the genesis block by default")
+	fmt.Println("  getblock -height HEIGHT | -hash HASH - Print the block at HEIGHT of the main chain or the block HASH")
+	fmt.Println("  gettransaction -txid TXID - Print the transaction TXID and the block containing it. Builds the transaction index on first use")
+	fmt.Println("  send -from FROM -to TO -amount AMOUNT -fee FEE -rbf -mine -node NODES - Send AMOUNT of coins from FROM address to TO paying FEE to the miner. Mine on the same node, when -mine is set, otherwise submit to the first available node in NODES. -rbf allows bumping the fee later")
+	fmt.Println("  stake -from FROM -amount AMOUNT -fee FEE -mine -node NODES - Lock AMOUNT of coins of FROM as stake, which weights FROM when selecting validators of a pos chain. Staked coins can not be spent")
+	fmt.Println("  bumpfee -txid TXID -fee FEE -node NODES - Replace the unconfirmed replaceable transaction TXID in the mempool of the first available node in NODES with one paying FEE in total")
 	fmt.Println("  createwallet - Generates a new key-pair and saves it into the wallet file")
 	fmt.Println("  reindexutxo - Rebuilds the UTXO set")
 	fmt.Println("  listaddresses - Lists all addresses from the wallet file")
-	fmt.Println("  startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println("  startnode -miner ADDRESS -blockinterval DURATION -peers NODES - Start a node with ID specified in NODE_ID env. var. -miner enables mining, -blockinterval mines empty blocks when idle, -peers sets the nodes to connect to")
+	fmt.Println("      -miningthreads N - Search for the proof of work with N goroutines, all CPUs by default")
+	fmt.Println("      -checkpoints HEIGHT:HASH,... -maxreorgdepth N - Never replace the main chain blocks at the checkpoints, refuse forks rolling back more than N blocks (negative disables)")
+	fmt.Println("      -maxtimedrift DURATION - Reject blocks with timestamps further ahead of the network-adjusted time")
+	fmt.Println("      -txindex - Maintain the transaction index, building it from the main chain on first use")
+	fmt.Println("      -addrindex - Maintain the address index, building it from the main chain on first use")
+	fmt.Println("      -utxocache MB - Keep up to MB megabytes of the UTXO set in memory, writing changes to the database in batches")
+	fmt.Println("      -maxmempool MB -maxmempooltx N -mempoolexpiry DURATION -minrelayfee FEE - Limit the mempool size, expiry and minimum fee rate")
+	fmt.Println("  savemempool -file FILE -node NODE - Save a snapshot of the mempool of the running NODE to FILE, the first seed node by default")
+	fmt.Println("  loadmempool -file FILE -node NODE - Load the transactions in FILE into the mempool of the running NODE, the first seed node by default")
+	fmt.Println("  miner -address ADDRESS -node NODE -threads N -poll DURATION - Mine block templates fetched from NODE and submit solved blocks to it, rewards go to ADDRESS")
 }
 
 func (cli *CLI) Run() {
@@ -61,14 +87,64 @@ func (cli *CLI) Run() {
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	saveMempoolCmd := flag.NewFlagSet("savemempool", flag.ExitOnError)
+	loadMempoolCmd := flag.NewFlagSet("loadmempool", flag.ExitOnError)
+	bumpFeeCmd := flag.NewFlagSet("bumpfee", flag.ExitOnError)
+	minerCmd := flag.NewFlagSet("miner", flag.ExitOnError)
+	stakeCmd := flag.NewFlagSet("stake", flag.ExitOnError)
+	getTransactionCmd := flag.NewFlagSet("gettransaction", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
+	listTransactionsCmd := flag.NewFlagSet("listtransactions", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
 	createBlockChainAddress := createBlockChainCmd.String("address", "", "The address to send genesis block reward to")
+	createBlockChainConsensus := createBlockChainCmd.String("consensus", blockchain.ConsensusPoW, "Consensus of the chain, pow, poa or pos")
+	createBlockChainSigners := createBlockChainCmd.String("signers", "", "Comma separated addresses sealing blocks in rotation for poa, initial validators for pos")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Transaction fee paid to the miner")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendRBF := sendCmd.Bool("rbf", false, "Allow the transaction to be replaced by one paying a higher fee")
+	sendNode := sendCmd.String("node", "", "Comma separated node addresses to submit the transaction to")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodePeers := startNodeCmd.String("peers", "", "Comma separated peer addresses to connect to")
+	startNodeBlockInterval := startNodeCmd.Duration("blockinterval", 0, "Mine an empty block after this long without transactions, 0 disables")
+	startNodeMempoolMB := startNodeCmd.Int("maxmempool", 32, "Maximum mempool size in megabytes")
+	startNodeMempoolCount := startNodeCmd.Int("maxmempooltx", 50000, "Maximum number of transactions in the mempool")
+	startNodeMempoolExpiry := startNodeCmd.Duration("mempoolexpiry", 72*time.Hour, "Remove transactions staying longer than this from the mempool")
+	startNodeMinRelayFee := startNodeCmd.Int("minrelayfee", 0, "Minimum fee per 1000 bytes for relaying transactions")
+	startNodeMiningThreads := startNodeCmd.Int("miningthreads", 0, "Number of goroutines searching for the proof of work, 0 uses all CPUs")
+	startNodeCheckpoints := startNodeCmd.String("checkpoints", "", "Comma separated HEIGHT:HASH checkpoints enforced in addition to the built-in ones")
+	startNodeMaxTimeDrift := startNodeCmd.Duration("maxtimedrift", blockchain.DefaultMaxTimeDrift, "Reject blocks with timestamps further ahead of the network-adjusted time")
+	startNodeTxIndex := startNodeCmd.Bool("txindex", false, "Maintain the transaction index")
+	startNodeAddrIndex := startNodeCmd.Bool("addrindex", false, "Maintain the address index")
+	startNodeUTXOCacheMB := startNodeCmd.Int("utxocache", blockchain.DefaultUTXOCacheSize>>20, "Maximum UTXO cache size in megabytes")
+	startNodeMaxReorgDepth := startNodeCmd.Int("maxreorgdepth", blockchain.DefaultMaxReorgDepth, "Refuse forks rolling back more than this many blocks, negative disables the limit")
+	saveMempoolFile := saveMempoolCmd.String("file", "", "The file to save the mempool snapshot to")
+	saveMempoolNode := saveMempoolCmd.String("node", "", "The node to save the mempool of, the first seed node by default")
+	loadMempoolFile := loadMempoolCmd.String("file", "", "The mempool snapshot to load")
+	loadMempoolNode := loadMempoolCmd.String("node", "", "The node to load the snapshot into, the first seed node by default")
+	bumpFeeTxID := bumpFeeCmd.String("txid", "", "The transaction to replace")
+	bumpFeeFee := bumpFeeCmd.Int("fee", 0, "The new total fee of the transaction")
+	bumpFeeNode := bumpFeeCmd.String("node", "", "Comma separated node addresses to submit the replacement to")
+	minerAddress := minerCmd.String("address", "", "The address to send mining rewards to")
+	minerNode := minerCmd.String("node", "", "The node to fetch block templates from, the first seed node by default")
+	minerThreads := minerCmd.Int("threads", 0, "Number of goroutines searching for the proof of work, 0 uses all CPUs")
+	minerPoll := minerCmd.Duration("poll", 5*time.Second, "Interval of checking the node for a new block template")
+	stakeFrom := stakeCmd.String("from", "", "The address staking coins")
+	stakeAmount := stakeCmd.Int("amount", 0, "Amount to stake")
+	stakeFee := stakeCmd.Int("fee", 0, "Transaction fee paid to the miner")
+	stakeMine := stakeCmd.Bool("mine", false, "Mine immediately on the same node")
+	stakeNode := stakeCmd.String("node", "", "Comma separated node addresses to submit the transaction to")
+	getTransactionTxID := getTransactionCmd.String("txid", "", "The transaction to look up")
+	printChainFrom := printChainCmd.Int("from", -1, "Height of the first block to print, the tip by default")
+	printChainTo := printChainCmd.Int("to", 0, "Height of the last block to print")
+	getBlockHeight := getBlockCmd.Int("height", -1, "Height of the block in the main chain")
+	getBlockHash := getBlockCmd.String("hash", "", "Hash of the block")
+	listTransactionsAddress := listTransactionsCmd.String("address", "", "The address to list transactions for")
+	listTransactionsSkip := listTransactionsCmd.Int("skip", 0, "Number of newest transactions to skip")
+	listTransactionsCount := listTransactionsCmd.Int("count", 10, "Maximum number of transactions to list")
 
 	switch os.Args[1] {
 	case "getbalance":
@@ -111,6 +187,46 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "savemempool":
+		err := saveMempoolCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "loadmempool":
+		err := loadMempoolCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "bumpfee":
+		err := bumpFeeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "miner":
+		err := minerCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "stake":
+		err := stakeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "gettransaction":
+		err := getTransactionCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getblock":
+		err := getBlockCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "listtransactions":
+		err := listTransactionsCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		os.Exit(1)
@@ -127,20 +243,28 @@ func (cli *CLI) Run() {
 			createBlockChainCmd.Usage()
 			os.Exit(1)
 		}
-		cli.createBlockChain(*createBlockChainAddress, nodeID)
+		params := blockchain.ChainParams{
+			Consensus: *createBlockChainConsensus,
+			Signers:   splitNodes(*createBlockChainSigners),
+		}
+		cli.createBlockChain(*createBlockChainAddress, nodeID, params)
 	}
 
 	if printChainCmd.Parsed() {
-		cli.printChain(nodeID)
+		cli.printChain(nodeID, *printChainFrom, *printChainTo)
 	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 {
 			sendCmd.Usage()
 			os.Exit(1)
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		nodes := splitNodes(*sendNode)
+		if len(nodes) == 0 {
+			nodes = blockchain.DefaultSeedNodes
+		}
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendRBF, nodeID, *sendMine, nodes)
 	}
 	if createWalletCmd.Parsed() {
 		cli.createWallet(nodeID)
@@ -158,7 +282,121 @@ func (cli *CLI) Run() {
 			startNodeCmd.Usage()
 			os.Exit(1)
 		}
-		cli.startNode(nodeID, *startNodeMiner)
+		mempoolOpts := []blockchain.MempoolOption{
+			blockchain.WithMaxMempoolBytes(*startNodeMempoolMB * 1024 * 1024),
+			blockchain.WithMaxMempoolCount(*startNodeMempoolCount),
+			blockchain.WithMempoolExpiry(*startNodeMempoolExpiry),
+			blockchain.WithMinRelayFee(*startNodeMinRelayFee),
+		}
+		checkpoints, err := blockchain.ParseCheckpoints(*startNodeCheckpoints)
+		if err != nil {
+			fmt.Println(err)
+			startNodeCmd.Usage()
+			os.Exit(1)
+		}
+		chainOpts := []blockchain.NodeOption{
+			blockchain.WithCheckpoints(checkpoints),
+			blockchain.WithMaxReorgDepth(*startNodeMaxReorgDepth),
+			blockchain.WithMaxTimeDrift(*startNodeMaxTimeDrift),
+			blockchain.WithUTXOCacheSize(*startNodeUTXOCacheMB * 1024 * 1024),
+		}
+		if *startNodeTxIndex {
+			chainOpts = append(chainOpts, blockchain.WithTxIndex())
+		}
+		if *startNodeAddrIndex {
+			chainOpts = append(chainOpts, blockchain.WithAddrIndex())
+		}
+		cli.startNode(nodeID, *startNodeMiner, *startNodeBlockInterval, *startNodeMiningThreads, splitNodes(*startNodePeers), mempoolOpts, chainOpts)
+	}
+
+	if saveMempoolCmd.Parsed() {
+		if *saveMempoolFile == "" {
+			saveMempoolCmd.Usage()
+			os.Exit(1)
+		}
+		node := *saveMempoolNode
+		if node == "" {
+			node = blockchain.DefaultSeedNodes[0]
+		}
+		cli.saveMempool(node, *saveMempoolFile)
+	}
+	if loadMempoolCmd.Parsed() {
+		if *loadMempoolFile == "" {
+			loadMempoolCmd.Usage()
+			os.Exit(1)
+		}
+		node := *loadMempoolNode
+		if node == "" {
+			node = blockchain.DefaultSeedNodes[0]
+		}
+		cli.loadMempool(node, *loadMempoolFile)
+	}
+	if bumpFeeCmd.Parsed() {
+		if *bumpFeeTxID == "" || *bumpFeeFee <= 0 {
+			bumpFeeCmd.Usage()
+			os.Exit(1)
+		}
+		nodes := splitNodes(*bumpFeeNode)
+		if len(nodes) == 0 {
+			nodes = blockchain.DefaultSeedNodes
+		}
+		cli.bumpFee(*bumpFeeTxID, *bumpFeeFee, nodeID, nodes)
+	}
+	if minerCmd.Parsed() {
+		if *minerAddress == "" || *minerPoll <= 0 {
+			minerCmd.Usage()
+			os.Exit(1)
+		}
+		node := *minerNode
+		if node == "" {
+			node = blockchain.DefaultSeedNodes[0]
+		}
+		cli.mine(*minerAddress, node, *minerThreads, *minerPoll)
+	}
+	if stakeCmd.Parsed() {
+		if *stakeFrom == "" || *stakeAmount <= 0 || *stakeFee < 0 {
+			stakeCmd.Usage()
+			os.Exit(1)
+		}
+		nodes := splitNodes(*stakeNode)
+		if len(nodes) == 0 {
+			nodes = blockchain.DefaultSeedNodes
+		}
+		cli.stake(*stakeFrom, *stakeAmount, *stakeFee, nodeID, *stakeMine, nodes)
+	}
+	if getTransactionCmd.Parsed() {
+		if *getTransactionTxID == "" {
+			getTransactionCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getTransaction(*getTransactionTxID, nodeID)
+	}
+	if getBlockCmd.Parsed() {
+		if (*getBlockHeight < 0) == (*getBlockHash == "") {
+			getBlockCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getBlock(nodeID, *getBlockHeight, *getBlockHash)
+	}
+	if listTransactionsCmd.Parsed() {
+		if *listTransactionsAddress == "" || *listTransactionsSkip < 0 || *listTransactionsCount <= 0 {
+			listTransactionsCmd.Usage()
+			os.Exit(1)
+		}
+		cli.listTransactions(*listTransactionsAddress, nodeID, *listTransactionsSkip, *listTransactionsCount)
 	}
 }
 
+// 解析逗号分隔的节点地址列表
+func splitNodes(list string) []string {
+	var nodes []string
+
+	for _, node := range strings.Split(list, ",") {
+		node = strings.TrimSpace(node)
+		if node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
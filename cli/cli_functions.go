@@ -1,17 +1,27 @@
 package cli
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/ReisenCW/go-simple-blockchain/blockchain"
 )
 
-func (cli *CLI) createBlockChain(address string, nodeID string) {
+func (cli *CLI) createBlockChain(address string, nodeID string, params blockchain.ChainParams) {
 	if !blockchain.ValidateAddress(address) {
 		log.Panic("ERROR: Address is not valid")
 	}
-	bc, err := blockchain.CreateBlockChain(address, nodeID)
+	bc, err := blockchain.CreateBlockChain(address, nodeID, blockchain.WithChainParams(params))
 	if err != nil {
 		fmt.Printf("Error creating blockchain: %v\n", err)
 		return
@@ -38,37 +48,156 @@ func (cli *CLI) getBalance(address string, nodeID string) {
 	balance := 0
 	pubKeyHash := blockchain.Base58Decode([]byte(address))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
+	// 启用了地址索引时直接读取余额, 否则遍历 UTXO 集
+	if bc.AddrIndexEnabled() {
+		balance, err = bc.AddressBalance(pubKeyHash)
+		if err != nil {
+			fmt.Printf("Error reading balance: %v\n", err)
+			return
+		}
+	} else {
+		UTXOs := UTXOSet.FindUTXO(pubKeyHash)
 
-	for _, out := range UTXOs {
-		balance += out.Value
+		for _, out := range UTXOs {
+			balance += out.Value
+		}
 	}
 
 	fmt.Printf("Balance of '%s': %d\n", address, balance)
 }
 
-func (cli *CLI) printChain(nodeID string) {
-	bc, _ := blockchain.NewBlockChain(nodeID)
+// 通过地址索引按高度从新到旧列出地址的交易记录, 第一次使用时根据主链建立索引
+func (cli *CLI) listTransactions(address string, nodeID string, skip, count int) {
+	if !blockchain.ValidateAddress(address) {
+		log.Panic("ERROR: Address is not valid")
+	}
+	bc, err := blockchain.NewBlockChain(nodeID)
+	if err != nil {
+		fmt.Printf("Error opening blockchain: %v\n", err)
+		return
+	}
 	defer bc.CloseDB()
 
-	bci := bc.Iterator()
-	for {
-		block := bci.Next()
+	if err := bc.EnableAddrIndex(); err != nil {
+		fmt.Printf("Error building address index: %v\n", err)
+		return
+	}
+	pubKeyHash := blockchain.Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+	history, total, err := bc.AddressTransactions(pubKeyHash, skip, count)
+	if err != nil {
+		fmt.Printf("Error listing transactions: %v\n", err)
+		return
+	}
+
+	for _, tx := range history {
+		fmt.Printf("%x height %d %+d\n", tx.TxID, tx.Height, tx.Delta)
+	}
+	fmt.Printf("Transactions %d-%d of %d\n", min(skip+1, total), skip+len(history), total)
+}
+
+// 按高度打印主链上从 from 到 to 的区块, from 为负数时从最新区块开始
+func (cli *CLI) printChain(nodeID string, from, to int) {
+	bc, err := blockchain.NewBlockChain(nodeID)
+	if err != nil {
+		fmt.Printf("Error opening blockchain: %v\n", err)
+		return
+	}
+	defer bc.CloseDB()
 
+	if from < 0 {
+		from = bc.GetBestHeight()
+	}
+	err = bc.ForEachBlockInRange(from, to, func(block *blockchain.Block) error {
+		fmt.Printf("Height: %d\n", block.Height)
 		fmt.Printf("Prev. hash: %x\n", block.PrevHash)
 		fmt.Printf("Hash: %x\n", block.Hash)
-		pow := blockchain.NewProofOfWork(block)
-		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
+		header := block.Header()
+		valid := bc.Engine().VerifyHeader(&header) == nil
+		fmt.Printf("%s: %s\n", strings.ToUpper(bc.Params().Consensus), strconv.FormatBool(valid))
 		fmt.Println()
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Error reading blocks: %v\n", err)
+	}
+}
 
-		// 遍历到头了
-		if len(block.PrevHash) == 0 {
-			break
+// 打印主链上高度为 height 的区块, 或哈希为 hash 的区块
+func (cli *CLI) getBlock(nodeID string, height int, hash string) {
+	bc, err := blockchain.NewBlockChain(nodeID)
+	if err != nil {
+		fmt.Printf("Error opening blockchain: %v\n", err)
+		return
+	}
+	defer bc.CloseDB()
+
+	var block blockchain.Block
+	if hash != "" {
+		id, decodeErr := hex.DecodeString(hash)
+		if decodeErr != nil {
+			log.Panic("ERROR: Block hash is not valid")
 		}
+		block, err = bc.GetBlock(id)
+	} else {
+		block, err = bc.GetBlockByHeight(height)
 	}
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	mainChain := bytes.Equal(bc.GetBlockHashByHeight(block.Height), block.Hash)
+	fmt.Printf("Hash: %x\n", block.Hash)
+	fmt.Printf("Prev. hash: %x\n", block.PrevHash)
+	fmt.Printf("Height: %d, main chain: %t\n", block.Height, mainChain)
+	fmt.Printf("Time: %s\n", time.Unix(block.TimeStamp, 0).Format(time.RFC3339))
+	fmt.Printf("Transactions: %d\n", len(block.Transactions))
+	for _, tx := range block.Transactions {
+		fmt.Println(tx)
+	}
+}
+
+// 通过交易索引查找交易, 第一次使用时根据主链建立索引
+func (cli *CLI) getTransaction(txid string, nodeID string) {
+	id, err := hex.DecodeString(txid)
+	if err != nil {
+		log.Panic("ERROR: Transaction ID is not valid")
+	}
+	bc, err := blockchain.NewBlockChain(nodeID)
+	if err != nil {
+		fmt.Printf("Error opening blockchain: %v\n", err)
+		return
+	}
+	defer bc.CloseDB()
+
+	if err := bc.EnableTxIndex(); err != nil {
+		fmt.Printf("Error building transaction index: %v\n", err)
+		return
+	}
+	loc, found, err := bc.LocateTransaction(id)
+	if err != nil {
+		fmt.Printf("Error looking up transaction: %v\n", err)
+		return
+	}
+	if !found {
+		fmt.Printf("Transaction %s is not found in the main chain\n", txid)
+		return
+	}
+	block, err := bc.GetBlock(loc.BlockHash)
+	if err != nil {
+		fmt.Printf("Error reading block: %v\n", err)
+		return
+	}
+
+	fmt.Printf("Block: %x\n", block.Hash)
+	fmt.Printf("Height: %d, position: %d, confirmations: %d\n", block.Height, loc.Position, bc.GetBestHeight()-block.Height+1)
+	fmt.Println(block.Transactions[loc.Position])
 }
 
-func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
+// nodes 为 -mine 未设置时提交交易的节点列表, 依次尝试直到有节点接受
+// 提交的交易同时记录在本地节点的内存池中, 以便之后用 bumpfee 提高手续费
+func (cli *CLI) send(from, to string, amount, fee int, replaceable bool, nodeID string, mineNow bool, nodes []string) {
 	if !blockchain.ValidateAddress(from) {
 		log.Panic("ERROR: Address from is not valid")
 	}
@@ -85,21 +214,125 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 	}
 	wallet := wallets.GetWallet(from)
 
-	tx, err := blockchain.NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
+	tx, err := blockchain.NewUTXOTransaction(&wallet, to, amount, fee, replaceable, &UTXOSet)
 	if err != nil {
 		log.Panic(err)
 	}
+	commitTx(bc, &wallet, tx, nodeID, mineNow, nodes)
+	fmt.Println("Success!")
+}
+
+// 质押 amount 个币, 质押的输出不能被花费, 在权益证明的链上按质押数量加权被选为验证者
+func (cli *CLI) stake(from string, amount, fee int, nodeID string, mineNow bool, nodes []string) {
+	if !blockchain.ValidateAddress(from) {
+		log.Panic("ERROR: Address from is not valid")
+	}
+	bc, _ := blockchain.NewBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{Blockchain: bc}
+	defer bc.CloseDB()
 
+	wallets, err := blockchain.NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet := wallets.GetWallet(from)
+
+	tx, err := blockchain.NewStakeTransaction(&wallet, amount, fee, &UTXOSet)
+	if err != nil {
+		log.Panic(err)
+	}
+	commitTx(bc, &wallet, tx, nodeID, mineNow, nodes)
+	fmt.Println("Success!")
+}
+
+// 由 wallet 在本地挖出包含交易 tx 的区块(mineNow), 或将 tx 提交给 nodes 中第一个可用的节点
+func commitTx(bc *blockchain.BlockChain, wallet *blockchain.Wallet, tx *blockchain.Transaction, nodeID string, mineNow bool, nodes []string) {
+	UTXOSet := blockchain.UTXOSet{Blockchain: bc}
 	if mineNow {
-		cbTx := blockchain.NewCoinbaseTX(from, "")
-		txs := []*blockchain.Transaction{cbTx, tx}
+		mempool := blockchain.NewMempool(bc)
+		if err := mempool.Add(tx); err != nil {
+			log.Panic(err)
+		}
+		tmpl := blockchain.NewBlockTemplate(bc, mempool, string(wallet.GetAddress()))
 
-		newBlock := bc.MineBlock(txs)
+		// 权威证明和权益证明的区块由 wallet 签名, 只有轮到 wallet 时才能挖出
+		if authorizer, ok := bc.Engine().(blockchain.Authorizer); ok {
+			authorizer.Authorize(wallet)
+		}
+		newBlock, err := bc.MineBlockContext(context.Background(), tmpl.Transactions)
+		if err != nil {
+			log.Panic(err)
+		}
 		UTXOSet.Update(newBlock)
 	} else {
-		blockchain.SendTx(blockchain.GetCentralNodeAddress(), tx)
+		node, err := blockchain.SubmitTx(nodes, tx)
+		if err != nil {
+			log.Panic(err)
+		}
+		fmt.Printf("Transaction %x submitted to %s\n", tx.ID, node)
+		addToLocalMempool(bc, nodeID, tx)
+	}
+}
+
+// 将交易加入本地节点保存的内存池, 节点下次启动时加载
+func addToLocalMempool(bc *blockchain.BlockChain, nodeID string, tx *blockchain.Transaction) {
+	mempool := blockchain.NewMempool(bc)
+	if _, err := mempool.Load(blockchain.MempoolFile(nodeID)); err != nil && !os.IsNotExist(err) {
+		log.Panic(err)
+	}
+	if err := mempool.Add(tx); err != nil {
+		fmt.Printf("Transaction is not added to the local mempool: %v\n", err)
+		return
+	}
+	if err := mempool.Save(blockchain.MempoolFile(nodeID)); err != nil {
+		log.Panic(err)
 	}
-	fmt.Println("Success!")
+}
+
+// 用手续费为 fee 的交易替换节点内存池中的交易 txid, 多出的手续费从找零中扣除
+// 原交易及其前序交易从 nodes 中第一个可以连接的节点获取, 替换交易提交给同一个节点
+func (cli *CLI) bumpFee(txid string, fee int, nodeID string, nodes []string) {
+	id, err := hex.DecodeString(txid)
+	if err != nil {
+		log.Panic("ERROR: Transaction ID is not valid")
+	}
+
+	var node string
+	var orig *blockchain.Transaction
+	var prevTXs map[string]blockchain.Transaction
+	for _, node = range nodes {
+		if orig, prevTXs, err = blockchain.GetMempoolTx(node, id); err == nil {
+			break
+		}
+		fmt.Printf("%v\n", err)
+	}
+	if orig == nil {
+		log.Panicf("ERROR: Transaction %s is not found in the mempool of any node", txid)
+	}
+
+	// 找到花费输入的钱包
+	wallets, err := blockchain.NewWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	var wallet *blockchain.Wallet
+	for _, w := range wallets.Wallets {
+		if bytes.Equal(w.PublicKey, orig.Vin[0].PubKey) {
+			wallet = w
+		}
+	}
+	if wallet == nil {
+		log.Panic("ERROR: Transaction is not sent from this wallet")
+	}
+
+	tx, err := blockchain.BumpFee(wallet, orig, fee, prevTXs)
+	if err != nil {
+		log.Panic(err)
+	}
+	if _, err := blockchain.SubmitTx([]string{node}, tx); err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Transaction %x replaced by %x, submitted to %s\n", orig.ID, tx.ID, node)
 }
 
 func (cli *CLI) createWallet(nodeID string) {
@@ -131,7 +364,7 @@ func (cli *CLI) reindexUTXO(nodeID string) {
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
 
-func (cli *CLI) startNode(nodeID, minerAddress string) {
+func (cli *CLI) startNode(nodeID, minerAddress string, blockInterval time.Duration, miningThreads int, peers []string, mempoolOpts []blockchain.MempoolOption, chainOpts []blockchain.NodeOption) {
 	fmt.Printf("Starting node %s\n", nodeID)
 	if len(minerAddress) > 0 {
 		if blockchain.ValidateAddress(minerAddress) {
@@ -140,5 +373,78 @@ func (cli *CLI) startNode(nodeID, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	blockchain.StartServer(nodeID, minerAddress)
-}
\ No newline at end of file
+	opts := []blockchain.NodeOption{
+		blockchain.WithMiningAddress(minerAddress),
+		blockchain.WithBlockInterval(blockInterval),
+		blockchain.WithMiningWorkers(miningThreads),
+		blockchain.WithMempoolOptions(mempoolOpts...),
+	}
+	opts = append(opts, chainOpts...)
+	if len(peers) > 0 {
+		opts = append(opts, blockchain.WithPeers(peers))
+	}
+	node, err := blockchain.NewNode(nodeID, opts...)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// 收到 Ctrl-C(SIGINT) 或 SIGTERM 时停止节点
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := node.Start(ctx); err != nil {
+		node.Stop()
+		log.Panic(err)
+	}
+	fmt.Printf("Listening on %s\n", node.Address())
+
+	<-ctx.Done()
+	fmt.Println("Shutting down...")
+	if err := node.Stop(); err != nil {
+		fmt.Printf("Error stopping node: %v\n", err)
+		return
+	}
+	fmt.Println("Node stopped")
+}
+
+// 作为外部矿工运行, 从节点 node 获取区块模板并提交挖出的区块, 直到收到 Ctrl-C(SIGINT) 或 SIGTERM
+func (cli *CLI) mine(address, node string, threads int, poll time.Duration) {
+	if !blockchain.ValidateAddress(address) {
+		log.Panic("ERROR: Address is not valid")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Printf("Mining block templates from %s, rewards go to %s\n", node, address)
+	blockchain.MineRemote(ctx, node, address, poll, blockchain.WithWorkers(threads))
+	fmt.Println("Miner stopped")
+}
+
+// 让运行中的节点 node 将内存池写入快照文件 file
+func (cli *CLI) saveMempool(node, file string) {
+	// 节点的工作目录可能与命令行不同, 使用绝对路径
+	path, err := filepath.Abs(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	saved, err := blockchain.SaveMempool(node, path)
+	if err != nil {
+		fmt.Printf("Error saving mempool (is the node running?): %v\n", err)
+		return
+	}
+	fmt.Printf("Saved %d transactions to %s\n", saved, path)
+}
+
+// 让运行中的节点 node 将快照文件 file 中仍然有效的交易加入内存池
+func (cli *CLI) loadMempool(node, file string) {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	loaded, size, err := blockchain.LoadMempool(node, path)
+	if err != nil {
+		fmt.Printf("Error loading mempool (is the node running?): %v\n", err)
+		return
+	}
+	fmt.Printf("Loaded %d transactions from %s, the mempool now has %d transactions\n", loaded, path, size)
+}